@@ -21,6 +21,12 @@ type CarFileResponse struct {
 	CreatedAt string `json:"created_at"`
 }
 
+// DatasetResponse is a dataset with its progress
+type DatasetResponse struct {
+	db.Dataset
+	Stats db.DatasetStats `json:"stats"`
+}
+
 type APIServer struct {
 	db         *db.Database
 	authConfig middleware.AuthConfig
@@ -144,6 +150,125 @@ func (s *APIServer) SearchFiles(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, files)
 }
 
+// ListFileCids returns the UnixFS nodes of a car file (?id=X) or every car
+// file node stored under a path (?path=X)
+func (s *APIServer) ListFileCids(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET method is allowed")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	path := r.URL.Query().Get("path")
+	if id == "" && path == "" {
+		writeError(w, http.StatusBadRequest, "id or path is required")
+		return
+	}
+
+	var cids []db.FileCid
+	var err error
+	if id != "" {
+		cids, err = s.db.ListFileCids(id)
+	} else {
+		cids, err = s.db.GetFileCidsByPath(path)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list file cids: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cids)
+}
+
+// ListFileDeals returns every deal sent for a car file (?id=X), one per
+// replica of its piece
+func (s *APIServer) ListFileDeals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET method is allowed")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "id is required")
+		return
+	}
+
+	deals, err := s.db.ListFileDeals(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list deals: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deals)
+}
+
+// ListDatasets returns every dataset with the bytes indexed, packed, dealt
+// and proven
+func (s *APIServer) ListDatasets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET method is allowed")
+		return
+	}
+
+	datasets, err := s.db.ListDatasets()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list datasets: %v", err))
+		return
+	}
+	stats, err := s.db.GetDatasetStats("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get dataset stats: %v", err))
+		return
+	}
+	statsByID := make(map[string]db.DatasetStats, len(stats))
+	for _, st := range stats {
+		statsByID[st.DatasetID] = st
+	}
+
+	resp := make([]DatasetResponse, 0, len(datasets))
+	for _, ds := range datasets {
+		resp = append(resp, DatasetResponse{Dataset: ds, Stats: statsByID[ds.ID]})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GetDataset returns one dataset (?name=X) with its progress
+func (s *APIServer) GetDataset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET method is allowed")
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	dataset, err := s.db.GetDatasetByName(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get dataset: %v", err))
+		return
+	}
+	if dataset == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("dataset %s not found", name))
+		return
+	}
+	stats, err := s.db.GetDatasetStats(dataset.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get dataset stats: %v", err))
+		return
+	}
+
+	resp := DatasetResponse{Dataset: *dataset}
+	if len(stats) > 0 {
+		resp.Stats = stats[0]
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
 func (s *APIServer) UpdateDealSentStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		writeError(w, http.StatusMethodNotAllowed, "only PUT method is allowed")
@@ -179,7 +304,7 @@ func (s *APIServer) UpdateDealSentStatus(w http.ResponseWriter, r *http.Request)
 	}
 
 	// 更新状态
-	err := s.db.UpdateDealSentStatus(idStr, dealStatus, "")
+	err := s.db.UpdateDealSentStatus(idStr, dealStatus)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update deal status: %v", err))
 		return
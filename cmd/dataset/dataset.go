@@ -0,0 +1,174 @@
+package dataset
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/minerdao/lotus-car/config"
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/util"
+	"github.com/urfave/cli/v2"
+)
+
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:  "dataset",
+		Usage: "Manage datasets",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create a new dataset",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Usage:    "Dataset name",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "source-dir",
+						Usage:    "Source parent path of the dataset",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "client",
+						Usage: "Client wallet address used to send deals of the dataset",
+					},
+					&cli.IntFlag{
+						Name:  "replicas",
+						Usage: "Target number of replicas of every piece",
+						Value: 1,
+					},
+				}, util.UnixfsFlags()...),
+				Action: func(c *cli.Context) error {
+					cfg, err := config.LoadConfig(c.String("config"))
+					if err != nil {
+						return fmt.Errorf("failed to load config: %v", err)
+					}
+
+					if c.Int("replicas") < 1 {
+						return fmt.Errorf("replicas must be at least 1")
+					}
+					sourceDir, err := filepath.Abs(c.String("source-dir"))
+					if err != nil {
+						return err
+					}
+					// 打包参数在创建时固定下来，之后修改配置不会影响已有数据集
+					params := util.UnixfsParamsFromFlags(c, util.UnixfsParams(cfg.Unixfs))
+					if err := params.Validate(); err != nil {
+						return fmt.Errorf("invalid unixfs params: %v", err)
+					}
+
+					database, err := db.InitFromConfig(cfg)
+					if err != nil {
+						return fmt.Errorf("failed to initialize database: %v", err)
+					}
+					defer database.Close()
+
+					dataset := &db.Dataset{
+						Name:           c.String("name"),
+						SourceDir:      sourceDir,
+						Client:         c.String("client"),
+						TargetReplicas: c.Int("replicas"),
+						UnixfsParams:   params.String(),
+					}
+					if err := database.CreateDataset(dataset); err != nil {
+						return fmt.Errorf("failed to create dataset: %v", err)
+					}
+
+					fmt.Printf("Dataset %s created with ID: %s\n", dataset.Name, dataset.ID)
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List all datasets with their progress",
+				Action: func(c *cli.Context) error {
+					cfg, err := config.LoadConfig(c.String("config"))
+					if err != nil {
+						return fmt.Errorf("failed to load config: %v", err)
+					}
+
+					database, err := db.InitFromConfig(cfg)
+					if err != nil {
+						return fmt.Errorf("failed to initialize database: %v", err)
+					}
+					defer database.Close()
+
+					stats, err := database.GetDatasetStats("")
+					if err != nil {
+						return err
+					}
+					if len(stats) == 0 {
+						fmt.Println("No datasets found")
+						return nil
+					}
+
+					fmt.Printf("%-24s %-10s %-10s %-10s %-10s %-10s\n", "NAME", "FILES", "INDEXED", "PACKED", "DEALT", "PROVEN")
+					for _, s := range stats {
+						fmt.Printf("%-24s %-10d %-10s %-10s %-10s %-10s\n",
+							s.Name, s.FilesIndexed,
+							util.FormatSize(s.BytesIndexed), util.FormatSize(s.BytesPacked),
+							util.FormatSize(s.BytesDealt), util.FormatSize(s.BytesProven))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "show",
+				Usage: "Show the settings and progress of a dataset",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Usage:    "Dataset name",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := config.LoadConfig(c.String("config"))
+					if err != nil {
+						return fmt.Errorf("failed to load config: %v", err)
+					}
+
+					database, err := db.InitFromConfig(cfg)
+					if err != nil {
+						return fmt.Errorf("failed to initialize database: %v", err)
+					}
+					defer database.Close()
+
+					name := c.String("name")
+					dataset, err := database.GetDatasetByName(name)
+					if err != nil {
+						return err
+					}
+					if dataset == nil {
+						return fmt.Errorf("dataset %s not found", name)
+					}
+					stats, err := database.GetDatasetStats(dataset.ID)
+					if err != nil {
+						return err
+					}
+
+					unixfs := dataset.UnixfsParams
+					if unixfs == "" {
+						unixfs = "(config defaults)"
+					}
+					fmt.Printf("ID:              %s\n", dataset.ID)
+					fmt.Printf("Name:            %s\n", dataset.Name)
+					fmt.Printf("Source dir:      %s\n", dataset.SourceDir)
+					fmt.Printf("Client:          %s\n", dataset.Client)
+					fmt.Printf("Target replicas: %d\n", dataset.TargetReplicas)
+					fmt.Printf("UnixFS params:   %s\n", unixfs)
+					fmt.Printf("Created at:      %s\n", dataset.CreatedAt.Format("2006-01-02 15:04:05"))
+					for _, s := range stats {
+						fmt.Printf("Indexed:         %d files, %s\n", s.FilesIndexed, util.FormatSize(s.BytesIndexed))
+						fmt.Printf("Packed:          %d files, %s\n", s.FilesPacked, util.FormatSize(s.BytesPacked))
+						fmt.Printf("Car files:       %d\n", s.CarFiles)
+						fmt.Printf("Dealt:           %s\n", util.FormatSize(s.BytesDealt))
+						fmt.Printf("Proven:          %s\n", util.FormatSize(s.BytesProven))
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -1,111 +1,34 @@
 package deal
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/minerdao/lotus-car/config"
 	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/market"
 	"github.com/minerdao/lotus-car/util"
 	"github.com/urfave/cli/v2"
 )
 
-// execCmd 执行命令并返回输出
-func execCmd(env, c string) (string, error) {
-	cmd := exec.Command("bash", "-c", c)
-	cmd.Env = append(os.Environ(), env)
-
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("command failed: %v, stderr: %s", err, stderr.String())
-	}
-
-	return stdout.String(), nil
-}
-
-// parseDealResponse parses the deal response string and returns a Deal struct
-func parseDealResponse(response string) (*db.Deal, error) {
-	lines := strings.Split(response, "\n")
-	deal := &db.Deal{
-		Status: "proposed", // Initial status when deal is created
-	}
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
-		}
-
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-
-		switch key {
-		case "deal uuid":
-			deal.UUID = value
-		case "storage provider":
-			deal.StorageProvider = value
-		case "client wallet":
-			deal.ClientWallet = value
-		case "payload cid":
-			deal.PayloadCid = value
-		case "commp":
-			deal.CommP = value
-		case "start epoch":
-			epoch, err := strconv.ParseInt(value, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse start epoch: %v", err)
-			}
-			deal.StartEpoch = epoch
-		case "end epoch":
-			epoch, err := strconv.ParseInt(value, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse end epoch: %v", err)
-			}
-			deal.EndEpoch = epoch
-		case "provider collateral":
-			// Parse "X.XXX mFIL" format
-			collateralStr := strings.Split(value, " ")[0]
-			collateral, err := strconv.ParseFloat(collateralStr, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse provider collateral: %v", err)
-			}
-			deal.ProviderCollateral = collateral
-		}
-	}
-
-	// Validate required fields
-	if deal.UUID == "" {
-		return nil, fmt.Errorf("deal UUID not found in response")
-	}
-
-	return deal, nil
-}
-
 func Command() *cli.Command {
 	return &cli.Command{
 		Name:  "deal",
 		Usage: "Send deals for car files",
 		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:     "miner",
-				Usage:    "Storage provider ID",
-				Required: true,
+			&cli.StringSliceFlag{
+				Name:  "miner",
+				Usage: "Registered storage provider to send deals to, f01234:N sends it at most N deals per run; repeatable, all registered providers when not set",
+			},
+			&cli.IntFlag{
+				Name:  "replicas",
+				Usage: "Replicas per piece, each on a different provider (0 uses the target of the file's dataset, 1 without dataset)",
+				Value: 0,
 			},
 			&cli.StringFlag{
 				Name:     "from-wallet",
@@ -118,6 +41,11 @@ func Command() *cli.Command {
 				Required: true,
 				Value:    "https://api.node.glif.io",
 			},
+			&cli.StringFlag{
+				Name:  "proposer",
+				Usage: "How deals are proposed: boost runs the boost client, native proposes over libp2p and signs with the wallet of the Lotus node at --api",
+				Value: "boost",
+			},
 			&cli.StringFlag{
 				Name:  "boost-client-path",
 				Usage: "Path to boost client executable (overrides config file)",
@@ -138,7 +66,7 @@ func Command() *cli.Command {
 			},
 			&cli.IntFlag{
 				Name:  "total",
-				Usage: "Number of deals to send",
+				Usage: "Number of deals to send per run (0 means no limit, ignored with --from-piece-cids)",
 				Value: 1,
 			},
 			&cli.BoolFlag{
@@ -159,7 +87,12 @@ func Command() *cli.Command {
 				return fmt.Errorf("failed to load config: %v", err)
 			}
 
-			miner := c.String("miner")
+			var providers []market.ProviderQuota
+			if c.IsSet("miner") {
+				if providers, err = market.ParseProviders(c.StringSlice("miner")); err != nil {
+					return err
+				}
+			}
 			fromWallet := c.String("from-wallet")
 			api := c.String("api")
 			boostClientPath := c.String("boost-client-path")
@@ -174,9 +107,44 @@ func Command() *cli.Command {
 			if boostClientPath == "" {
 				boostClientPath = cfg.Deal.BoostPath
 			}
+			var proposer market.DealProposer
+			switch c.String("proposer") {
+			case "boost":
+				proposer = &market.BoostCLI{Path: boostClientPath, APIInfo: api}
+			case "native":
+				native, err := market.NewNativeProposer(api)
+				if err != nil {
+					return err
+				}
+				defer native.Close()
+				proposer = native
+			default:
+				return fmt.Errorf("invalid proposer %s, must be one of: boost, native", c.String("proposer"))
+			}
+			opts := Options{
+				Providers:     providers,
+				Replicas:      c.Int("replicas"),
+				Wallet:        fromWallet,
+				FromPieceCids: fromPieceCids,
+				StartEpochDay: startEpochDay,
+				Duration:      duration,
+				Total:         total,
+				ReallyDoIt:    reallyDoIt,
+				Limits: db.RateLimits{
+					MaxConcurrent:      cfg.Deal.MaxConcurrent,
+					WalletDealsPerHour: cfg.Deal.WalletDealsPerHour,
+					WalletBytesPerDay:  cfg.Deal.WalletBytesPerDay,
+				},
+			}
+
+			database, err := db.InitFromConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to initialize database: %v", err)
+			}
+			defer database.Close()
 
 			for {
-				if err := sendDeals(cfg, miner, fromWallet, api, boostClientPath, fromPieceCids, startEpochDay, duration, total, reallyDoIt); err != nil {
+				if err := SendDeals(c.Context, database, proposer, opts); err != nil {
 					log.Printf("Error sending deals: %v", err)
 				}
 
@@ -192,37 +160,46 @@ func Command() *cli.Command {
 	}
 }
 
-func sendDeals(cfg *config.Config, miner, fromWallet, api, boostClientPath, fromPieceCids string, startEpochDay, duration int64, total int, reallyDoIt bool) error {
-	// Initialize database connection
-	dbConfig := &db.DBConfig{
-		Host:     cfg.Database.Host,
-		Port:     cfg.Database.Port,
-		User:     cfg.Database.User,
-		Password: cfg.Database.Password,
-		DBName:   cfg.Database.DBName,
-		SSLMode:  cfg.Database.SSLMode,
-	}
-
-	database, err := db.InitDB(dbConfig)
-	if err != nil {
-		return fmt.Errorf("failed to initialize database: %v", err)
-	}
-	defer database.Close()
-
-	log.Printf("Start epoch days: %d", startEpochDay)
-	startEpoch := util.CurrentHeight() + (startEpochDay * 2880)
-
-	var pendingDeals []db.CarFile
+// Options selects the car files deals are sent for and the deal terms
+type Options struct {
+	Providers     []market.ProviderQuota // registered providers to use, all when empty
+	Replicas      int                    // replicas per piece, 0 for the target of the file's dataset
+	Wallet        string
+	FromPieceCids string // file of piece CIDs, one per line, all under-replicated files when empty
+	StartEpochDay int64
+	Duration      int64
+	Total         int // deals sent in a run at most, ignored with FromPieceCids
+	ReallyDoIt    bool
+	Limits        db.RateLimits // shared with the other deal processes through the database
+}
 
-	if fromPieceCids != "" {
+// concurrencyRetry is how long SendDeals waits for another deal process to
+// finish sending when the concurrency limit is reached
+const concurrencyRetry = 5 * time.Second
+
+// proposeTimeout bounds a proposal so that its reservation still counts
+// until the provider answered
+const proposeTimeout = db.AttemptExpiry / 2
+
+// SendDeals sends deals for the selected car files until the piece of every
+// file has its target number of replicas, each on a different provider, and
+// saves the deals. Every deal is reserved in the database before it is
+// proposed, so deal processes running at the same time respect the limits
+// together.
+func SendDeals(ctx context.Context, database *db.Database, proposer market.DealProposer, opts Options) error {
+	log.Printf("Start epoch days: %d", opts.StartEpochDay)
+	startEpoch := util.CurrentHeight() + (opts.StartEpochDay * 2880)
+
+	var pieceCids []string
+	pageSize := 0
+	if opts.FromPieceCids != "" {
 		// Read piece CIDs from file
-		content, err := os.ReadFile(fromPieceCids)
+		content, err := os.ReadFile(opts.FromPieceCids)
 		if err != nil {
 			return fmt.Errorf("failed to read piece CIDs file: %v", err)
 		}
 
 		// Parse piece CIDs
-		var pieceCids []string
 		lines := strings.Split(string(content), "\n")
 		for _, line := range lines {
 			line = strings.TrimSpace(line)
@@ -232,7 +209,7 @@ func sendDeals(cfg *config.Config, miner, fromWallet, api, boostClientPath, from
 		}
 
 		if len(pieceCids) == 0 {
-			return fmt.Errorf("no piece CIDs found in file: %s", fromPieceCids)
+			return fmt.Errorf("no piece CIDs found in file: %s", opts.FromPieceCids)
 		}
 
 		log.Printf("Loaded %d piece CIDs from file", len(pieceCids))
@@ -243,8 +220,6 @@ func sendDeals(cfg *config.Config, miner, fromWallet, api, boostClientPath, from
 			return fmt.Errorf("failed to get files by piece CIDs: %v", err)
 		}
 
-		pendingDeals = files
-
 		// Log unmatched piece CIDs
 		foundCids := make(map[string]bool)
 		for _, file := range files {
@@ -265,29 +240,53 @@ func sendDeals(cfg *config.Config, miner, fromWallet, api, boostClientPath, from
 			}
 		}
 
-		log.Printf("Found %d matching files for specified piece CIDs", len(pendingDeals))
-	} else {
-		// Get pending deals from database
-		files, err := database.ListPendingFiles()
-		if err != nil {
-			return fmt.Errorf("failed to list pending files: %v", err)
-		}
-
-		pendingDeals = files
+		log.Printf("Found %d matching files for specified piece CIDs", len(files))
+	} else if opts.Total > 0 {
+		// Every file needs one deal at least, files no provider takes are
+		// skipped and the next page is listed
+		pageSize = opts.Total
+	}
 
-		// Apply total limit if no piece CIDs specified
-		if total > 0 && total < len(pendingDeals) {
-			pendingDeals = pendingDeals[:total]
-		}
+	files, err := database.ListUnderReplicatedFiles(pieceCids, opts.Replicas, pageSize, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list under-replicated files: %v", err)
 	}
 
-	if len(pendingDeals) == 0 {
+	if len(files) == 0 {
 		log.Println("No files found to process")
 		return nil
 	}
 
-	log.Printf("Will process %d deals", len(pendingDeals))
+	// Providers come from the registry, with what is left of their limits
+	registered, err := database.ListProviders()
+	if err != nil {
+		return fmt.Errorf("failed to list providers: %v", err)
+	}
+	usage, err := database.GetProviderUsage(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to get provider usage: %v", err)
+	}
+	quotas, skipped, err := market.Quotas(registered, usage, opts.Wallet, opts.Providers)
+	if err != nil {
+		return err
+	}
+	for provider, reason := range skipped {
+		log.Printf("Skipping provider %s: %s", provider, reason)
+	}
+	if len(quotas) == 0 {
+		log.Println("No storage provider can take deals")
+		return nil
+	}
+	terms := make(map[string]db.Provider, len(registered))
+	for _, p := range registered {
+		terms[p.MinerID] = p
+	}
 
+	replicator := market.NewReplicator(quotas)
+	sent := 0
+	limitReached := func() bool {
+		return opts.FromPieceCids == "" && opts.Total > 0 && sent >= opts.Total
+	}
 	successCount := 0
 	failureCount := 0
 
@@ -298,81 +297,160 @@ func sendDeals(cfg *config.Config, miner, fromWallet, api, boostClientPath, from
 	}
 	var failedDeals []failedDealInfo
 
-	for i, file := range pendingDeals {
-		// Prepare deal command
-		cmd := boostClientPath + " offline-deal " +
-			"--provider=" + miner + " " +
-			"--commp=" + file.CommP + " " +
-			"--piece-size=" + strconv.FormatUint(file.PieceSize, 10) + " " +
-			"--wallet=" + fromWallet + " " +
-			"--payload-cid=" + file.DataCid + " " +
-			"--verified=true " +
-			"--duration=" + strconv.FormatInt(duration, 10) + " " +
-			"--storage-price=0 " +
-			"--start-epoch=" + strconv.FormatInt(startEpoch, 10)
-
-		log.Printf("[%d/%d] Processing file %s", i+1, len(pendingDeals), file.FilePath)
-		log.Printf("Command: %s", cmd)
-
-		if reallyDoIt {
-			dealResponse, err := execCmd(api, cmd)
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to send deal: %v", err)
-				log.Printf("Failed to send deal for file %s: %v", file.FilePath, errMsg)
-				// Update deal status to failed with error message
-				if err = database.UpdateDealSentStatus(file.ID, db.DealStatusFailed, errMsg); err != nil {
-					log.Printf("Failed to update deal status: %v", err)
-				}
-				failureCount++
-				continue
+	processed := 0
+	walletLimited := false
+pages:
+	for {
+		for _, file := range files {
+			if walletLimited {
+				break pages
+			}
+			if limitReached() {
+				log.Printf("Sent %d deals, the limit of this run", sent)
+				break pages
+			}
+			if replicator.Exhausted() {
+				log.Printf("Every storage provider took its quota of deals")
+				break pages
 			}
+			processed++
+
+			log.Printf("[%d] Processing file %s, %d of %d replicas on %v",
+				processed, file.FilePath, len(file.Providers), file.Target, file.Providers)
+
+			holding := append([]string(nil), file.Providers...)
+			placed := 0
+			lastErr := ""
+			for len(file.Providers)+placed < file.Target && !limitReached() {
+				provider := replicator.Next(holding, file.PieceSize)
+				if provider == "" {
+					log.Printf("No storage provider left for file %s", file.FilePath)
+					break
+				}
+				// A provider is tried once per piece, whether it takes the deal or not
+				holding = append(holding, provider)
+
+				proposal := market.Proposal{
+					Provider:     provider,
+					Wallet:       opts.Wallet,
+					PieceCid:     file.CommP,
+					PieceSize:    file.PieceSize,
+					PayloadCid:   file.DataCid,
+					StartEpoch:   startEpoch,
+					Duration:     opts.Duration,
+					Verified:     terms[provider].Verified,
+					StoragePrice: terms[provider].StoragePrice,
+				}
+				log.Printf("Proposal: %+v", proposal)
 
-			log.Printf("Deal sent successfully for file %s: %s", file.FilePath, dealResponse)
+				if !opts.ReallyDoIt {
+					replicator.Sent(provider, file.PieceSize)
+					placed++
+					sent++
+					continue
+				}
 
-			// Parse deal response
-			deal, err := parseDealResponse(dealResponse)
-			if err != nil {
-				log.Printf("Failed to parse deal response: %v", err)
-				failedDeals = append(failedDeals, failedDealInfo{
-					commp:  file.PieceCid,
-					dealID: deal.UUID,
-				})
-				failureCount++
-				continue
+				attemptID, err := reserveDeal(ctx, database, db.DealReservation{
+					Provider:  provider,
+					Wallet:    opts.Wallet,
+					PieceCid:  file.CommP,
+					PieceSize: int64(file.PieceSize),
+					Replicas:  file.Target,
+				}, opts.Limits)
+				var limit *db.LimitError
+				if errors.As(err, &limit) {
+					log.Printf("Not sending file %s to %s: %v", file.FilePath, provider, limit)
+					switch limit.Scope {
+					case db.LimitPiece:
+						continue
+					case db.LimitProvider:
+						replicator.Drop(provider)
+						continue
+					case db.LimitWallet:
+						walletLimited = true
+					}
+					break
+				}
+				if err != nil {
+					return err
+				}
+
+				proposeCtx, cancel := context.WithTimeout(ctx, proposeTimeout)
+				deal, err := proposer.Propose(proposeCtx, proposal)
+				cancel()
+				if err != nil {
+					lastErr = fmt.Sprintf("Failed to send deal to %s: %v", provider, err)
+					log.Printf("Failed to send deal for file %s: %v", file.FilePath, lastErr)
+					if err := database.RejectDealAttempt(attemptID, err.Error()); err != nil {
+						log.Printf("Failed to record deal attempt: %v", err)
+					}
+					failureCount++
+					continue
+				}
+				replicator.Sent(provider, file.PieceSize)
+				sent++
+
+				log.Printf("Deal sent successfully for file %s to %s: %s", file.FilePath, provider, deal.UUID)
+
+				// Save deal to database
+				deal.FileID = &file.ID
+				if err = database.CompleteDealAttempt(attemptID, deal); err != nil {
+					log.Printf("Failed to save deal: %v", err)
+					// The provider took the deal, its attempt keeps the piece from
+					// being proposed to the provider again
+					if err := database.AcceptDealAttempt(attemptID, deal.UUID); err != nil {
+						log.Printf("Failed to record deal attempt: %v", err)
+					}
+					failedDeals = append(failedDeals, failedDealInfo{
+						commp:  file.PieceCid,
+						dealID: deal.UUID,
+					})
+					failureCount++
+					continue
+				}
+				placed++
+				successCount++
 			}
 
-			// Save deal to database
-			if err = database.InsertDeal(deal); err != nil {
-				log.Printf("Failed to save deal: %v", err)
-				failedDeals = append(failedDeals, failedDealInfo{
-					commp:  file.PieceCid,
-					dealID: deal.UUID,
-				})
-				failureCount++
+			if !opts.ReallyDoIt {
 				continue
 			}
 
-			// Update car_files with deal UUID
-			if err = database.UpdateDealSentStatus(file.ID, db.DealStatusSuccess, deal.UUID); err != nil {
+			// The file is done once its piece has all replicas, it stays pending
+			// while some are missing and fails when no provider took a deal
+			var err error
+			switch {
+			case len(file.Providers)+placed >= file.Target:
+				err = database.UpdateDealSentStatus(file.ID, db.DealStatusSuccess)
+			case placed > 0:
+				err = database.UpdateDealSentStatus(file.ID, db.DealStatusPending)
+			case lastErr != "":
+				err = database.UpdateDealError(file.ID, lastErr)
+			}
+			if err != nil {
 				log.Printf("Failed to update deal status: %v", err)
 			}
-			successCount++
+		}
 
-			// Add delay between deals
-			if i < len(pendingDeals)-1 {
-				time.Sleep(time.Duration(cfg.Deal.DealDelay) * time.Millisecond)
-				log.Printf("[%d/%d] Delayed for %d seconds", i+1, len(pendingDeals), cfg.Deal.DealDelay/1000)
-			}
+		if pageSize == 0 || len(files) < pageSize {
+			break
+		}
+		files, err = database.ListUnderReplicatedFiles(pieceCids, opts.Replicas, pageSize, &files[len(files)-1].CarFile)
+		if err != nil {
+			return fmt.Errorf("failed to list under-replicated files: %v", err)
+		}
+		if len(files) == 0 {
+			break
 		}
 	}
 
 	// Print summary
-	if reallyDoIt {
+	if opts.ReallyDoIt {
 		log.Printf("\nDeal Summary:")
-		log.Printf("Total Processed: %d", len(pendingDeals))
+		log.Printf("Total Processed: %d", processed)
 		log.Printf("Successful: %d", successCount)
 		log.Printf("Failed: %d", failureCount)
-		
+
 		if len(failedDeals) > 0 {
 			log.Printf("\nFailed Deals:")
 			for _, fd := range failedDeals {
@@ -383,3 +461,21 @@ func sendDeals(cfg *config.Config, miner, fromWallet, api, boostClientPath, from
 
 	return nil
 }
+
+// reserveDeal reserves a deal, waiting while other deal processes send as
+// many deals as the concurrency limit allows
+func reserveDeal(ctx context.Context, database *db.Database, r db.DealReservation, limits db.RateLimits) (int64, error) {
+	for {
+		id, err := database.ReserveDeal(r, limits)
+		var limit *db.LimitError
+		if !errors.As(err, &limit) || limit.Scope != db.LimitConcurrency {
+			return id, err
+		}
+		log.Printf("%v, waiting %s", limit, concurrencyRetry)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(concurrencyRetry):
+		}
+	}
+}
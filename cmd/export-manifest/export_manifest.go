@@ -0,0 +1,270 @@
+package exportmanifest
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/minerdao/lotus-car/config"
+	"github.com/minerdao/lotus-car/db"
+	"github.com/urfave/cli/v2"
+)
+
+// ManifestEntry maps one original file to the car file and deals holding it
+type ManifestEntry struct {
+	Path       string   `json:"path"`
+	FileCid    string   `json:"file_cid"`
+	PayloadCid string   `json:"payload_cid"`
+	PieceCid   string   `json:"piece_cid"`
+	PieceSize  uint64   `json:"piece_size"`
+	DealIDs    []string `json:"deal_ids"`
+}
+
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:  "export-manifest",
+		Usage: "Export the mapping of original files to file CID, payload CID, piece CID and deals",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "from-piece-cids",
+				Usage: "Path to file containing piece CIDs (one per line)",
+			},
+			&cli.StringFlag{
+				Name:  "dataset",
+				Usage: "Export the car files packed from this dataset",
+			},
+			&cli.BoolFlag{
+				Name:  "all",
+				Usage: "Export every car file in the database",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format (csv/json)",
+				Value: "csv",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "Output file, or '-' for stdout",
+				Value:   "-",
+			},
+			&cli.BoolFlag{
+				Name:  "dirs",
+				Usage: "Also export directory entries",
+				Value: false,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			// Load configuration
+			cfg, err := config.LoadConfig(c.String("config"))
+			if err != nil {
+				return fmt.Errorf("failed to load config: %v", err)
+			}
+
+			fromPieceCids := c.String("from-piece-cids")
+			datasetName := c.String("dataset")
+			all := c.Bool("all")
+			format := c.String("format")
+			output := c.String("output")
+			dirs := c.Bool("dirs")
+
+			if format != "csv" && format != "json" {
+				return fmt.Errorf("invalid format %s, must be one of: csv, json", format)
+			}
+			if fromPieceCids == "" && datasetName == "" && !all {
+				return fmt.Errorf("one of --from-piece-cids, --dataset or --all must be specified")
+			}
+
+			database, err := db.InitFromConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to initialize database: %v", err)
+			}
+			defer database.Close()
+
+			var files []db.CarFile
+			if fromPieceCids != "" {
+				pieceCids, err := readPieceCidsFromFile(fromPieceCids)
+				if err != nil {
+					return fmt.Errorf("failed to read piece CIDs from file: %v", err)
+				}
+				files, err = database.GetFilesByPieceCids(pieceCids)
+				if err != nil {
+					return fmt.Errorf("failed to get files by piece CIDs: %v", err)
+				}
+			} else if datasetName != "" {
+				dataset, err := database.GetDatasetByName(datasetName)
+				if err != nil {
+					return err
+				}
+				if dataset == nil {
+					return fmt.Errorf("dataset %s not found", datasetName)
+				}
+				files, err = database.ListDatasetFiles(dataset.ID)
+				if err != nil {
+					return fmt.Errorf("failed to list files of dataset %s: %v", datasetName, err)
+				}
+			} else {
+				files, err = database.ListFiles()
+				if err != nil {
+					return fmt.Errorf("failed to list files: %v", err)
+				}
+			}
+
+			var out io.Writer = os.Stdout
+			if output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return fmt.Errorf("failed to create output file: %v", err)
+				}
+				defer f.Close()
+				out = f
+			}
+			bw := bufio.NewWriter(out)
+			defer bw.Flush()
+
+			var w manifestWriter
+			if format == "json" {
+				w = &jsonManifestWriter{w: bw}
+			} else {
+				w = &csvManifestWriter{w: csv.NewWriter(bw)}
+			}
+			if err := w.Begin(); err != nil {
+				return err
+			}
+
+			total := 0
+			for i, file := range files {
+				deals, err := database.GetDealsByCommP(file.CommP)
+				if err != nil {
+					return fmt.Errorf("failed to get deals for %s: %v", file.PieceCid, err)
+				}
+				dealIDs := make([]string, 0, len(deals))
+				for _, deal := range deals {
+					dealIDs = append(dealIDs, deal.UUID)
+				}
+
+				cids, err := database.ListFileCids(file.ID)
+				if err != nil {
+					return fmt.Errorf("failed to get file cids for %s: %v", file.PieceCid, err)
+				}
+				if len(cids) == 0 {
+					log.Printf("[%d/%d] No CID map stored for %s, regenerate it to fill the manifest", i+1, len(files), file.PieceCid)
+					continue
+				}
+
+				for _, fc := range cids {
+					if fc.Path == "" || (fc.IsDir && !dirs) {
+						continue
+					}
+					err = w.Write(ManifestEntry{
+						Path:       fc.Path,
+						FileCid:    fc.Cid,
+						PayloadCid: file.DataCid,
+						PieceCid:   file.PieceCid,
+						PieceSize:  file.PieceSize,
+						DealIDs:    dealIDs,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to write manifest entry: %v", err)
+					}
+					total++
+				}
+			}
+
+			if err := w.End(); err != nil {
+				return err
+			}
+
+			log.Printf("Exported %d entries from %d car files", total, len(files))
+			return nil
+		},
+	}
+}
+
+type manifestWriter interface {
+	Begin() error
+	Write(entry ManifestEntry) error
+	End() error
+}
+
+type csvManifestWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvManifestWriter) Begin() error {
+	return c.w.Write([]string{"path", "file_cid", "payload_cid", "piece_cid", "piece_size", "deal_ids"})
+}
+
+func (c *csvManifestWriter) Write(entry ManifestEntry) error {
+	return c.w.Write([]string{
+		entry.Path,
+		entry.FileCid,
+		entry.PayloadCid,
+		entry.PieceCid,
+		strconv.FormatUint(entry.PieceSize, 10),
+		strings.Join(entry.DealIDs, " "),
+	})
+}
+
+func (c *csvManifestWriter) End() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonManifestWriter writes a JSON array one entry at a time, so large
+// manifests are never held in memory
+type jsonManifestWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonManifestWriter) Begin() error {
+	_, err := io.WriteString(j.w, "[")
+	return err
+}
+
+func (j *jsonManifestWriter) Write(entry ManifestEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if j.count == 0 {
+		sep = "\n  "
+	}
+	j.count++
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonManifestWriter) End() error {
+	_, err := io.WriteString(j.w, "\n]\n")
+	return err
+}
+
+// 从文件读取 piece CIDs
+func readPieceCidsFromFile(filePath string) ([]string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	var pieceCids []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			pieceCids = append(pieceCids, line)
+		}
+	}
+	return pieceCids, nil
+}
@@ -0,0 +1,143 @@
+package generate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/util"
+)
+
+// sourceClaim tracks the source files a generate run claimed from a dataset.
+// Each slice of a split file is saved as soon as its car file is, and a file
+// is marked packed once every car file holding a part of it is saved. The
+// others are released when the run ends, and a later claim only packs their
+// slices that are not saved yet.
+type sourceClaim struct {
+	database  *db.Database
+	datasetID string
+
+	mu      sync.Mutex
+	ids     map[string]int64 // 源文件绝对路径 -> source_files.id
+	pending map[int64]int    // 还未保存的包含该文件的 car 数量
+}
+
+// claimDatasetBins claims enough unpacked files of a dataset to fill quantity
+// car files and packs them. Claimed files that do not make it into the
+// selected bins are released right away.
+func claimDatasetBins(database *db.Database, dataset *db.Dataset, parent string, fileSize int64, quantity int, staleAfter time.Duration) ([][]util.Finfo, *sourceClaim, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, nil, err
+	}
+	claimedBy := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+
+	var maxBytes int64
+	if quantity > 0 {
+		maxBytes = fileSize * int64(quantity)
+	}
+	files, err := database.ClaimSourceFiles(dataset.ID, maxBytes, claimedBy, staleAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("Claimed %d source files of dataset %s as %s\n", len(files), dataset.Name, claimedBy)
+
+	claim := &sourceClaim{
+		database:  database,
+		datasetID: dataset.ID,
+		ids:       make(map[string]int64),
+		pending:   make(map[int64]int),
+	}
+	ids := make([]int64, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, f.ID)
+	}
+	saved, err := database.ListSourceFileSlices(ids)
+	if err != nil {
+		claim.release()
+		return nil, nil, err
+	}
+	var fileList []util.Finfo
+	var done []int64
+	for _, f := range files {
+		p := filepath.Join(parent, filepath.FromSlash(f.Path))
+		claim.ids[p] = f.ID
+		var covered []util.Finfo
+		for _, sl := range saved[f.ID] {
+			covered = append(covered, util.Finfo{Path: p, Size: f.Size, Start: sl.Start, End: sl.End})
+		}
+		missing := util.UncoveredSlices(util.Finfo{Path: p, Size: f.Size}, covered)
+		if len(missing) == 0 {
+			// Every slice was saved by a run that stopped before marking it
+			done = append(done, f.ID)
+			delete(claim.ids, p)
+			continue
+		}
+		fileList = append(fileList, missing...)
+	}
+	if err := database.MarkSourceFilesPacked(done); err != nil {
+		claim.release()
+		return nil, nil, err
+	}
+
+	bins := util.SelectBins(util.PackFiles(fileList, fileSize), quantity)
+	for _, bin := range bins {
+		for _, f := range bin {
+			claim.pending[claim.ids[f.Path]]++
+		}
+	}
+	if err := claim.release(); err != nil {
+		return nil, nil, err
+	}
+	return bins, claim, nil
+}
+
+// binDone records that the car file of a bin is saved
+func (sc *sourceClaim) binDone(bin []util.Finfo) error {
+	sc.mu.Lock()
+	var slices []db.SourceFileSlice
+	var packed []int64
+	for _, f := range bin {
+		id := sc.ids[f.Path]
+		if f.IsSlice() {
+			slices = append(slices, db.SourceFileSlice{SourceFileID: id, Start: f.Start, End: f.Start + f.Len()})
+		}
+		sc.pending[id]--
+		if sc.pending[id] == 0 {
+			delete(sc.pending, id)
+			delete(sc.ids, f.Path)
+			packed = append(packed, id)
+		}
+	}
+	sc.mu.Unlock()
+	if err := sc.database.SaveSourceFileSlices(slices); err != nil {
+		return err
+	}
+	return sc.database.MarkSourceFilesPacked(packed)
+}
+
+// finish releases every claimed file that was not packed, including the ones
+// of bins that failed. Their saved slices are kept.
+func (sc *sourceClaim) finish() error {
+	sc.mu.Lock()
+	sc.pending = make(map[int64]int)
+	sc.mu.Unlock()
+	return sc.release()
+}
+
+// release hands back every claimed file that is not in a pending bin
+func (sc *sourceClaim) release() error {
+	sc.mu.Lock()
+	var ids []int64
+	for p, id := range sc.ids {
+		if sc.pending[id] == 0 {
+			ids = append(ids, id)
+			delete(sc.ids, p)
+		}
+	}
+	sc.mu.Unlock()
+	return sc.database.ReleaseSourceFiles(ids)
+}
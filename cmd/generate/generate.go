@@ -2,18 +2,17 @@ package generate
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	commcid "github.com/filecoin-project/go-fil-commcid"
@@ -27,13 +26,11 @@ import (
 
 const BufSize = (4 << 20) / 128 * 127
 
-type Input []util.Finfo
-
 func Command() *cli.Command {
 	return &cli.Command{
 		Name:  "generate",
 		Usage: "Generate car archive from list of files and compute commp",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:    "input",
 				Aliases: []string{"i"},
@@ -43,12 +40,12 @@ func Command() *cli.Command {
 			&cli.Uint64Flag{
 				Name:    "quantity",
 				Aliases: []string{"q"},
-				Usage:   "Quantity of car files",
+				Usage:   "Quantity of car files (0 means pack every unpacked file)",
 				Value:   3,
 			},
 			&cli.Uint64Flag{
 				Name:  "file-size",
-				Usage: "Target car file size, default to 32GiB size sector",
+				Usage: "Maximum raw data size packed into one car file, default to 32GiB size sector",
 				Value: 19327352832,
 			},
 			&cli.Uint64Flag{
@@ -75,12 +72,35 @@ func Command() *cli.Command {
 				Value:   "",
 			},
 			&cli.StringFlag{
-				Name:     "parent",
-				Aliases:  []string{"p"},
-				Usage:    "Parent path of the dataset",
-				Required: true,
+				Name:  "blockstore-dir",
+				Usage: "Optionally keep intermediate blocks in a temporary on-disk blockstore under this directory to bound memory usage",
+				Value: "",
 			},
-		},
+			&cli.IntFlag{
+				Name:  "car-version",
+				Usage: "Car format version to write, 2 wraps the car in a CARv2 with a multihash sorted index",
+				Value: 1,
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of car files generated in parallel",
+				Value: 1,
+			},
+			&cli.StringFlag{
+				Name:    "parent",
+				Aliases: []string{"p"},
+				Usage:   "Parent path of the dataset, defaults to the source directory of --dataset",
+			},
+			&cli.StringFlag{
+				Name:  "dataset",
+				Usage: "Claim unpacked source files of this dataset from the database instead of reading --input, packed with the dataset's UnixFS params",
+			},
+			&cli.DurationFlag{
+				Name:  "claim-timeout",
+				Usage: "Claim source files left packing by another generate for longer than this, 0 never takes over a claim",
+				Value: 24 * time.Hour,
+			},
+		}, util.UnixfsFlags()...),
 		Action: func(c *cli.Context) error {
 			ctx := context.Background()
 			// Load configuration
@@ -97,35 +117,7 @@ func Command() *cli.Command {
 			outDir := c.String("out-dir")
 			parent := c.String("parent")
 			tmpDir := c.String("tmp-dir")
-
-			var inputBytes []byte
-			if inputFile == "-" {
-				reader := bufio.NewReader(os.Stdin)
-				buf := new(bytes.Buffer)
-				_, err := buf.ReadFrom(reader)
-				if err != nil {
-					return err
-				}
-				inputBytes = buf.Bytes()
-			} else {
-				bytes, err := os.ReadFile(inputFile)
-				if err != nil {
-					return err
-				}
-				inputBytes = bytes
-			}
-
-			var inputFiles Input
-			err = json.Unmarshal(inputBytes, &inputFiles)
-			if err != nil {
-				return err
-			}
-
-			csvF, err := os.Create(outFile)
-			if err != nil {
-				return err
-			}
-			defer csvF.Close()
+			parallel := c.Int("parallel")
 
 			dbConfig := &db.DBConfig{
 				Host:     cfg.Database.Host,
@@ -142,129 +134,512 @@ func Command() *cli.Command {
 			}
 			defer database.Close()
 
-			for i := 0; i < int(quantity); i++ {
-				start := time.Now()
-				var selectedFiles []util.Finfo
-				totalSize := 0
-				rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-				for totalSize < int(fileSizeInput) {
-					choicedFile := inputFiles[rng.Intn(len(inputFiles))]
-					totalSize += int(choicedFile.Size)
-					fileInfo := choicedFile
-					selectedFiles = append(selectedFiles, fileInfo)
-				}
-
-				fmt.Printf("Will generate file with %d bytes\n", totalSize)
-
-				outFilename := uuid.New().String() + ".car"
-				outPath := path.Join(outDir, outFilename)
-				carF, err := os.Create(outPath)
+			var dataset *db.Dataset
+			if name := c.String("dataset"); name != "" {
+				dataset, err = database.GetDatasetByName(name)
 				if err != nil {
 					return err
 				}
+				if dataset == nil {
+					return fmt.Errorf("dataset %s not found, create it with dataset create or run index with --dataset first", name)
+				}
+				if parent == "" {
+					parent = dataset.SourceDir
+				}
+			}
+			if parent == "" {
+				return fmt.Errorf("--parent is required without --dataset")
+			}
 
-				cp := new(commp.Calc)
-				writer := bufio.NewWriterSize(io.MultiWriter(carF, cp), BufSize)
-				_, cid, _, err := util.GenerateCar(ctx, selectedFiles, parent, tmpDir, writer)
+			params := util.UnixfsParams(cfg.Unixfs)
+			if dataset != nil && dataset.UnixfsParams != "" {
+				params, err = util.ParseUnixfsParams(dataset.UnixfsParams)
 				if err != nil {
-					carF.Close()
-					os.Remove(outPath)
-					return err
+					return fmt.Errorf("invalid unixfs params of dataset %s: %v", dataset.Name, err)
 				}
-				err = writer.Flush()
+			}
+			params = util.UnixfsParamsFromFlags(c, params)
+			carOpts := util.CarOptions{
+				BlockstoreDir: c.String("blockstore-dir"),
+				CarVersion:    c.Int("car-version"),
+				Unixfs:        params,
+			}
+			if carOpts.CarVersion != 1 && carOpts.CarVersion != 2 {
+				return fmt.Errorf("unsupported car version %d", carOpts.CarVersion)
+			}
+			if err := carOpts.Unixfs.Validate(); err != nil {
+				return fmt.Errorf("invalid unixfs params: %v", err)
+			}
+			fmt.Printf("UnixFS params: %s\n", carOpts.Unixfs)
+
+			if fileSizeInput > pieceSizeInput/128*127 {
+				return fmt.Errorf("file size %d does not fit into piece size %d", fileSizeInput, pieceSizeInput)
+			}
+
+			if parallel < 1 {
+				parallel = 1
+			}
+			g := &generator{
+				database:  database,
+				parent:    parent,
+				outDir:    outDir,
+				pieceSize: pieceSizeInput,
+				carOpts:   carOpts,
+			}
+
+			var input *indexBins
+			if dataset == nil {
+				input, err = openIndexBins(database, inputFile, parent, int64(fileSizeInput))
 				if err != nil {
-					carF.Close()
-					os.Remove(outPath)
 					return err
 				}
-				err = carF.Close()
-				if err != nil {
-					os.Remove(outPath)
-					return err
+				defer input.Close()
+			}
+
+			// Car files are packed and generated a window at a time, so a
+			// large dataset is never held in memory whole
+			window := max(packWindow, parallel)
+			generated := 0
+			for quantity == 0 || uint64(generated) < quantity {
+				n := window
+				if quantity > 0 {
+					n = min(n, int(quantity)-generated)
+				}
+				var bins [][]util.Finfo
+				var claim *sourceClaim
+				if dataset != nil {
+					bins, claim, err = claimDatasetBins(database, dataset, parent, int64(fileSizeInput), n, c.Duration("claim-timeout"))
+				} else {
+					bins, err = input.next(n)
 				}
-				rawCommP, pieceSize, err := cp.Digest()
 				if err != nil {
 					return err
 				}
-				if pieceSizeInput > 0 {
-					rawCommP, err = commp.PadCommP(
-						rawCommP,
-						pieceSize,
-						pieceSizeInput,
-					)
+				if len(bins) == 0 {
+					break
+				}
+
+				if g.csvWriter == nil {
+					csvF, err := os.Create(outFile)
 					if err != nil {
 						return err
 					}
-					pieceSize = pieceSizeInput
+					defer csvF.Close()
+					g.csvWriter = csv.NewWriter(csvF)
 				}
-				commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
-				if err != nil {
-					return err
+				g.claim = claim
+				err = g.run(ctx, bins, generated, parallel, tmpDir)
+				// Files claimed but not packed go back to the dataset
+				if claim != nil {
+					if err := claim.finish(); err != nil {
+						fmt.Printf("Failed to release source files: %v\n", err)
+					}
 				}
-
-				generatedFile := path.Join(outDir, commCid.String()+".car")
-				err = os.Rename(outPath, generatedFile)
 				if err != nil {
 					return err
 				}
-				elapsed := time.Since(start)
-				fmt.Printf("Generated %d car %s took %s \n", i+1, generatedFile, elapsed)
+				generated += len(bins)
+			}
+			if generated == 0 {
+				fmt.Println("No files left to pack")
+				return nil
+			}
+			if quantity > 0 && uint64(generated) > quantity {
+				fmt.Printf("Generated %d car files instead of %d to keep split files complete\n", generated, quantity)
+			}
+			return nil
+		},
+	}
+}
 
-				// get car file size
-				carFi, err := os.Stat(generatedFile)
-				if err != nil {
-					return err
-				}
+// packWindow is the number of car files packed and generated at a time
+const packWindow = 16
 
-				// 将选中的文件信息转换为优化后的结构
-				var rawFileInfos []db.RawFileInfo
-				for _, f := range selectedFiles {
-					relPath := strings.TrimPrefix(f.Path, parent)
-					relPath = strings.TrimPrefix(relPath, "/")
-					rawFileInfos = append(rawFileInfos, db.RawFileInfo{
-						Name:         filepath.Base(f.Path),
-						Size:         f.Size,
-						RelativePath: relPath,
-					})
-				}
+// generator builds car files from bins of source files, it is shared by all
+// workers of a generate run
+type generator struct {
+	database  *db.Database
+	parent    string
+	outDir    string
+	pieceSize uint64
+	carOpts   util.CarOptions
+	total     int          // car files of the windows generated so far
+	claim     *sourceClaim // nil when the files come from --input
 
-				rawFilesBytes, err := json.Marshal(rawFileInfos)
-				if err != nil {
-					return fmt.Errorf("failed to marshal raw files: %v", err)
-				}
+	csvMu     sync.Mutex
+	csvWriter *csv.Writer
+}
 
-				carFile := &db.CarFile{
-					CommP:      commCid.String(),
-					DataCid:    cid,
-					PieceCid:   commCid.String(),
-					PieceSize:  pieceSize,
-					CarSize:    uint64(carFi.Size()),
-					FilePath:   generatedFile,
-					RawFiles:   string(rawFilesBytes),
-					DealStatus: db.DealStatusPending,
-				}
+// run generates the car files of a window of bins with parallel workers, the
+// first bin being the offset-th car file of the run
+func (g *generator) run(ctx context.Context, bins [][]util.Finfo, offset, parallel int, tmpDir string) error {
+	g.total = offset + len(bins)
+	for i, bin := range bins {
+		for _, f := range bin {
+			if f.IsSlice() {
+				fmt.Printf("Car %d holds slice [%d, %d) of %s\n", offset+i+1, f.Start, f.End, f.Path)
+			}
+		}
+	}
+	workers := min(parallel, len(bins))
+	fmt.Printf("Generating %d car files with %d workers\n", len(bins), workers)
 
-				err = database.InsertFile(carFile)
-				if err != nil {
-					return fmt.Errorf("failed to insert car file: %v", err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+	for w := 0; w < workers; w++ {
+		workerTmpDir := util.WorkerTmpDir(tmpDir, w, workers)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := g.generate(ctx, offset+i, bins[i], workerTmpDir); err != nil {
+					fmt.Printf("[%d/%d] Failed to generate car file: %v\n", offset+i+1, g.total, err)
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+					cancel()
 				}
+			}
+		}()
+	}
 
-				fmt.Printf("Car file information saved to database with ID: %s\n", carFile.ID)
+dispatch:
+	for i := range bins {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
 
-				outItem := []string{
-					commCid.String(),
-					strconv.Itoa(int(carFi.Size())),
-					strconv.Itoa(int(pieceSize)),
-					cid,
-				}
+	return firstErr
+}
+
+// generate builds the i-th car file, computes its commp and saves it to the
+// database and the CSV file
+func (g *generator) generate(ctx context.Context, i int, selectedFiles []util.Finfo, tmpDir string) error {
+	start := time.Now()
+	totalSize := util.BinSize(selectedFiles)
+
+	fmt.Printf("[%d/%d] Will generate file with %d files, %d bytes\n", i+1, g.total, len(selectedFiles), totalSize)
+
+	outFilename := uuid.New().String() + ".car"
+	outPath := path.Join(g.outDir, outFilename)
+	carF, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+
+	// 记录打包时源文件的 mtime 和内容 hash，regenerate 据此提前发现被修改的文件
+	modTimes, err := statSources(selectedFiles)
+	if err != nil {
+		carF.Close()
+		os.Remove(outPath)
+		return err
+	}
+	carOpts := g.carOpts
+	carOpts.SourceHashes = make(map[string]string, len(selectedFiles))
+
+	cp := new(commp.Calc)
+	writer := bufio.NewWriterSize(io.MultiWriter(carF, cp), BufSize)
+	ipldDag, cid, cidMap, err := util.GenerateCar(ctx, selectedFiles, g.parent, tmpDir, carOpts, writer)
+	if err != nil {
+		carF.Close()
+		os.Remove(outPath)
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		carF.Close()
+		os.Remove(outPath)
+		return err
+	}
+	// 打包过程中被修改的文件会使记录的 hash 和 car 内容对不上
+	if err := checkSourcesUnchanged(selectedFiles, modTimes); err != nil {
+		carF.Close()
+		os.Remove(outPath)
+		return err
+	}
+	err = carF.Close()
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	rawCommP, pieceSize, err := cp.Digest()
+	if err != nil {
+		return err
+	}
+	if g.pieceSize > 0 {
+		rawCommP, err = commp.PadCommP(
+			rawCommP,
+			pieceSize,
+			g.pieceSize,
+		)
+		if err != nil {
+			return err
+		}
+		pieceSize = g.pieceSize
+	}
+	commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		return err
+	}
+
+	generatedFile := path.Join(g.outDir, commCid.String()+".car")
+	err = os.Rename(outPath, generatedFile)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("[%d/%d] Generated car %s took %s \n", i+1, g.total, generatedFile, elapsed)
+
+	// get car file size
+	carFi, err := os.Stat(generatedFile)
+	if err != nil {
+		return err
+	}
+
+	// 将选中的文件信息转换为优化后的结构
+	var rawFileInfos []db.RawFileInfo
+	for _, f := range selectedFiles {
+		modTime := modTimes[f.Path]
+		rawFileInfos = append(rawFileInfos, db.RawFileInfo{
+			Name:         filepath.Base(f.Path),
+			Size:         f.Size,
+			RelativePath: relativePath(g.parent, f.Path),
+			Start:        f.Start,
+			End:          f.End,
+			ModTime:      &modTime,
+			SHA256:       carOpts.SourceHashes[f.Path],
+		})
+	}
+
+	rawFilesBytes, err := json.Marshal(rawFileInfos)
+	if err != nil {
+		return fmt.Errorf("failed to marshal raw files: %v", err)
+	}
+
+	carFile := &db.CarFile{
+		CommP:        commCid.String(),
+		DataCid:      cid,
+		PieceCid:     commCid.String(),
+		PieceSize:    pieceSize,
+		CarSize:      uint64(carFi.Size()),
+		CarVersion:   g.carOpts.CarVersion,
+		UnixfsParams: g.carOpts.Unixfs.String(),
+		FilePath:     generatedFile,
+		RawFiles:     string(rawFilesBytes),
+		DealStatus:   db.DealStatusPending,
+	}
+	if g.claim != nil {
+		carFile.DatasetID = &g.claim.datasetID
+	}
+
+	err = g.database.InsertFile(carFile)
+	if err != nil {
+		return fmt.Errorf("failed to insert car file: %v", err)
+	}
+
+	err = g.database.SaveFileCids(carFile.ID, util.FileCids(ipldDag, cidMap))
+	if err != nil {
+		return fmt.Errorf("failed to save file cids: %v", err)
+	}
+
+	fmt.Printf("[%d/%d] Car file information saved to database with ID: %s\n", i+1, g.total, carFile.ID)
+
+	outItem := []string{
+		commCid.String(),
+		strconv.Itoa(int(carFi.Size())),
+		strconv.Itoa(int(pieceSize)),
+		cid,
+	}
 
-				csvWriter := csv.NewWriter(csvF)
-				csvWriter.Write(outItem)
-				csvWriter.Flush()
+	g.csvMu.Lock()
+	g.csvWriter.Write(outItem)
+	g.csvWriter.Flush()
+	err = g.csvWriter.Error()
+	g.csvMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write csv: %v", err)
+	}
+
+	if g.claim != nil {
+		if err := g.claim.binDone(selectedFiles); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[%d/%d] Saved %s to database and CSV\n", i+1, g.total, commCid.String())
+	return nil
+}
+
+// packLookupBatch is the number of index entries whose packed slices are
+// looked up in the database at once
+const packLookupBatch = 1000
+
+// indexBins packs the parts of index entries that are not in any car file
+// yet. The index is read one batch of entries at a time and packed in windows
+// of a few car files, so neither the index nor the packed slices are ever
+// loaded whole.
+type indexBins struct {
+	packed   func(paths []string) (map[string][]db.RawFileInfo, error) // packed slices by relative path
+	r        *util.IndexReader
+	parent   string
+	fileSize int64
+
+	carry   []util.Finfo // unpacked parts read for a previous window that no selected bin took
+	eof     bool
+	read    int
+	skipped int
+}
+
+// openIndexBins opens the index file, or stdin when inputFile is "-"
+func openIndexBins(database *db.Database, inputFile, parent string, fileSize int64) (*indexBins, error) {
+	var r *util.IndexReader
+	var err error
+	if inputFile == "-" {
+		r, err = util.NewIndexReader(os.Stdin)
+	} else {
+		r, err = util.OpenIndex(inputFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &indexBins{packed: database.GetPackedSlices, r: r, parent: parent, fileSize: fileSize}, nil
+}
+
+// next returns the bins of the next n car files, more when a split file
+// spans further bins, fewer once the index is read to the end, and none when
+// every entry is packed
+func (ib *indexBins) next(n int) ([][]util.Finfo, error) {
+	unpacked := ib.carry
+	ib.carry = nil
+	var unpackedBytes int64
+	for _, f := range unpacked {
+		unpackedBytes += f.Len()
+	}
+	// One more car file of entries keeps the last selected bin full
+	for !ib.eof && unpackedBytes < ib.fileSize*int64(n+1) {
+		batch, err := ib.readBatch()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range batch {
+			unpacked = append(unpacked, f)
+			unpackedBytes += f.Len()
+		}
+	}
+
+	// The parts of a file are selected together, the files left out are
+	// packed in the next window
+	bins := util.SelectBins(util.PackFiles(unpacked, ib.fileSize), n)
+	selected := make(map[string]bool)
+	for _, bin := range bins {
+		for _, f := range bin {
+			selected[f.Path] = true
+		}
+	}
+	for _, f := range unpacked {
+		if !selected[f.Path] {
+			ib.carry = append(ib.carry, f)
+		}
+	}
+	return bins, nil
+}
 
-				fmt.Printf("Saved %s to database and CSV\n", commCid.String())
+// readBatch reads up to packLookupBatch index entries and returns their parts
+// that are not packed yet
+func (ib *indexBins) readBatch() ([]util.Finfo, error) {
+	var entries []util.IndexEntry
+	var paths []string
+	for len(entries) < packLookupBatch {
+		e, err := ib.r.Next()
+		if err == io.EOF {
+			ib.eof = true
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index: %v", err)
+		}
+		entries = append(entries, e)
+		paths = append(paths, relativePath(ib.parent, e.Path))
+	}
+	ib.read += len(entries)
+
+	// A split file missing some slices gets only those packed again
+	packed, err := ib.packed(paths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packed files: %v", err)
+	}
+	var unpacked []util.Finfo
+	for i, e := range entries {
+		var covered []util.Finfo
+		for _, info := range packed[paths[i]] {
+			// 大小不同说明文件已被修改，之前打包的切片不再算数
+			if info.Size == e.Size {
+				covered = append(covered, util.Finfo{Path: e.Path, Size: info.Size, Start: info.Start, End: info.End})
 			}
-			return nil
-		},
+		}
+		missing := util.UncoveredSlices(util.Finfo{Path: e.Path, Size: e.Size}, covered)
+		if len(missing) == 0 {
+			ib.skipped++
+			continue
+		}
+		unpacked = append(unpacked, missing...)
+	}
+	return unpacked, nil
+}
+
+// Close reports the entries read and closes the index
+func (ib *indexBins) Close() error {
+	fmt.Printf("Read %d index entries, %d already packed\n", ib.read, ib.skipped)
+	return ib.r.Close()
+}
+
+// relativePath returns the path of a source file relative to the dataset parent
+func relativePath(parent, p string) string {
+	relPath := strings.TrimPrefix(p, parent)
+	return strings.TrimPrefix(relPath, "/")
+}
+
+// statSources returns the mtime of every source file, keyed by path, and
+// checks that each file still has the size it was indexed with
+func statSources(files []util.Finfo) (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() != f.Size {
+			return nil, fmt.Errorf("source file %s has %d bytes, indexed with %d", f.Path, fi.Size(), f.Size)
+		}
+		modTimes[f.Path] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// checkSourcesUnchanged returns an error listing the source files whose size
+// or mtime changed since statSources
+func checkSourcesUnchanged(files []util.Finfo, modTimes map[string]time.Time) error {
+	var changed []string
+	for _, f := range files {
+		fi, err := os.Stat(f.Path)
+		if err != nil || fi.Size() != f.Size || !fi.ModTime().Equal(modTimes[f.Path]) {
+			changed = append(changed, f.Path)
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("source files changed while packing: %s", strings.Join(changed, ", "))
 	}
+	return nil
 }
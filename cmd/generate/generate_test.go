@@ -0,0 +1,87 @@
+package generate
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/util"
+)
+
+func TestIndexBinsWindows(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index.ndjson")
+	w, err := util.CreateIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]int64{"a": 10, "b": 25, "c": 5, "d": 8, "e": 12, "f": 7}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := w.Write(util.IndexEntry{Path: "/src/" + name, Size: sizes[name]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := util.OpenIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// d is packed, the first half of e is packed, f was packed before it changed
+	packed := map[string][]db.RawFileInfo{
+		"d": {{RelativePath: "d", Size: 8}},
+		"e": {{RelativePath: "e", Size: 12, Start: 0, End: 6}},
+		"f": {{RelativePath: "f", Size: 3}},
+	}
+	ib := &indexBins{
+		packed: func(paths []string) (map[string][]db.RawFileInfo, error) {
+			result := make(map[string][]db.RawFileInfo)
+			for _, p := range paths {
+				result[p] = packed[p]
+			}
+			return result, nil
+		},
+		r:        r,
+		parent:   "/src",
+		fileSize: 20,
+	}
+	defer ib.Close()
+
+	got := make(map[string]int64)
+	windows := 0
+	for {
+		bins, err := ib.next(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bins) == 0 {
+			break
+		}
+		windows++
+		for _, bin := range bins {
+			if util.BinSize(bin) > 20 {
+				t.Fatalf("bin %v holds more than the file size", bin)
+			}
+			for _, f := range bin {
+				got[f.Path] += f.Len()
+			}
+		}
+	}
+
+	want := map[string]int64{"/src/a": 10, "/src/b": 25, "/src/c": 5, "/src/e": 6, "/src/f": 7}
+	if len(got) != len(want) {
+		t.Fatalf("packed %v, want %v", got, want)
+	}
+	for p, n := range want {
+		if got[p] != n {
+			t.Fatalf("packed %d bytes of %s, want %d", got[p], p, n)
+		}
+	}
+	if windows < 2 {
+		t.Fatalf("packed in %d windows, want several windows of one car file", windows)
+	}
+	if ib.read != 6 || ib.skipped != 1 {
+		t.Fatalf("read %d entries with %d packed, want 6 with 1", ib.read, ib.skipped)
+	}
+}
@@ -1,15 +1,16 @@
 package importdeal
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"time"
 
 	"github.com/minerdao/lotus-car/config"
 	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/market"
 	"github.com/urfave/cli/v2"
 )
 
@@ -57,8 +58,21 @@ func Command() *cli.Command {
 			interval := c.Int64("interval")
 			regenerated := c.Bool("regenerated")
 
+			backend := &market.BoostCLI{BoostdPath: boostdPath}
+			opts := Options{
+				CarDirs:     carDirs,
+				Total:       total,
+				Regenerated: regenerated,
+			}
+
+			database, err := db.InitFromConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to initialize database: %v", err)
+			}
+			defer database.Close()
+
 			for {
-				if err := importDeals(cfg, carDirs, boostdPath, total, regenerated); err != nil {
+				if err := ImportDeals(c.Context, database, backend, opts); err != nil {
 					log.Printf("Error importing deals: %v", err)
 				}
 
@@ -74,25 +88,19 @@ func Command() *cli.Command {
 	}
 }
 
-func importDeals(cfg *config.Config, carDirs []string, boostdPath string, total int, regenerated bool) error {
-	// Initialize database connection
-	dbConfig := &db.DBConfig{
-		Host:     cfg.Database.Host,
-		Port:     cfg.Database.Port,
-		User:     cfg.Database.User,
-		Password: cfg.Database.Password,
-		DBName:   cfg.Database.DBName,
-		SSLMode:  cfg.Database.SSLMode,
-	}
-
-	database, err := db.InitDB(dbConfig)
-	if err != nil {
-		return fmt.Errorf("failed to initialize database: %v", err)
-	}
-	defer database.Close()
+// Options selects the deals whose car files are imported
+type Options struct {
+	CarDirs     []string // directories searched for <commp>.car
+	Total       int      // 0 means all
+	Regenerated bool     // only deals of regenerated car files
+}
 
+// ImportDeals hands the car files of proposed deals to their providers and
+// marks the deals imported
+func ImportDeals(ctx context.Context, database *db.Database, backend market.DealBackend, opts Options) error {
+	var err error
 	var deals []db.Deal
-	if regenerated {
+	if opts.Regenerated {
 		// 获取status为proposed且对应文件regenerate_status为success的订单
 		deals, err = database.GetProposedDealsWithRegeneratedFiles()
 	} else {
@@ -111,8 +119,8 @@ func importDeals(cfg *config.Config, carDirs []string, boostdPath string, total
 
 	// Determine how many deals to process
 	dealsToProcess := len(deals)
-	if total > 0 && total < dealsToProcess {
-		dealsToProcess = total
+	if opts.Total > 0 && opts.Total < dealsToProcess {
+		dealsToProcess = opts.Total
 	}
 
 	log.Printf("Found %d deals, will process %d deals", len(deals), dealsToProcess)
@@ -126,7 +134,7 @@ func importDeals(cfg *config.Config, carDirs []string, boostdPath string, total
 		// Search for car file in all directories
 		var carFile string
 		var found bool
-		for _, dir := range carDirs {
+		for _, dir := range opts.CarDirs {
 			path := filepath.Join(dir, deal.CommP+".car")
 			if _, err := os.Stat(path); err == nil {
 				carFile = path
@@ -134,21 +142,16 @@ func importDeals(cfg *config.Config, carDirs []string, boostdPath string, total
 				break
 			}
 		}
-		
+
 		if !found {
 			log.Printf("Car file not found for deal %s in any of the specified directories", deal.UUID)
 			failureCount++
 			continue
 		}
 
-		// Construct import command
-		cmd := exec.Command(boostdPath, "import-data", deal.UUID, carFile)
-
-		// Run the command
 		log.Printf("[%d/%d] Importing deal %s with car file %s", i+1, dealsToProcess, deal.UUID, carFile)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("Failed to import deal %s: %v\nOutput: %s", deal.UUID, err, string(output))
+		if err := backend.Import(ctx, deal, carFile); err != nil {
+			log.Printf("Failed to import deal %s: %v", deal.UUID, err)
 			failureCount++
 			continue
 		}
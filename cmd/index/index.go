@@ -1,11 +1,17 @@
 package index
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/minerdao/lotus-car/config"
+	"github.com/minerdao/lotus-car/db"
 	"github.com/minerdao/lotus-car/util"
 	"github.com/urfave/cli/v2"
 )
@@ -30,11 +36,64 @@ func Command() *cli.Command {
 				Usage:    "Index file name",
 				Required: true,
 			},
+			&cli.StringSliceFlag{
+				Name:  "hash",
+				Usage: "Record the content hash of every file, sha256 and/or md5",
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of files hashed in parallel",
+				Value: 4,
+			},
+			&cli.DurationFlag{
+				Name:  "checkpoint-interval",
+				Usage: "Save the index file at this interval so an interrupted run can resume",
+				Value: time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:  "rebuild",
+				Usage: "Ignore the existing index file and index every file again",
+			},
+			&cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "Only index files matching one of these glob patterns, matched against the base name or, with a slash, the relative path",
+			},
+			&cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "Skip files and directories matching one of these glob patterns",
+				Value: cli.NewStringSlice(".DS_Store"),
+			},
+			&cli.StringFlag{
+				Name:  "symlinks",
+				Usage: "Symlink policy: skip, files (follow symlinks to files only) or follow (also walk symlinked directories)",
+				Value: util.SymlinkFiles,
+			},
+			&cli.BoolFlag{
+				Name:  "skip-empty",
+				Usage: "Skip zero-byte files",
+			},
+			&cli.StringFlag{
+				Name:  "error-report",
+				Usage: "Write the entries that could not be read to this file, one per line",
+			},
+			&cli.StringFlag{
+				Name:  "dataset",
+				Usage: "Also save the index to the source files of this dataset in the database, creating the dataset if needed",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			sourceDir := c.String("source-dir")
 			outputDir := c.String("output-dir")
 			indexFile := c.String("index-file")
+			hashes := c.StringSlice("hash")
+			parallel := c.Int("parallel")
+			checkpointInterval := c.Duration("checkpoint-interval")
+			walkOpts := util.WalkOptions{
+				Include:   c.StringSlice("include"),
+				Exclude:   c.StringSlice("exclude"),
+				Symlinks:  c.String("symlinks"),
+				SkipEmpty: c.Bool("skip-empty"),
+			}
 
 			// Check if directories exist
 			if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
@@ -43,69 +102,420 @@ func Command() *cli.Command {
 			if _, err := os.Stat(outputDir); os.IsNotExist(err) {
 				return fmt.Errorf("parent directory does not exist: %s", outputDir)
 			}
+			if err := util.CheckHashes(hashes); err != nil {
+				return err
+			}
+			if err := walkOpts.Validate(); err != nil {
+				return err
+			}
+			if parallel < 1 {
+				parallel = 1
+			}
 
-			// List all files
-			var files []string
-			err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
+			outputFile := filepath.Join(outputDir, indexFile)
+			idx := &indexer{
+				hashes:             hashes,
+				outputFile:         outputFile,
+				checkpointInterval: checkpointInterval,
+				lastCheckpoint:     time.Now(),
+			}
+
+			// The previous index and the partial file of an interrupted run are
+			// read alongside the walk, unchanged files are not read again
+			var w *util.IndexWriter
+			var err error
+			if c.Bool("rebuild") {
+				w, err = util.CreateIndex(outputFile)
+			} else {
+				idx.prev, err = util.OpenIndex(outputFile)
+				if err != nil && !os.IsNotExist(err) {
 					return err
 				}
-				if !info.IsDir() {
-					files = append(files, path)
+				if idx.prev != nil {
+					defer idx.prev.Close()
+					if err := idx.advance(); err != nil {
+						return err
+					}
 				}
-				return nil
-			})
+				w, err = util.ResumeIndex(outputFile, func(e util.IndexEntry) {
+					idx.resumeAfter = e.Path
+				})
+				if w != nil && w.Count() > 0 {
+					fmt.Printf("Resuming from %d entries in %s\n", w.Count(), util.PartialIndexPath(outputFile))
+				}
+			}
 			if err != nil {
-				return fmt.Errorf("error walking through directory: %v", err)
+				return fmt.Errorf("error creating index file: %v", err)
 			}
+			idx.w = w
+			idx.resumed = w.Count()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 
-			// Create JSON array
-			var jsonArr []map[string]interface{}
-			for _, file := range files {
-				info, err := os.Stat(file)
+			// Workers may finish out of order, results are written in walk
+			// order and at most window files are in flight
+			window := parallel * 1024
+			slots := make(chan struct{}, window)
+			jobs := make(chan indexJob)
+			results := make(chan indexResult, window)
+			var wg sync.WaitGroup
+			for n := 0; n < parallel; n++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for job := range jobs {
+						results <- idx.index(job)
+					}
+				}()
+			}
+			writeErr := make(chan error, 1)
+			go func() {
+				err := idx.writeResults(results, slots)
 				if err != nil {
-					return fmt.Errorf("error getting file info: %v", err)
+					cancel()
 				}
+				writeErr <- err
+			}()
 
-				fileInfo := map[string]interface{}{
-					"Path": file,
-					"Size": info.Size(),
+			seq := 0
+			walkErrs, err := util.WalkSource(sourceDir, walkOpts, func(path string, info os.FileInfo) error {
+				if idx.resumeAfter != "" && util.ComparePaths(path, idx.resumeAfter) <= 0 {
+					return nil
 				}
-				jsonArr = append(jsonArr, fileInfo)
-				fmt.Printf("Indexed: %s, size: %s\n", file, util.FormatSize(info.Size()))
-			}
-
-			// Write to JSON file
-			outputFile := filepath.Join(outputDir, indexFile)
-
-			// Remove existing file if exists
-			if _, err := os.Stat(outputFile); err == nil {
-				fmt.Printf("Removing existing index file: %s\n", outputFile)
-				err = os.Remove(outputFile)
+				old, err := idx.lookup(path)
 				if err != nil {
-					return fmt.Errorf("error removing existing index file: %v", err)
+					return err
+				}
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				select {
+				case jobs <- indexJob{seq: seq, path: path, info: info, old: old}:
+					seq++
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			close(jobs)
+			wg.Wait()
+			close(results)
+			if wErr := <-writeErr; wErr != nil {
+				w.Close()
+				return fmt.Errorf("error writing index file: %v", wErr)
+			}
+			idx.unreadable = append(walkErrs, idx.unreadable...)
+			if err != nil {
+				// Keep what has been indexed so far for the next run
+				if closeErr := w.Close(); closeErr != nil {
+					fmt.Printf("Failed to save partial index file: %v\n", closeErr)
 				}
+				return fmt.Errorf("error walking through directory: %v", err)
 			}
 
-			// Create parent directory if not exists
-			if err := os.MkdirAll(outputDir, 0755); err != nil {
-				return fmt.Errorf("error creating output directory: %v", err)
+			// Files that disappeared since the last run are dropped from the index
+			for idx.next != nil {
+				if err := idx.skip(); err != nil {
+					return err
+				}
 			}
 
-			// Write JSON data
 			fmt.Printf("Writing index file: %s\n", outputFile)
-			jsonData, err := json.MarshalIndent(jsonArr, "", "    ")
-			if err != nil {
-				return fmt.Errorf("error marshaling JSON: %v", err)
+			if err := w.Commit(); err != nil {
+				return fmt.Errorf("error writing index file: %v", err)
 			}
 
-			err = os.WriteFile(outputFile, jsonData, 0644)
-			if err != nil {
-				return fmt.Errorf("error writing index file: %v", err)
+			fmt.Printf("Successfully indexed %d files (%d new or changed, %d unchanged, %d resumed, %d removed): %s\n",
+				w.Count(), idx.changed, idx.unchanged, idx.resumed, idx.removed, outputFile)
+			if err := reportUnreadable(idx.unreadable, c.String("error-report")); err != nil {
+				return err
 			}
 
-			fmt.Printf("Successfully indexed %d files: %s\n", len(jsonArr), outputFile)
+			if dataset := c.String("dataset"); dataset != "" {
+				return syncDataset(c, dataset, sourceDir, outputFile)
+			}
 			return nil
 		},
 	}
 }
+
+// syncDataset saves a complete index to the source files of a dataset, with
+// paths relative to the source directory so packers can mount it anywhere
+func syncDataset(c *cli.Context, name, sourceDir, indexFile string) error {
+	cfg, err := config.LoadConfig(c.String("config"))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	dbConfig := &db.DBConfig{
+		Host:     cfg.Database.Host,
+		Port:     cfg.Database.Port,
+		User:     cfg.Database.User,
+		Password: cfg.Database.Password,
+		DBName:   cfg.Database.DBName,
+		SSLMode:  cfg.Database.SSLMode,
+	}
+
+	database, err := db.InitDB(dbConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %v", err)
+	}
+	defer database.Close()
+
+	absSourceDir, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return err
+	}
+	dataset, err := database.GetOrCreateDataset(name, absSourceDir)
+	if err != nil {
+		return err
+	}
+	if dataset.SourceDir != absSourceDir {
+		fmt.Printf("Dataset %s was indexed from %s, now from %s\n", name, dataset.SourceDir, absSourceDir)
+	}
+
+	r, err := util.OpenIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files := 0
+	result, err := database.SyncSourceFiles(dataset.ID, func() (*db.SourceFile, error) {
+		e, err := r.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(sourceDir, e.Path)
+		if err != nil {
+			return nil, err
+		}
+		files++
+		return &db.SourceFile{
+			Path:    filepath.ToSlash(rel),
+			Size:    e.Size,
+			ModTime: e.ModTime,
+			SHA256:  e.SHA256,
+			MD5:     e.MD5,
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Synced %d files to dataset %s: %d new or changed, %d removed\n", files, name, result.Upserted, result.Removed)
+	if result.Reset > 0 {
+		fmt.Printf("%d packed files changed since they were packed and are set back to unpacked\n", result.Reset)
+	}
+
+	stats, err := database.GetSourceFileStats(dataset.ID)
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		fmt.Printf("  %-8s %d files, %s\n", s.Status, s.Files, util.FormatSize(s.Bytes))
+	}
+	return nil
+}
+
+// reportUnreadable prints the entries that could not be read and writes them
+// to reportFile if set
+func reportUnreadable(errs []util.WalkError, reportFile string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Path < errs[j].Path
+	})
+	fmt.Printf("%d entries could not be read and were skipped:\n", len(errs))
+	for _, e := range errs {
+		fmt.Printf("  %s\n", e.Error())
+	}
+	if reportFile == "" {
+		return nil
+	}
+
+	f, err := os.Create(reportFile)
+	if err != nil {
+		return fmt.Errorf("error creating error report: %v", err)
+	}
+	defer f.Close()
+	for _, e := range errs {
+		if _, err := fmt.Fprintf(f, "%s\t%v\n", e.Path, e.Err); err != nil {
+			return fmt.Errorf("error writing error report: %v", err)
+		}
+	}
+	fmt.Printf("Error report written to %s\n", reportFile)
+	return nil
+}
+
+// indexJob is a file found by the walk, with its entry in the previous index
+type indexJob struct {
+	seq  int
+	path string
+	info os.FileInfo
+	old  *util.IndexEntry
+}
+
+// indexResult is the entry of an indexJob, nil when the file could not be read
+type indexResult struct {
+	seq     int
+	entry   *util.IndexEntry
+	changed bool
+}
+
+// indexer holds the state of an index run. The previous index is read in step
+// with the walk, which visits files in the order index files are written in.
+type indexer struct {
+	hashes             []string
+	outputFile         string
+	checkpointInterval time.Duration
+
+	// Only used by the walk
+	prev        *util.IndexReader
+	next        *util.IndexEntry // next unmatched entry of the previous index
+	resumeAfter string           // last path of the resumed partial file
+	removed     int
+
+	// Only used by writeResults
+	w              *util.IndexWriter
+	changed        int
+	unchanged      int
+	resumed        int
+	lastCheckpoint time.Time
+
+	mu         sync.Mutex
+	unreadable []util.WalkError
+}
+
+// advance reads the next entry of the previous index
+func (idx *indexer) advance() error {
+	e, err := idx.prev.Next()
+	if err == io.EOF {
+		idx.next = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading previous index: %v", err)
+	}
+	idx.next = &e
+	return nil
+}
+
+// skip drops the next entry of the previous index, which is no longer in the
+// source directory unless it was already written by the resumed run
+func (idx *indexer) skip() error {
+	if idx.resumeAfter == "" || util.ComparePaths(idx.next.Path, idx.resumeAfter) > 0 {
+		idx.removed++
+	}
+	return idx.advance()
+}
+
+// lookup returns the entry of path in the previous index. Index files written
+// in another order still work, their unmatched files are just read again.
+func (idx *indexer) lookup(path string) (*util.IndexEntry, error) {
+	for idx.next != nil && util.ComparePaths(idx.next.Path, path) < 0 {
+		if err := idx.skip(); err != nil {
+			return nil, err
+		}
+	}
+	if idx.next == nil || idx.next.Path != path {
+		return nil, nil
+	}
+	old := idx.next
+	return old, idx.advance()
+}
+
+// index records one file, reading it only when it is new or has changed. A
+// file that cannot be read is reported and left out of the index.
+func (idx *indexer) index(job indexJob) indexResult {
+	old, info, path := job.old, job.info, job.path
+	if old != nil && old.Unchanged(info, idx.hashes) {
+		return indexResult{seq: job.seq, entry: old}
+	}
+
+	entry := util.IndexEntry{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	// Hashes of an unchanged file are kept even if they are not requested this time
+	if old != nil && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) {
+		entry.SHA256 = old.SHA256
+		entry.MD5 = old.MD5
+	}
+	// Without hashes the file is only opened, so unreadable files are still found
+	sums, err := util.HashFile(path, idx.hashes)
+	if err == nil && len(idx.hashes) == 0 {
+		var f *os.File
+		if f, err = os.Open(path); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		idx.mu.Lock()
+		idx.unreadable = append(idx.unreadable, util.WalkError{Path: path, Err: err})
+		idx.mu.Unlock()
+		return indexResult{seq: job.seq}
+	}
+	if sum, ok := sums[util.HashSHA256]; ok {
+		entry.SHA256 = sum
+	}
+	if sum, ok := sums[util.HashMD5]; ok {
+		entry.MD5 = sum
+	}
+	fmt.Printf("Indexed: %s, size: %s\n", path, util.FormatSize(info.Size()))
+	return indexResult{seq: job.seq, entry: &entry, changed: true}
+}
+
+// writeResults writes the results in walk order, freeing a slot for every
+// result written
+func (idx *indexer) writeResults(results <-chan indexResult, slots <-chan struct{}) error {
+	pending := make(map[int]indexResult)
+	next := 0
+	for res := range results {
+		pending[res.seq] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-slots
+			if res.entry == nil {
+				continue
+			}
+			if err := idx.w.Write(*res.entry); err != nil {
+				return err
+			}
+			if res.changed {
+				idx.changed++
+			} else {
+				idx.unchanged++
+			}
+		}
+		if err := idx.checkpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint flushes the partial file once the checkpoint interval has passed
+// since the previous checkpoint, so an interrupted run can resume from it
+func (idx *indexer) checkpoint() error {
+	if idx.checkpointInterval <= 0 || time.Since(idx.lastCheckpoint) < idx.checkpointInterval {
+		return nil
+	}
+	if err := idx.w.Flush(); err != nil {
+		return err
+	}
+	idx.lastCheckpoint = time.Now()
+	fmt.Printf("Checkpoint: saved %d entries to %s\n", idx.w.Count(), util.PartialIndexPath(idx.outputFile))
+	return nil
+}
@@ -0,0 +1,301 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minerdao/lotus-car/config"
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/util"
+	"github.com/urfave/cli/v2"
+)
+
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:  "provider",
+		Usage: "Manage the storage providers deals are sent to",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "add",
+				Usage: "Register a storage provider",
+				Flags: settingFlags(),
+				Action: func(c *cli.Context) error {
+					p := &db.Provider{MinerID: c.String("miner"), Verified: true}
+					if err := applySettings(c, p); err != nil {
+						return err
+					}
+					return withDatabase(c, func(database *db.Database) error {
+						if err := database.AddProvider(p); err != nil {
+							return err
+						}
+						fmt.Printf("Provider %s added\n", p.MinerID)
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "update",
+				Usage: "Change the settings of a storage provider, flags not set are kept",
+				Flags: settingFlags(),
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(database *db.Database) error {
+						p, err := getProvider(database, c.String("miner"))
+						if err != nil {
+							return err
+						}
+						if err := applySettings(c, p); err != nil {
+							return err
+						}
+						if err := database.UpdateProvider(p); err != nil {
+							return err
+						}
+						fmt.Printf("Provider %s updated\n", p.MinerID)
+						return nil
+					})
+				},
+			},
+			stateCommand("pause", "Stop sending deals to a storage provider", db.ProviderStatePaused),
+			stateCommand("resume", "Send deals to a paused storage provider again", db.ProviderStateEnabled),
+			{
+				Name:  "remove",
+				Usage: "Remove a storage provider from the registry, its deals are kept",
+				Flags: []cli.Flag{minerFlag()},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(database *db.Database) error {
+						if err := database.DeleteProvider(c.String("miner")); err != nil {
+							return err
+						}
+						fmt.Printf("Provider %s removed\n", c.String("miner"))
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List the storage providers with their usage in the last 24 hours",
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(database *db.Database) error {
+						providers, err := database.ListProviders()
+						if err != nil {
+							return err
+						}
+						if len(providers) == 0 {
+							fmt.Println("No providers found")
+							return nil
+						}
+						usage, err := database.GetProviderUsage(time.Now().Add(-24 * time.Hour))
+						if err != nil {
+							return err
+						}
+
+						fmt.Printf("%-12s %-16s %-8s %-12s %-22s %-8s %-8s\n", "MINER", "LABEL", "STATE", "DEALS/DAY", "IN FLIGHT", "VERIFIED", "FAILURE")
+						for _, p := range providers {
+							u := usage[p.MinerID]
+							fmt.Printf("%-12s %-16s %-8s %-12s %-22s %-8t %-8s\n",
+								p.MinerID, p.Label, p.State,
+								fmt.Sprintf("%d/%s", u.Deals, limit(int64(p.MaxDealsPerDay), formatCount)),
+								fmt.Sprintf("%s/%s", util.FormatSize(u.BytesInFlight), limit(p.MaxBytesInFlight, util.FormatSize)),
+								p.Verified, fmt.Sprintf("%.0f%%", u.FailureRate()*100))
+						}
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "show",
+				Usage: "Show the settings and usage of a storage provider",
+				Flags: []cli.Flag{minerFlag()},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(database *db.Database) error {
+						p, err := getProvider(database, c.String("miner"))
+						if err != nil {
+							return err
+						}
+						usage, err := database.GetProviderUsage(time.Now().Add(-24 * time.Hour))
+						if err != nil {
+							return err
+						}
+						u := usage[p.MinerID]
+
+						wallets := strings.Join(p.AllowedWallets, ", ")
+						if wallets == "" {
+							wallets = "(any)"
+						}
+						fmt.Printf("Miner:               %s\n", p.MinerID)
+						fmt.Printf("Label:               %s\n", p.Label)
+						fmt.Printf("State:               %s\n", p.State)
+						fmt.Printf("Verified:            %t\n", p.Verified)
+						fmt.Printf("Storage price:       %d attoFIL/GiB/epoch\n", p.StoragePrice)
+						fmt.Printf("Allowed wallets:     %s\n", wallets)
+						fmt.Printf("Deals last 24h:      %d/%s\n", u.Deals, limit(int64(p.MaxDealsPerDay), formatCount))
+						fmt.Printf("Deals per hour:      %s\n", limit(int64(p.MaxDealsPerHour), formatCount))
+						fmt.Printf("Bytes per day:       %s\n", limit(p.MaxBytesPerDay, util.FormatSize))
+						fmt.Printf("Bytes in flight:     %s/%s\n", util.FormatSize(u.BytesInFlight), limit(p.MaxBytesInFlight, util.FormatSize))
+						fmt.Printf("Failure rate:        %.0f%% of %d attempts in 24h, limit %s\n", u.FailureRate()*100, u.Attempts, rateLimit(p.MaxFailureRate))
+						fmt.Printf("Created at:          %s\n", p.CreatedAt.Format("2006-01-02 15:04:05"))
+						return nil
+					})
+				},
+			},
+		},
+	}
+}
+
+func minerFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:     "miner",
+		Usage:    "Storage provider ID, such as f01234",
+		Required: true,
+	}
+}
+
+// settingFlags are the flags of add and update
+func settingFlags() []cli.Flag {
+	return []cli.Flag{
+		minerFlag(),
+		&cli.StringFlag{
+			Name:  "label",
+			Usage: "Free text describing the provider",
+		},
+		&cli.IntFlag{
+			Name:  "max-deals-per-day",
+			Usage: "Maximum deals sent to the provider in 24 hours (0 means no limit)",
+		},
+		&cli.IntFlag{
+			Name:  "max-deals-per-hour",
+			Usage: "Maximum deals sent to the provider in an hour (0 means no limit)",
+		},
+		&cli.Int64Flag{
+			Name:  "max-bytes-per-day",
+			Usage: "Maximum piece bytes of deals sent to the provider in 24 hours (0 means no limit)",
+		},
+		&cli.Int64Flag{
+			Name:  "max-bytes-in-flight",
+			Usage: "Maximum piece bytes of deals sent to the provider and not proving yet (0 means no limit)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allowed-wallet",
+			Usage: "Client wallet the provider accepts deals from, repeatable (any wallet when not set)",
+		},
+		&cli.Int64Flag{
+			Name:  "price",
+			Usage: "Storage price in attoFIL per GiB per epoch",
+		},
+		&cli.BoolFlag{
+			Name:  "verified",
+			Usage: "Send verified (Fil+) deals to the provider",
+			Value: true,
+		},
+		&cli.Float64Flag{
+			Name:  "max-failure-rate",
+			Usage: "Stop sending deals while the failure rate of the last 24 hours is above this, between 0 and 1 (0 means no limit)",
+		},
+	}
+}
+
+// applySettings copies the setting flags set on the command line to p
+func applySettings(c *cli.Context, p *db.Provider) error {
+	if c.IsSet("label") {
+		p.Label = c.String("label")
+	}
+	if c.IsSet("max-deals-per-day") {
+		p.MaxDealsPerDay = c.Int("max-deals-per-day")
+	}
+	if c.IsSet("max-deals-per-hour") {
+		p.MaxDealsPerHour = c.Int("max-deals-per-hour")
+	}
+	if c.IsSet("max-bytes-per-day") {
+		p.MaxBytesPerDay = c.Int64("max-bytes-per-day")
+	}
+	if c.IsSet("max-bytes-in-flight") {
+		p.MaxBytesInFlight = c.Int64("max-bytes-in-flight")
+	}
+	if c.IsSet("allowed-wallet") {
+		p.AllowedWallets = c.StringSlice("allowed-wallet")
+	}
+	if c.IsSet("price") {
+		p.StoragePrice = c.Int64("price")
+	}
+	if c.IsSet("verified") {
+		p.Verified = c.Bool("verified")
+	}
+	if c.IsSet("max-failure-rate") {
+		p.MaxFailureRate = c.Float64("max-failure-rate")
+	}
+
+	if p.MaxDealsPerDay < 0 || p.MaxDealsPerHour < 0 || p.MaxBytesPerDay < 0 || p.MaxBytesInFlight < 0 || p.StoragePrice < 0 {
+		return fmt.Errorf("limits and price must not be negative")
+	}
+	if p.MaxFailureRate < 0 || p.MaxFailureRate > 1 {
+		return fmt.Errorf("max failure rate must be between 0 and 1")
+	}
+	return nil
+}
+
+func stateCommand(name, usage string, state db.ProviderState) *cli.Command {
+	return &cli.Command{
+		Name:  name,
+		Usage: usage,
+		Flags: []cli.Flag{minerFlag()},
+		Action: func(c *cli.Context) error {
+			return withDatabase(c, func(database *db.Database) error {
+				p, err := getProvider(database, c.String("miner"))
+				if err != nil {
+					return err
+				}
+				p.State = state
+				if err := database.UpdateProvider(p); err != nil {
+					return err
+				}
+				fmt.Printf("Provider %s is %s\n", p.MinerID, p.State)
+				return nil
+			})
+		},
+	}
+}
+
+func withDatabase(c *cli.Context, fn func(database *db.Database) error) error {
+	cfg, err := config.LoadConfig(c.String("config"))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	database, err := db.InitFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %v", err)
+	}
+	defer database.Close()
+
+	return fn(database)
+}
+
+func getProvider(database *db.Database, minerID string) (*db.Provider, error) {
+	p, err := database.GetProvider(minerID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("provider %s not found", minerID)
+	}
+	return p, nil
+}
+
+func formatCount(v int64) string {
+	return fmt.Sprint(v)
+}
+
+// limit formats a limit, 0 meaning no limit
+func limit(v int64, format func(int64) string) string {
+	if v == 0 {
+		return "-"
+	}
+	return format(v)
+}
+
+func rateLimit(v float64) string {
+	if v == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%.0f%%", v*100)
+}
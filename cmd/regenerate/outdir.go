@@ -0,0 +1,98 @@
+package regenerate
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/util"
+)
+
+// outDirs hands out the output directories of a regenerate run. Each car file
+// goes to the directory with the most free space left once the car files
+// still being written are accounted for, the directories should therefore be
+// on different disks.
+type outDirs struct {
+	mu        sync.Mutex
+	dirs      []string
+	reserved  map[string]uint64
+	freeSpace func(dir string) (uint64, error)
+}
+
+func newOutDirs(dirs []string) (*outDirs, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("at least one output directory is required")
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %v", err)
+		}
+	}
+	return &outDirs{dirs: dirs, reserved: make(map[string]uint64), freeSpace: util.FreeSpace}, nil
+}
+
+// find returns the path of a car file already regenerated into one of the
+// directories, or an empty string
+func (o *outDirs) find(pieceCid string) string {
+	for _, dir := range o.dirs {
+		p := filepath.Join(dir, pieceCid+".car")
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			return p
+		}
+	}
+	return ""
+}
+
+// pending returns the files that still need to be regenerated and the number
+// of files skipped because they were regenerated successfully and their car
+// file is still in one of the directories. force regenerates every file.
+func (o *outDirs) pending(files []db.CarFile, force bool) ([]db.CarFile, int) {
+	var pending []db.CarFile
+	skipped := 0
+	for _, file := range files {
+		if !force && file.RegenerateStatus == db.RegenerateStatusSuccess {
+			if p := o.find(file.PieceCid); p != "" {
+				log.Printf("Skip file %s, already regenerated to %s", file.ID, p)
+				skipped++
+				continue
+			}
+		}
+		pending = append(pending, file)
+	}
+	return pending, skipped
+}
+
+// reserve picks the directory for a car file of size bytes and holds the
+// space until release is called
+func (o *outDirs) reserve(size uint64) (dir string, release func(), err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var best uint64
+	for _, d := range o.dirs {
+		free, err := o.freeSpace(d)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get free space of %s: %v", d, err)
+		}
+		if free < o.reserved[d] {
+			continue
+		}
+		free -= o.reserved[d]
+		if free >= size && (dir == "" || free > best) {
+			dir, best = d, free
+		}
+	}
+	if dir == "" {
+		return "", nil, fmt.Errorf("no output directory has %d bytes free", size)
+	}
+
+	o.reserved[dir] += size
+	return dir, func() {
+		o.mu.Lock()
+		o.reserved[dir] -= size
+		o.mu.Unlock()
+	}, nil
+}
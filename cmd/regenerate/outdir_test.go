@@ -0,0 +1,98 @@
+package regenerate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// testOutDirs returns outDirs over n temporary directories reporting the
+// given free space
+func testOutDirs(t *testing.T, free ...uint64) (*outDirs, []string) {
+	var dirs []string
+	space := make(map[string]uint64)
+	for _, f := range free {
+		dir := t.TempDir()
+		dirs = append(dirs, dir)
+		space[dir] = f
+	}
+	o, err := newOutDirs(dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.freeSpace = func(dir string) (uint64, error) {
+		return space[dir], nil
+	}
+	return o, dirs
+}
+
+func TestOutDirsReserve(t *testing.T) {
+	o, dirs := testOutDirs(t, 100, 80)
+
+	dir, release1, err := o.reserve(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != dirs[0] {
+		t.Fatalf("expected the directory with the most free space, got %s", dir)
+	}
+
+	// 100 - 50 reserved leaves less than the 80 of the second directory
+	dir, release2, err := o.reserve(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != dirs[1] {
+		t.Fatalf("expected reservations to count against free space, got %s", dir)
+	}
+
+	// 50 and 30 are left once both reservations are held
+	if _, _, err := o.reserve(60); err == nil {
+		t.Fatalf("expected no directory to fit 60 bytes")
+	}
+
+	release1()
+	dir, _, err = o.reserve(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != dirs[0] {
+		t.Fatalf("expected released space to be available again, got %s", dir)
+	}
+	release2()
+}
+
+func TestOutDirsNothingFits(t *testing.T) {
+	o, _ := testOutDirs(t, 10, 20)
+	if _, _, err := o.reserve(30); err == nil {
+		t.Fatalf("expected an error when no directory has enough free space")
+	}
+}
+
+func TestOutDirsPending(t *testing.T) {
+	o, dirs := testOutDirs(t, 100, 100)
+	if err := os.WriteFile(filepath.Join(dirs[1], "piece-done.car"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirs[0], "piece-failed.car"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []db.CarFile{
+		{ID: "done", PieceCid: "piece-done", RegenerateStatus: db.RegenerateStatusSuccess},
+		{ID: "missing", PieceCid: "piece-missing", RegenerateStatus: db.RegenerateStatusSuccess},
+		{ID: "failed", PieceCid: "piece-failed", RegenerateStatus: db.RegenerateStatusFailed},
+	}
+
+	pending, skipped := o.pending(files, false)
+	if skipped != 1 || len(pending) != 2 || pending[0].ID != "missing" || pending[1].ID != "failed" {
+		t.Fatalf("expected only the regenerated file with a car file to be skipped, got %d skipped and %v", skipped, pending)
+	}
+
+	pending, skipped = o.pending(files, true)
+	if skipped != 0 || len(pending) != 3 {
+		t.Fatalf("expected force to regenerate every file, got %d skipped and %d pending", skipped, len(pending))
+	}
+}
@@ -8,13 +8,12 @@ import (
 	"io"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	commcid "github.com/filecoin-project/go-fil-commcid"
 	commp "github.com/filecoin-project/go-fil-commp-hashhash"
-	"github.com/google/uuid"
 	"github.com/minerdao/lotus-car/config"
 	"github.com/minerdao/lotus-car/db"
 	"github.com/minerdao/lotus-car/util"
@@ -51,10 +50,33 @@ func Command() *cli.Command {
 				Value:   "",
 			},
 			&cli.StringFlag{
+				Name:  "blockstore-dir",
+				Usage: "Optionally keep intermediate blocks in a temporary on-disk blockstore under this directory to bound memory usage",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "car-version",
+				Usage: "Car format version to regenerate, 0 uses the version recorded for each car file",
+				Value: 0,
+			},
+			&cli.StringSliceFlag{
 				Name:    "out-dir",
 				Aliases: []string{"o"},
-				Usage:   "Output directory to save the car file",
-				Value:   ".",
+				Usage:   "Output directory to save the car files (can be specified multiple times), each car file goes to the one with the most free space",
+				Value:   cli.NewStringSlice("."),
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of car files regenerated in parallel",
+				Value: 1,
+			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "Regenerate car files already regenerated successfully whose car file exists",
+			},
+			&cli.BoolFlag{
+				Name:  "check-hash",
+				Usage: "Hash every raw file before regenerating, by default only files whose mtime changed are hashed",
 			},
 		},
 		Action: func(c *cli.Context) error {
@@ -68,7 +90,14 @@ func Command() *cli.Command {
 			fromPieceCids := c.String("from-piece-cids")
 			parent := c.String("parent")
 			tmpDir := c.String("tmp-dir")
-			outDir := c.String("out-dir")
+			parallel := c.Int("parallel")
+			if parallel < 1 {
+				parallel = 1
+			}
+			carOpts := util.CarOptions{
+				BlockstoreDir: c.String("blockstore-dir"),
+				CarVersion:    c.Int("car-version"),
+			}
 
 			dbConfig := &db.DBConfig{
 				Host:     cfg.Database.Host,
@@ -119,26 +148,54 @@ func Command() *cli.Command {
 				return fmt.Errorf("no files found for the provided piece CIDs")
 			}
 
-			log.Printf("Found %d files to regenerate", len(files))
+			outDirs, err := newOutDirs(c.StringSlice("out-dir"))
+			if err != nil {
+				return err
+			}
 
+			// 跳过已成功重新生成且 car 文件仍在的记录，中断后重跑同一批次即可继续
+			pending, skipCount := outDirs.pending(files, c.Bool("force"))
+			log.Printf("Found %d files to regenerate, %d already regenerated", len(pending), skipCount)
+			if parallel > len(pending) {
+				parallel = len(pending)
+			}
+
+			var mu sync.Mutex
 			successCount := 0
 			failureCount := 0
 
-			// 处理每个文件
-			for i, file := range files {
-				log.Printf("[%d/%d] Start regenerating file %s", i+1, len(files), file.ID)
-				err = regenerateFile(database, file, parent, tmpDir, outDir)
-				if err != nil {
-					log.Printf("[%d/%d] Failed to regenerate file %s: %v", i+1, len(files), file.ID, err)
-					failureCount++
-					continue
-				}
-				successCount++
-				log.Printf("[%d/%d] Successfully regenerated file %s", i+1, len(files), file.ID)
+			jobs := make(chan int)
+			var wg sync.WaitGroup
+			for w := 0; w < parallel; w++ {
+				workerTmpDir := util.WorkerTmpDir(tmpDir, w, parallel)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range jobs {
+						file := pending[i]
+						log.Printf("[%d/%d] Start regenerating file %s", i+1, len(pending), file.ID)
+						err := regenerateTo(database, outDirs, file, parent, workerTmpDir, carOpts, c.Bool("check-hash"))
+						mu.Lock()
+						if err != nil {
+							log.Printf("[%d/%d] Failed to regenerate file %s: %v", i+1, len(pending), file.ID, err)
+							failureCount++
+						} else {
+							log.Printf("[%d/%d] Successfully regenerated file %s", i+1, len(pending), file.ID)
+							successCount++
+						}
+						mu.Unlock()
+					}
+				}()
 			}
+			for i := range pending {
+				jobs <- i
+			}
+			close(jobs)
+			wg.Wait()
 
 			log.Printf("\nRegenerate Summary:")
 			log.Printf("Total Files: %d", len(files))
+			log.Printf("Skipped: %d", skipCount)
 			log.Printf("Success: %d", successCount)
 			log.Printf("Failed: %d", failureCount)
 
@@ -171,8 +228,24 @@ func readPieceCidsFromFile(filePath string) ([]string, error) {
 	return pieceCids, nil
 }
 
+// regenerateTo regenerates a car file into the output directory with the most
+// free space
+func regenerateTo(database *db.Database, outDirs *outDirs, file db.CarFile, parent, tmpDir string, carOpts util.CarOptions, checkHash bool) error {
+	size := file.CarSize
+	if size == 0 {
+		size = file.PieceSize
+	}
+	outDir, release, err := outDirs.reserve(size)
+	if err != nil {
+		_ = database.UpdateRegenerateStatus(file.ID, db.RegenerateStatusFailed)
+		return err
+	}
+	defer release()
+	return regenerateFile(database, file, parent, tmpDir, outDir, carOpts, checkHash)
+}
+
 // 重新生成单个文件
-func regenerateFile(database *db.Database, file db.CarFile, parent, tmpDir, outDir string) error {
+func regenerateFile(database *db.Database, file db.CarFile, parent, tmpDir, outDir string, carOpts util.CarOptions, checkHash bool) error {
 	log.Printf("Start regenerating car file for id: %s, piece cid: %s", file.ID, file.PieceCid)
 
 	// 更新状态为进行中
@@ -190,28 +263,40 @@ func regenerateFile(database *db.Database, file db.CarFile, parent, tmpDir, outD
 		return fmt.Errorf("failed to unmarshal raw files: %v", err)
 	}
 
-	// 检查所有原始文件是否存在
-	for _, rawFile := range rawFiles {
-		fullPath := filepath.Join(parent, rawFile.RelativePath)
-		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-			// 更新状态为失败
-			_ = database.UpdateRegenerateStatus(file.ID, db.RegenerateStatusFailed)
-			return fmt.Errorf("raw file not found: %s", fullPath)
-		}
+	// 未指定版本时按生成时记录的版本重建，否则 CommP 无法对上
+	if carOpts.CarVersion == 0 {
+		carOpts.CarVersion = file.CarVersion
 	}
 
-	// 生成临时 car 文件
-	outFilename := uuid.New().String() + ".car"
-	outPath := path.Join(outDir, outFilename)
-
-	// 创建输出目录
-	err = os.MkdirAll(outDir, 0755)
+	// 使用生成时记录的 UnixFS 参数，保证 DAG 完全一致
+	carOpts.Unixfs, err = util.ParseUnixfsParams(file.UnixfsParams)
 	if err != nil {
 		// 更新状态为失败
 		_ = database.UpdateRegenerateStatus(file.ID, db.RegenerateStatusFailed)
-		return fmt.Errorf("failed to create output directory: %v", err)
+		return err
 	}
 
+	// 开始前检查所有原始文件是否存在且与打包时一致，一次列出全部有变化的文件
+	var drifted []string
+	for _, rawFile := range rawFiles {
+		fullPath := filepath.Join(parent, strings.TrimPrefix(rawFile.RelativePath, "/"))
+		if drift := util.SourceDrift(fullPath, rawFile, checkHash); drift != "" {
+			drifted = append(drifted, fmt.Sprintf("%s: %s", fullPath, drift))
+		}
+	}
+	if len(drifted) > 0 {
+		// 更新状态为失败
+		_ = database.UpdateRegenerateStatus(file.ID, db.RegenerateStatusFailed)
+		for _, d := range drifted {
+			log.Printf("Drifted raw file %s", d)
+		}
+		return fmt.Errorf("%d of %d raw files changed since the car file was packed", len(drifted), len(rawFiles))
+	}
+
+	// 生成临时 car 文件，进程中断后留下的临时文件在重跑时被覆盖
+	generatedFile := filepath.Join(outDir, fmt.Sprintf("%s.car", file.PieceCid))
+	outPath := generatedFile + ".tmp"
+
 	// 生成 car 文件
 	carF, err := os.Create(outPath)
 	if err != nil {
@@ -224,8 +309,10 @@ func regenerateFile(database *db.Database, file db.CarFile, parent, tmpDir, outD
 	var selectedFiles []util.Finfo
 	for _, rawFile := range rawFiles {
 		selectedFiles = append(selectedFiles, util.Finfo{
-			Path: filepath.Join(parent, strings.TrimPrefix(rawFile.RelativePath, "/")),
-			Size: rawFile.Size,
+			Path:  filepath.Join(parent, strings.TrimPrefix(rawFile.RelativePath, "/")),
+			Size:  rawFile.Size,
+			Start: rawFile.Start,
+			End:   rawFile.End,
 		})
 	}
 
@@ -234,7 +321,7 @@ func regenerateFile(database *db.Database, file db.CarFile, parent, tmpDir, outD
 	cp := new(commp.Calc)
 	writer := bufio.NewWriterSize(io.MultiWriter(carF, cp), BufSize)
 
-	_, cid, _, err := util.GenerateCar(ctx, selectedFiles, parent, tmpDir, writer)
+	ipldDag, cid, cidMap, err := util.GenerateCar(ctx, selectedFiles, parent, tmpDir, carOpts, writer)
 	if err != nil {
 		// 更新状态为失败
 		_ = database.UpdateRegenerateStatus(file.ID, db.RegenerateStatusFailed)
@@ -302,7 +389,6 @@ func regenerateFile(database *db.Database, file db.CarFile, parent, tmpDir, outD
 	}
 
 	// 重命名为最终文件名
-	generatedFile := filepath.Join(outDir, fmt.Sprintf("%s.car", file.PieceCid))
 	err = os.Rename(outPath, generatedFile)
 	if err != nil {
 		// 更新状态为失败
@@ -310,6 +396,13 @@ func regenerateFile(database *db.Database, file db.CarFile, parent, tmpDir, outD
 		return fmt.Errorf("failed to rename car file: %v", err)
 	}
 
+	// 保存文件 CID 树，补全旧记录缺失的数据
+	err = database.SaveFileCids(file.ID, util.FileCids(ipldDag, cidMap))
+	if err != nil {
+		_ = database.UpdateRegenerateStatus(file.ID, db.RegenerateStatusFailed)
+		return fmt.Errorf("failed to save file cids: %v", err)
+	}
+
 	// 更新状态为成功
 	err = database.UpdateRegenerateStatus(file.ID, db.RegenerateStatusSuccess)
 	if err != nil {
@@ -50,9 +50,13 @@ func Command() *cli.Command {
 			// 需要认证的路由
 			authMiddleware := middleware.AuthMiddleware(authConfig)
 			mux.HandleFunc("/api/files", authMiddleware(apiServer.ListFiles))
-			mux.HandleFunc("/api/file", authMiddleware(apiServer.GetFile))       // GET with ?id=X
-			mux.HandleFunc("/api/delete", authMiddleware(apiServer.DeleteFile))  // DELETE with ?id=X
-			mux.HandleFunc("/api/search", authMiddleware(apiServer.SearchFiles)) // GET with query params
+			mux.HandleFunc("/api/file", authMiddleware(apiServer.GetFile))        // GET with ?id=X
+			mux.HandleFunc("/api/delete", authMiddleware(apiServer.DeleteFile))   // DELETE with ?id=X
+			mux.HandleFunc("/api/search", authMiddleware(apiServer.SearchFiles))  // GET with query params
+			mux.HandleFunc("/api/cids", authMiddleware(apiServer.ListFileCids))   // GET with ?id=X or ?path=X
+			mux.HandleFunc("/api/deals", authMiddleware(apiServer.ListFileDeals)) // GET with ?id=X
+			mux.HandleFunc("/api/datasets", authMiddleware(apiServer.ListDatasets))
+			mux.HandleFunc("/api/dataset", authMiddleware(apiServer.GetDataset)) // GET with ?name=X
 
 			log.Printf("Starting API server on %s", cfg.Server.Address)
 			return http.ListenAndServe(cfg.Server.Address, mux)
@@ -1,17 +1,16 @@
 package updatedeal
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/urfave/cli/v2"
 
 	"github.com/minerdao/lotus-car/config"
 	"github.com/minerdao/lotus-car/db"
-	"github.com/minerdao/lotus-car/util"
+	"github.com/minerdao/lotus-car/market"
 )
 
 type DealResponse struct {
@@ -20,40 +19,6 @@ type DealResponse struct {
 	Message    string `json:"Message"`
 }
 
-// BoostDealStatus represents the parsed response from boost deal-status command
-type BoostDealStatus struct {
-	UUID        string
-	Status      string
-	Label       string
-	PublishCid  string
-	ChainDealID int64
-}
-
-func parseDealStatus(output string) (*BoostDealStatus, error) {
-	status := &BoostDealStatus{}
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "deal uuid:") {
-			status.UUID = strings.TrimSpace(strings.TrimPrefix(line, "deal uuid:"))
-		} else if strings.HasPrefix(line, "deal status:") {
-			status.Status = strings.TrimSpace(strings.TrimPrefix(line, "deal status:"))
-		} else if strings.HasPrefix(line, "deal label:") {
-			status.Label = strings.TrimSpace(strings.TrimPrefix(line, "deal label:"))
-		} else if strings.HasPrefix(line, "publish cid:") {
-			status.PublishCid = strings.TrimSpace(strings.TrimPrefix(line, "publish cid:"))
-		} else if strings.HasPrefix(line, "chain deal id:") {
-			idStr := strings.TrimSpace(strings.TrimPrefix(line, "chain deal id:"))
-			id, err := strconv.ParseInt(idStr, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse chain deal id: %w", err)
-			}
-			status.ChainDealID = id
-		}
-	}
-	return status, nil
-}
-
 func Command() *cli.Command {
 	return &cli.Command{
 		Name:  "update-deal",
@@ -89,8 +54,15 @@ func Command() *cli.Command {
 			boostPath := c.String("boost-path")
 			delay := c.Int("delay")
 
+			backend := &market.BoostCLI{Path: boostPath}
+			database, err := db.InitFromConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to init database: %w", err)
+			}
+			defer database.Close()
+
 			// 启动时立即运行一次
-			if err := updateDeals(cfg, boostPath, delay); err != nil {
+			if err := UpdateDeals(c.Context, database, backend, time.Duration(delay)*time.Second); err != nil {
 				log.Printf("Error updating deals: %v", err)
 			}
 
@@ -98,7 +70,7 @@ func Command() *cli.Command {
 			if interval > 0 {
 				for {
 					time.Sleep(time.Duration(interval) * time.Second)
-					if err := updateDeals(cfg, boostPath, delay); err != nil {
+					if err := UpdateDeals(c.Context, database, backend, time.Duration(delay)*time.Second); err != nil {
 						log.Printf("Error updating deals: %v", err)
 					}
 				}
@@ -109,23 +81,9 @@ func Command() *cli.Command {
 	}
 }
 
-func updateDeals(cfg *config.Config, boostPath string, delay int) error {
-	// Get all deals with "imported" status
-	dbConfig := &db.DBConfig{
-		Host:     cfg.Database.Host,
-		Port:     cfg.Database.Port,
-		User:     cfg.Database.User,
-		Password: cfg.Database.Password,
-		DBName:   cfg.Database.DBName,
-		SSLMode:  cfg.Database.SSLMode,
-	}
-
-	database, err := db.InitDB(dbConfig)
-	if err != nil {
-		return fmt.Errorf("failed to init database: %w", err)
-	}
-	defer database.Close()
-
+// UpdateDeals saves the status reported by the provider of every deal that
+// is not proving yet, waiting delay before each query
+func UpdateDeals(ctx context.Context, database *db.Database, backend market.DealBackend, delay time.Duration) error {
 	deals, err := database.GetDealsForUpdate()
 	if err != nil {
 		return fmt.Errorf("failed to get imported deals: %w", err)
@@ -138,26 +96,16 @@ func updateDeals(cfg *config.Config, boostPath string, delay int) error {
 
 	for i, deal := range deals {
 		// 添加延迟，防止API请求过快
-		time.Sleep(time.Duration(delay) * time.Second)
+		time.Sleep(delay)
 
-		// Query deal status using boost CLI
 		log.Printf("[%d/%d] Checking deal %s status", i+1, len(deals), deal.UUID)
-		cmd := fmt.Sprintf("%s deal-status --provider=%s --deal-uuid=%s --wallet=%s", boostPath, deal.StorageProvider, deal.UUID, deal.ClientWallet)
-		output, err := util.ExecCmd("", cmd)
+		status, err := backend.Status(ctx, deal)
 		if err != nil {
 			log.Printf("[%d/%d] Error querying deal status for %s: %v", i+1, len(deals), deal.UUID, err)
 			failureCount++
 			continue
 		}
 
-		// Map boost status to our status
-		status, err := parseDealStatus(output)
-		if err != nil {
-			log.Printf("[%d/%d] Error parsing deal status for %s: %v", i+1, len(deals), deal.UUID, err)
-			failureCount++
-			continue
-		}
-
 		log.Printf("[%d/%d] Deal %s status is %s", i+1, len(deals), deal.UUID, status.Status)
 
 		// Update deal status in database
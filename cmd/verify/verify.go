@@ -0,0 +1,246 @@
+package verify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/minerdao/lotus-car/config"
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/util"
+	"github.com/urfave/cli/v2"
+)
+
+func Command() *cli.Command {
+	return &cli.Command{
+		Name:  "verify",
+		Usage: "Verify car files on disk against their records in the database",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "id",
+				Usage: "UUID of the car file to verify",
+			},
+			&cli.StringFlag{
+				Name:  "file",
+				Usage: "Path of a car file to verify, named <commp>.car",
+			},
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "Verify every car file in this directory, and report car files recorded there that are missing",
+			},
+			&cli.BoolFlag{
+				Name:  "deep",
+				Usage: "Also check that every block hashes to its CID and that no block of the DAG is missing",
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of car files verified in parallel",
+				Value: 4,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			id := c.String("id")
+			file := c.String("file")
+			dir := c.String("dir")
+			set := 0
+			for _, v := range []string{id, file, dir} {
+				if v != "" {
+					set++
+				}
+			}
+			if set != 1 {
+				return fmt.Errorf("exactly one of --id, --file or --dir is required")
+			}
+			parallel := c.Int("parallel")
+			if parallel < 1 {
+				parallel = 1
+			}
+
+			cfg, err := config.LoadConfig(c.String("config"))
+			if err != nil {
+				return fmt.Errorf("failed to load config: %v", err)
+			}
+
+			database, err := db.InitFromConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to initialize database: %v", err)
+			}
+			defer database.Close()
+
+			var targets []target
+			switch {
+			case id != "":
+				f, err := database.GetFile(id)
+				if err != nil {
+					return fmt.Errorf("failed to get file: %v", err)
+				}
+				if f == nil {
+					return fmt.Errorf("car file %s not found", id)
+				}
+				targets = append(targets, target{path: f.FilePath, record: f})
+			case file != "":
+				t, err := lookupTarget(database, file)
+				if err != nil {
+					return err
+				}
+				targets = append(targets, t)
+			default:
+				targets, err = dirTargets(database, dir)
+				if err != nil {
+					return err
+				}
+			}
+
+			return verifyTargets(targets, parallel, c.Bool("deep"))
+		},
+	}
+}
+
+// target is a car file to verify, record is nil when the database does not
+// know the file
+type target struct {
+	path   string
+	record *db.CarFile
+}
+
+// lookupTarget finds the record of a car file by its name, which is the
+// CommP of the car file
+func lookupTarget(database *db.Database, path string) (target, error) {
+	commp := strings.TrimSuffix(filepath.Base(path), ".car")
+	f, err := database.GetFileByCommP(commp)
+	if err != nil {
+		return target{}, err
+	}
+	return target{path: path, record: f}, nil
+}
+
+// dirTargets returns every car file in dir, together with the car files
+// recorded in dir that are no longer there
+func dirTargets(database *db.Database, dir string) ([]target, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []target
+	onDisk := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".car" {
+			continue
+		}
+		p := filepath.Join(absDir, e.Name())
+		t, err := lookupTarget(database, p)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+		onDisk[p] = true
+	}
+
+	recorded, err := database.ListFilesInDir(absDir)
+	if err != nil {
+		return nil, err
+	}
+	for i := range recorded {
+		if !onDisk[recorded[i].FilePath] {
+			targets = append(targets, target{path: recorded[i].FilePath, record: &recorded[i]})
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].path < targets[j].path
+	})
+	return targets, nil
+}
+
+// verifyTargets verifies the car files with parallel workers and returns an
+// error when any of them failed
+func verifyTargets(targets []target, parallel int, deep bool) error {
+	if len(targets) == 0 {
+		fmt.Println("No car files to verify")
+		return nil
+	}
+	if parallel > len(targets) {
+		parallel = len(targets)
+	}
+	fmt.Printf("Verifying %d car files with %d workers\n", len(targets), parallel)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				problems := verifyTarget(targets[i], deep)
+				mu.Lock()
+				if len(problems) == 0 {
+					fmt.Printf("[%d/%d] OK %s\n", i+1, len(targets), targets[i].path)
+				} else {
+					fmt.Printf("[%d/%d] FAILED %s: %s\n", i+1, len(targets), targets[i].path, strings.Join(problems, "; "))
+					failed = append(failed, targets[i].path)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		fmt.Printf("%d of %d car files failed verification:\n", len(failed), len(targets))
+		for _, p := range failed {
+			fmt.Printf("  %s\n", p)
+		}
+		return fmt.Errorf("%d of %d car files failed verification", len(failed), len(targets))
+	}
+	fmt.Printf("All %d car files verified\n", len(targets))
+	return nil
+}
+
+// verifyTarget returns the problems found with one car file. The deep check
+// reads every block, it runs even when the record does not match so all
+// damage is reported at once.
+func verifyTarget(t target, deep bool) []string {
+	if _, err := os.Stat(t.path); os.IsNotExist(err) {
+		return []string{"missing"}
+	}
+	var problems []string
+	if deep {
+		res, err := util.VerifyCarDAG(t.path)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		problems = append(problems, res.Problems...)
+	}
+	if t.record == nil {
+		return append(problems, "no record in the database")
+	}
+
+	res, err := util.VerifyCarFile(t.path, util.CarExpect{
+		CommP:     t.record.CommP,
+		DataCid:   t.record.DataCid,
+		PieceSize: t.record.PieceSize,
+		CarSize:   t.record.CarSize,
+	})
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if t.record.CarVersion != 0 && res.Version != t.record.CarVersion {
+		res.Problems = append(res.Problems, fmt.Sprintf("car version %d, expected %d", res.Version, t.record.CarVersion))
+	}
+	return append(problems, res.Problems...)
+}
@@ -23,15 +23,26 @@ type Config struct {
 	} `yaml:"server"`
 
 	Deal struct {
-		LotusPath string `yaml:"lotus_path"`
-		BoostPath string `yaml:"boost_path"`
-		DealDelay int    `yaml:"deal_delay"` // 发单间隔时间（毫秒）
+		LotusPath          string `yaml:"lotus_path"`
+		BoostPath          string `yaml:"boost_path"`
+		MaxConcurrent      int    `yaml:"max_concurrent"`        // 所有 deal 进程同时发送中的订单数上限，0 为不限
+		WalletDealsPerHour int    `yaml:"wallet_deals_per_hour"` // 每个钱包每小时的订单数上限，0 为不限
+		WalletBytesPerDay  int64  `yaml:"wallet_bytes_per_day"`  // 每个钱包 24 小时内的 piece 字节数上限，0 为不限
 	} `yaml:"deal"`
 
 	Auth struct {
 		JWTSecret        string `yaml:"jwt_secret"`
 		TokenExpireHours int    `yaml:"token_expire_hours"`
 	} `yaml:"auth"`
+
+	Unixfs struct {
+		ChunkSize     uint64 `yaml:"chunk_size"`     // 叶子块大小（字节）
+		MaxLinks      int    `yaml:"max_links"`      // 每层最大链接数
+		RawLeaves     bool   `yaml:"raw_leaves"`     // 叶子节点使用 raw 编码
+		CidVersion    int    `yaml:"cid_version"`    // CID 版本，0 或 1
+		Layout        string `yaml:"layout"`         // balanced 或 trickle
+		HamtThreshold int    `yaml:"hamt_threshold"` // 目录条目数超过该值时使用 HAMT 分片，0 为 go-unixfs 默认行为
+	} `yaml:"unixfs"`
 }
 
 // DefaultConfig returns a configuration with default values
@@ -58,13 +69,14 @@ func DefaultConfig() *Config {
 			Address: ":8080",
 		},
 		Deal: struct {
-			LotusPath string `yaml:"lotus_path"`
-			BoostPath string `yaml:"boost_path"`
-			DealDelay int    `yaml:"deal_delay"` // 发单间隔时间（毫秒）
+			LotusPath          string `yaml:"lotus_path"`
+			BoostPath          string `yaml:"boost_path"`
+			MaxConcurrent      int    `yaml:"max_concurrent"`        // 所有 deal 进程同时发送中的订单数上限，0 为不限
+			WalletDealsPerHour int    `yaml:"wallet_deals_per_hour"` // 每个钱包每小时的订单数上限，0 为不限
+			WalletBytesPerDay  int64  `yaml:"wallet_bytes_per_day"`  // 每个钱包 24 小时内的 piece 字节数上限，0 为不限
 		}{
 			LotusPath: "",
 			BoostPath: "",
-			DealDelay: 0,
 		},
 		Auth: struct {
 			JWTSecret        string `yaml:"jwt_secret"`
@@ -73,6 +85,20 @@ func DefaultConfig() *Config {
 			JWTSecret:        "secret",
 			TokenExpireHours: 2,
 		},
+		Unixfs: struct {
+			ChunkSize     uint64 `yaml:"chunk_size"`     // 叶子块大小（字节）
+			MaxLinks      int    `yaml:"max_links"`      // 每层最大链接数
+			RawLeaves     bool   `yaml:"raw_leaves"`     // 叶子节点使用 raw 编码
+			CidVersion    int    `yaml:"cid_version"`    // CID 版本，0 或 1
+			Layout        string `yaml:"layout"`         // balanced 或 trickle
+			HamtThreshold int    `yaml:"hamt_threshold"` // 目录条目数超过该值时使用 HAMT 分片，0 为 go-unixfs 默认行为
+		}{
+			ChunkSize:  1 << 20,
+			MaxLinks:   1024,
+			RawLeaves:  true,
+			CidVersion: 1,
+			Layout:     "balanced",
+		},
 	}
 }
 
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Dataset groups the source files indexed from one source directory together
+// with the settings used to pack and deal them
+type Dataset struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	SourceDir      string    `json:"source_dir"`      // 索引时的源目录，source_files 中的路径相对于该目录
+	Client         string    `json:"client"`          // 发单使用的客户钱包地址
+	TargetReplicas int       `json:"target_replicas"` // 每个 piece 的目标副本数
+	UnixfsParams   string    `json:"unixfs_params"`   // JSON string of util.UnixfsParams, empty means the config defaults
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// DatasetStats reports the progress of a dataset. Indexed and packed bytes
+// count source data, dealt and proven bytes count the piece size of car files
+// with a deal sent and a deal proving.
+type DatasetStats struct {
+	DatasetID    string `json:"dataset_id"`
+	Name         string `json:"name"`
+	FilesIndexed int64  `json:"files_indexed"`
+	BytesIndexed int64  `json:"bytes_indexed"`
+	FilesPacked  int64  `json:"files_packed"`
+	BytesPacked  int64  `json:"bytes_packed"`
+	CarFiles     int64  `json:"car_files"`
+	BytesDealt   int64  `json:"bytes_dealt"`
+	BytesProven  int64  `json:"bytes_proven"`
+}
+
+// datasetColumns lists the datasets columns in the order read by scanDataset
+const datasetColumns = `id, name, source_dir, client, target_replicas, unixfs_params, created_at, updated_at`
+
+// scanDataset reads a datasets row selected with datasetColumns
+func scanDataset(row rowScanner) (Dataset, error) {
+	var ds Dataset
+	err := row.Scan(
+		&ds.ID,
+		&ds.Name,
+		&ds.SourceDir,
+		&ds.Client,
+		&ds.TargetReplicas,
+		&ds.UnixfsParams,
+		&ds.CreatedAt,
+		&ds.UpdatedAt,
+	)
+	return ds, err
+}
+
+// CreateDataset inserts a new dataset, the name must not be taken
+func (d *Database) CreateDataset(ds *Dataset) error {
+	if ds.ID == "" {
+		u, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		ds.ID = u.String()
+	}
+	if ds.TargetReplicas == 0 {
+		ds.TargetReplicas = 1
+	}
+
+	err := d.db.QueryRow(`
+		INSERT INTO datasets (id, name, source_dir, client, target_replicas, unixfs_params)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, updated_at`,
+		ds.ID, ds.Name, ds.SourceDir, ds.Client, ds.TargetReplicas, ds.UnixfsParams,
+	).Scan(&ds.CreatedAt, &ds.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert dataset: %v", err)
+	}
+	return nil
+}
+
+// GetOrCreateDataset returns the dataset with the given name, creating it
+// with default settings when it does not exist yet
+func (d *Database) GetOrCreateDataset(name, sourceDir string) (*Dataset, error) {
+	ds, err := d.GetDatasetByName(name)
+	if err != nil || ds != nil {
+		return ds, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	// Another indexer may have created it in the meantime, the name is unique
+	_, err = d.db.Exec(`
+		INSERT INTO datasets (id, name, source_dir)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO NOTHING
+	`, id.String(), name, sourceDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert dataset: %v", err)
+	}
+	return d.GetDatasetByName(name)
+}
+
+// GetDatasetByName returns nil when no dataset has the given name
+func (d *Database) GetDatasetByName(name string) (*Dataset, error) {
+	ds, err := scanDataset(d.db.QueryRow(`
+		SELECT `+datasetColumns+`
+		FROM datasets
+		WHERE name = $1
+	`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dataset: %v", err)
+	}
+	return &ds, nil
+}
+
+// ListDatasets returns every dataset ordered by name
+func (d *Database) ListDatasets() ([]Dataset, error) {
+	rows, err := d.db.Query(`
+		SELECT ` + datasetColumns + `
+		FROM datasets
+		ORDER BY name ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query datasets: %v", err)
+	}
+	defer rows.Close()
+
+	var datasets []Dataset
+	for rows.Next() {
+		ds, err := scanDataset(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dataset: %v", err)
+		}
+		datasets = append(datasets, ds)
+	}
+	return datasets, rows.Err()
+}
+
+// GetDatasetStats returns the progress of every dataset, or of one dataset
+// when datasetID is not empty
+func (d *Database) GetDatasetStats(datasetID string) ([]DatasetStats, error) {
+	// 已发单按文件是否有有效订单统计，已证明按 boost 返回的 Proving 状态统计
+	rows, err := d.db.Query(`
+		SELECT ds.id, ds.name,
+			COALESCE(sf.files_indexed, 0), COALESCE(sf.bytes_indexed, 0),
+			COALESCE(sf.files_packed, 0), COALESCE(sf.bytes_packed, 0),
+			COALESCE(f.car_files, 0), COALESCE(f.bytes_dealt, 0), COALESCE(f.bytes_proven, 0)
+		FROM datasets ds
+		LEFT JOIN (
+			SELECT dataset_id,
+				COUNT(*) AS files_indexed,
+				SUM(size) AS bytes_indexed,
+				COUNT(*) FILTER (WHERE status = $2) AS files_packed,
+				SUM(size) FILTER (WHERE status = $2) AS bytes_packed
+			FROM source_files
+			GROUP BY dataset_id
+		) sf ON sf.dataset_id = ds.id
+		LEFT JOIN (
+			SELECT files.dataset_id,
+				COUNT(*) AS car_files,
+				SUM(files.piece_size) FILTER (WHERE EXISTS (
+					SELECT 1 FROM deals WHERE (deals.file_id = files.id OR (deals.file_id IS NULL AND deals.commp = files.comm_p))
+					AND `+activeDeal("deals")+`
+				)) AS bytes_dealt,
+				SUM(files.piece_size) FILTER (WHERE EXISTS (
+					SELECT 1 FROM deals WHERE (deals.file_id = files.id OR (deals.file_id IS NULL AND deals.commp = files.comm_p))
+					AND deals.status LIKE '%Proving%'
+				)) AS bytes_proven
+			FROM files
+			WHERE files.dataset_id IS NOT NULL
+			GROUP BY files.dataset_id
+		) f ON f.dataset_id = ds.id
+		WHERE $1 = '' OR ds.id = $1
+		ORDER BY ds.name ASC
+	`, datasetID, SourceFileStatusPacked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dataset stats: %v", err)
+	}
+	defer rows.Close()
+
+	var stats []DatasetStats
+	for rows.Next() {
+		var s DatasetStats
+		err := rows.Scan(
+			&s.DatasetID,
+			&s.Name,
+			&s.FilesIndexed,
+			&s.BytesIndexed,
+			&s.FilesPacked,
+			&s.BytesPacked,
+			&s.CarFiles,
+			&s.BytesDealt,
+			&s.BytesProven,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dataset stats: %v", err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,281 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AttemptStatus 表示一次发单尝试的状态
+type AttemptStatus string
+
+const (
+	AttemptSending  AttemptStatus = "sending"  // 已预留，正在发送
+	AttemptAccepted AttemptStatus = "accepted" // 存储提供者接受了订单
+	AttemptRejected AttemptStatus = "rejected" // 存储提供者拒绝了订单
+)
+
+// dealReservationLock is the advisory lock serialising reservations of all
+// deal processes sharing the database
+const dealReservationLock = 0x6c6f7475735f6361
+
+// AttemptExpiry is how long an attempt counts while it is being sent. An
+// attempt left sending longer belongs to a deal process that died, so deal
+// processes must give up on a proposal before it expires.
+const AttemptExpiry = 10 * time.Minute
+
+// pendingAttempt matches the attempts being sent
+var pendingAttempt = fmt.Sprintf(`status = 'sending' AND created_at >= CURRENT_TIMESTAMP - INTERVAL '%d seconds'`, int(AttemptExpiry/time.Second))
+
+// unsavedAttempt matches the attempts of a deal_attempts alias a accepted by
+// their provider whose deal could not be saved
+const unsavedAttempt = `(a.status = 'accepted' AND NOT EXISTS (SELECT 1 FROM deals WHERE deals.uuid = a.deal_uuid))`
+
+// RateLimits are the limits shared by every deal process, 0 means no limit.
+// The limits of each storage provider are read from the providers table.
+type RateLimits struct {
+	MaxConcurrent      int   // deals being sent at once
+	WalletDealsPerHour int   // deals sent from one wallet in an hour
+	WalletBytesPerDay  int64 // piece bytes sent from one wallet in 24 hours
+}
+
+// LimitScope tells what a LimitError applies to
+type LimitScope string
+
+const (
+	LimitPiece       LimitScope = "piece"       // the provider holds the piece or is being sent it
+	LimitReplicas    LimitScope = "replicas"    // the piece has all its replicas
+	LimitProvider    LimitScope = "provider"    // the provider may not take more deals now
+	LimitWallet      LimitScope = "wallet"      // the wallet may not send more deals now
+	LimitConcurrency LimitScope = "concurrency" // too many deals are being sent
+)
+
+// LimitError is returned by ReserveDeal when a deal would break a limit
+type LimitError struct {
+	Scope  LimitScope
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit: %s", e.Scope, e.Reason)
+}
+
+// DealReservation is a deal about to be proposed
+type DealReservation struct {
+	Provider  string
+	Wallet    string
+	PieceCid  string
+	PieceSize int64
+	Replicas  int // target replicas of the piece
+}
+
+// ReserveDeal checks a deal against the rate limits and the limits of its
+// provider and records it as being sent. The checks and the record are done
+// under a lock held by one deal process at a time, so concurrent processes
+// neither send a piece twice to a provider nor overshoot a limit together.
+// A *LimitError is returned when the deal may not be sent now. The returned
+// attempt ID must be passed to CompleteDealAttempt or RejectDealAttempt once
+// the provider answered.
+func (d *Database) ReserveDeal(r DealReservation, limits RateLimits) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, dealReservationLock); err != nil {
+		return 0, fmt.Errorf("failed to lock deal reservations: %v", err)
+	}
+
+	if limits.MaxConcurrent > 0 {
+		var sending int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM deal_attempts WHERE ` + pendingAttempt).Scan(&sending); err != nil {
+			return 0, fmt.Errorf("failed to count deals being sent: %v", err)
+		}
+		if sending >= limits.MaxConcurrent {
+			return 0, &LimitError{LimitConcurrency, fmt.Sprintf("%d deals are being sent, the limit is %d", sending, limits.MaxConcurrent)}
+		}
+	}
+
+	// Providers holding the piece or being sent it
+	rows, err := tx.Query(`
+		SELECT storage_provider FROM deals d
+		WHERE d.commp = $1 AND `+activeDeal("d")+`
+		UNION
+		SELECT provider FROM deal_attempts a
+		WHERE piece_cid = $1 AND (`+pendingAttempt+` OR `+unsavedAttempt+`)
+	`, r.PieceCid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query providers of piece: %v", err)
+	}
+	holders := 0
+	for rows.Next() {
+		var provider string
+		if err := rows.Scan(&provider); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan provider of piece: %v", err)
+		}
+		if provider == r.Provider {
+			rows.Close()
+			return 0, &LimitError{LimitPiece, fmt.Sprintf("%s already holds or is being sent piece %s", r.Provider, r.PieceCid)}
+		}
+		holders++
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if r.Replicas > 0 && holders >= r.Replicas {
+		return 0, &LimitError{LimitReplicas, fmt.Sprintf("piece %s has %d of %d replicas", r.PieceCid, holders, r.Replicas)}
+	}
+
+	p, err := scanProvider(tx.QueryRow(`SELECT `+providerColumns+` FROM providers WHERE miner_id = $1`, r.Provider))
+	if err == sql.ErrNoRows {
+		return 0, &LimitError{LimitProvider, fmt.Sprintf("%s is not registered", r.Provider)}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get provider: %v", err)
+	}
+	if p.State != ProviderStateEnabled {
+		return 0, &LimitError{LimitProvider, fmt.Sprintf("%s is %s", r.Provider, p.State)}
+	}
+	if !p.AllowsWallet(r.Wallet) {
+		return 0, &LimitError{LimitProvider, fmt.Sprintf("%s does not accept wallet %s", r.Provider, r.Wallet)}
+	}
+
+	u, err := attemptUsage(tx, "provider", r.Provider)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case p.MaxDealsPerHour > 0 && u.hourDeals >= p.MaxDealsPerHour:
+		return 0, &LimitError{LimitProvider, fmt.Sprintf("%s took %d deals in the last hour, the limit is %d", r.Provider, u.hourDeals, p.MaxDealsPerHour)}
+	case p.MaxDealsPerDay > 0 && u.dayDeals >= p.MaxDealsPerDay:
+		return 0, &LimitError{LimitProvider, fmt.Sprintf("%s took %d deals in the last day, the limit is %d", r.Provider, u.dayDeals, p.MaxDealsPerDay)}
+	case p.MaxBytesPerDay > 0 && u.dayBytes+r.PieceSize > p.MaxBytesPerDay:
+		return 0, &LimitError{LimitProvider, fmt.Sprintf("%s took %d bytes in the last day, the limit is %d", r.Provider, u.dayBytes, p.MaxBytesPerDay)}
+	}
+	if p.MaxBytesInFlight > 0 {
+		var inFlight int64
+		err := tx.QueryRow(`
+			SELECT
+				COALESCE((SELECT SUM((SELECT f.piece_size FROM files f WHERE f.comm_p = d.commp LIMIT 1))
+					FROM deals d WHERE d.storage_provider = $1 AND `+inFlightDeal("d")+`), 0)
+				+ COALESCE((SELECT SUM(piece_size) FROM deal_attempts WHERE provider = $1 AND `+pendingAttempt+`), 0)
+		`, r.Provider).Scan(&inFlight)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get bytes in flight: %v", err)
+		}
+		if inFlight+r.PieceSize > p.MaxBytesInFlight {
+			return 0, &LimitError{LimitProvider, fmt.Sprintf("%s has %d bytes in flight, the limit is %d", r.Provider, inFlight, p.MaxBytesInFlight)}
+		}
+	}
+
+	if limits.WalletDealsPerHour > 0 || limits.WalletBytesPerDay > 0 {
+		u, err := attemptUsage(tx, "wallet", r.Wallet)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case limits.WalletDealsPerHour > 0 && u.hourDeals >= limits.WalletDealsPerHour:
+			return 0, &LimitError{LimitWallet, fmt.Sprintf("%s sent %d deals in the last hour, the limit is %d", r.Wallet, u.hourDeals, limits.WalletDealsPerHour)}
+		case limits.WalletBytesPerDay > 0 && u.dayBytes+r.PieceSize > limits.WalletBytesPerDay:
+			return 0, &LimitError{LimitWallet, fmt.Sprintf("%s sent %d bytes in the last day, the limit is %d", r.Wallet, u.dayBytes, limits.WalletBytesPerDay)}
+		}
+	}
+
+	var id int64
+	err = tx.QueryRow(`
+		INSERT INTO deal_attempts (provider, wallet, piece_cid, piece_size, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, r.Provider, r.Wallet, r.PieceCid, r.PieceSize, AttemptSending).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve deal: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return id, nil
+}
+
+// attemptStats counts the deals being sent or accepted for a provider or a
+// wallet
+type attemptStats struct {
+	hourDeals int
+	dayDeals  int
+	dayBytes  int64
+}
+
+// attemptUsage returns the attempt stats of the last day for a value of
+// column, which is provider or wallet
+func attemptUsage(tx *sql.Tx, column, value string) (attemptStats, error) {
+	var s attemptStats
+	err := tx.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE created_at >= CURRENT_TIMESTAMP - INTERVAL '1 hour'),
+			COUNT(*),
+			COALESCE(SUM(piece_size), 0)
+		FROM deal_attempts
+		WHERE `+column+` = $1
+		AND created_at >= CURRENT_TIMESTAMP - INTERVAL '1 day'
+		AND (status = $2 OR (`+pendingAttempt+`))
+	`, value, AttemptAccepted).Scan(&s.hourDeals, &s.dayDeals, &s.dayBytes)
+	if err != nil {
+		return s, fmt.Errorf("failed to count deals of %s %s: %v", column, value, err)
+	}
+	return s, nil
+}
+
+// CompleteDealAttempt saves a deal accepted by its provider and marks the
+// attempt it was reserved with accepted, in one transaction
+func (d *Database) CompleteDealAttempt(id int64, deal *Deal) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertDeal(tx, deal); err != nil {
+		return fmt.Errorf("failed to insert deal: %v", err)
+	}
+	_, err = tx.Exec(`
+		UPDATE deal_attempts
+		SET status = $1, deal_uuid = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, AttemptAccepted, deal.UUID, id)
+	if err != nil {
+		return fmt.Errorf("failed to update deal attempt: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// AcceptDealAttempt marks an attempt accepted by its provider when its deal
+// could not be saved, so the piece is not proposed to the provider again
+func (d *Database) AcceptDealAttempt(id int64, dealUUID string) error {
+	_, err := d.db.Exec(`
+		UPDATE deal_attempts
+		SET status = $1, deal_uuid = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, AttemptAccepted, dealUUID, id)
+	if err != nil {
+		return fmt.Errorf("failed to update deal attempt: %v", err)
+	}
+	return nil
+}
+
+// RejectDealAttempt marks an attempt rejected by its provider, which frees
+// its reservation
+func (d *Database) RejectDealAttempt(id int64, dealErr string) error {
+	_, err := d.db.Exec(`
+		UPDATE deal_attempts
+		SET status = $1, error = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, AttemptRejected, dealErr, id)
+	if err != nil {
+		return fmt.Errorf("failed to update deal attempt: %v", err)
+	}
+	return nil
+}
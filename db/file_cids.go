@@ -0,0 +1,101 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// FileCid is one node of the UnixFS tree stored in a car file. The root
+// directory has an empty path, the tree can be rebuilt from the paths.
+type FileCid struct {
+	FileID string `json:"file_id"`
+	Path   string `json:"path"`
+	Cid    string `json:"cid"`
+	IsDir  bool   `json:"is_dir"`
+	Size   uint64 `json:"size"`
+}
+
+// SaveFileCids replaces the UnixFS tree saved for a car file
+func (d *Database) SaveFileCids(fileID string, cids []FileCid) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM file_cids WHERE file_id = $1`, fileID); err != nil {
+		return fmt.Errorf("failed to delete file cids: %v", err)
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("file_cids", "file_id", "path", "cid", "is_dir", "size"))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy: %v", err)
+	}
+	for _, c := range cids {
+		if _, err := stmt.Exec(fileID, c.Path, c.Cid, c.IsDir, c.Size); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy file cid %s: %v", c.Path, err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to flush file cids: %v", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to close copy: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// ListFileCids returns the UnixFS tree of a car file ordered by path
+func (d *Database) ListFileCids(fileID string) ([]FileCid, error) {
+	rows, err := d.db.Query(`
+		SELECT file_id, path, cid, is_dir, size
+		FROM file_cids
+		WHERE file_id = $1
+		ORDER BY path ASC
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file cids: %v", err)
+	}
+	defer rows.Close()
+
+	return scanFileCids(rows)
+}
+
+// GetFileCidsByPath returns every car file node stored under the given path
+func (d *Database) GetFileCidsByPath(path string) ([]FileCid, error) {
+	rows, err := d.db.Query(`
+		SELECT file_id, path, cid, is_dir, size
+		FROM file_cids
+		WHERE path = $1
+		ORDER BY file_id ASC
+	`, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file cids: %v", err)
+	}
+	defer rows.Close()
+
+	return scanFileCids(rows)
+}
+
+func scanFileCids(rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}) ([]FileCid, error) {
+	var cids []FileCid
+	for rows.Next() {
+		var c FileCid
+		if err := rows.Scan(&c.FileID, &c.Path, &c.Cid, &c.IsDir, &c.Size); err != nil {
+			return nil, fmt.Errorf("failed to scan file cid: %v", err)
+		}
+		cids = append(cids, c)
+	}
+	return cids, rows.Err()
+}
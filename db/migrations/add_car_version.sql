@@ -0,0 +1,5 @@
+-- Add car_version column to files table, existing car files are CARv1
+ALTER TABLE files ADD COLUMN IF NOT EXISTS car_version INTEGER NOT NULL DEFAULT 1;
+
+-- Add check constraint for car_version values
+ALTER TABLE files ADD CONSTRAINT check_car_version CHECK (car_version IN (1, 2));
@@ -0,0 +1,15 @@
+-- Add dataset settings and link files to the dataset they were packed from.
+-- Files generated without --dataset keep a NULL dataset_id.
+CREATE TABLE IF NOT EXISTS datasets (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    source_dir TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE datasets ADD COLUMN IF NOT EXISTS client TEXT NOT NULL DEFAULT '';
+ALTER TABLE datasets ADD COLUMN IF NOT EXISTS target_replicas INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE datasets ADD COLUMN IF NOT EXISTS unixfs_params TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS dataset_id TEXT REFERENCES datasets(id);
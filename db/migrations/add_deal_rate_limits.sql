@@ -0,0 +1,17 @@
+-- Reserve every deal in deal_attempts before it is proposed, so concurrent
+-- deal processes share rate limits, and add hourly and daily provider limits.
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS max_deals_per_hour INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS max_bytes_per_day BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE deal_attempts ADD COLUMN IF NOT EXISTS wallet TEXT NOT NULL DEFAULT '';
+ALTER TABLE deal_attempts ADD COLUMN IF NOT EXISTS piece_cid TEXT NOT NULL DEFAULT '';
+ALTER TABLE deal_attempts ADD COLUMN IF NOT EXISTS piece_size BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE deal_attempts ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'sending';
+ALTER TABLE deal_attempts ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;
+
+-- Attempts recorded before were all finished
+UPDATE deal_attempts SET status = 'accepted' WHERE status = 'sending' AND deal_uuid IS NOT NULL;
+UPDATE deal_attempts SET status = 'rejected' WHERE status = 'sending';
+
+CREATE INDEX IF NOT EXISTS idx_deal_attempts_wallet ON deal_attempts (wallet, created_at);
+CREATE INDEX IF NOT EXISTS idx_deal_attempts_piece ON deal_attempts (piece_cid, provider);
@@ -0,0 +1,33 @@
+-- Link deals to the car file they were sent for, a file holds one deal per
+-- replica. Deals sent before keep a NULL file_id and are matched by commp.
+ALTER TABLE deals ADD COLUMN IF NOT EXISTS file_id TEXT;
+
+-- The deal a file kept in files.deal_id is linked first, then the deals
+-- matching the file's commp
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1
+        FROM information_schema.columns
+        WHERE table_name = 'files'
+        AND column_name = 'deal_id'
+    ) THEN
+        UPDATE deals d SET file_id = f.id
+        FROM files f
+        WHERE d.file_id IS NULL AND f.deal_id = d.uuid;
+    END IF;
+END $$;
+
+UPDATE deals d SET file_id = f.id
+FROM files f
+WHERE d.file_id IS NULL AND f.comm_p = d.commp;
+
+-- Every deal is linked now, files no longer keep the last deal sent
+ALTER TABLE files DROP COLUMN IF EXISTS deal_id;
+
+CREATE INDEX IF NOT EXISTS idx_deals_commp ON deals (commp, storage_provider);
+
+-- A file without a deal error has an empty one
+UPDATE files SET deal_error = '' WHERE deal_error IS NULL;
+ALTER TABLE files ALTER COLUMN deal_error SET DEFAULT '';
+ALTER TABLE files ALTER COLUMN deal_error SET NOT NULL;
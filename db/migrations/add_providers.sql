@@ -0,0 +1,25 @@
+-- Register storage providers with the limits deal respects, and record every
+-- proposal so the recent failure rate of a provider can be computed.
+CREATE TABLE IF NOT EXISTS providers (
+    miner_id TEXT PRIMARY KEY,
+    label TEXT NOT NULL DEFAULT '',
+    max_deals_per_day INTEGER NOT NULL DEFAULT 0,
+    max_bytes_in_flight BIGINT NOT NULL DEFAULT 0,
+    allowed_wallets TEXT[] NOT NULL DEFAULT '{}',
+    storage_price BIGINT NOT NULL DEFAULT 0,
+    verified BOOLEAN NOT NULL DEFAULT TRUE,
+    state TEXT NOT NULL DEFAULT 'enabled',
+    max_failure_rate REAL NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS deal_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    provider TEXT NOT NULL,
+    deal_uuid UUID,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_deal_attempts_provider ON deal_attempts (provider, created_at);
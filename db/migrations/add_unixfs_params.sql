@@ -0,0 +1,3 @@
+-- Add unixfs_params column to files table, an empty value means the car file
+-- was built with the default UnixFS params (1MiB chunks, 1024 links, raw leaves, CIDv1, balanced)
+ALTER TABLE files ADD COLUMN IF NOT EXISTS unixfs_params TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// insertPackedSlices records the raw files of a car file by relative path, so
+// that generate finds the packed parts of a source file without reading the
+// raw files of every car file
+func insertPackedSlices(tx *sql.Tx, fileID, rawFiles string) error {
+	if rawFiles == "" {
+		return nil
+	}
+	var infos []RawFileInfo
+	if err := json.Unmarshal([]byte(rawFiles), &infos); err != nil {
+		return fmt.Errorf("failed to unmarshal raw files: %v", err)
+	}
+	if len(infos) == 0 {
+		return nil
+	}
+	paths := make([]string, len(infos))
+	sizes := make([]int64, len(infos))
+	starts := make([]int64, len(infos))
+	ends := make([]int64, len(infos))
+	for i, info := range infos {
+		paths[i], sizes[i], starts[i], ends[i] = info.RelativePath, info.Size, info.Start, info.End
+	}
+	_, err := tx.Exec(`
+		INSERT INTO packed_slices (file_id, path, size, start_offset, end_offset)
+		SELECT $1::TEXT, * FROM unnest($2::TEXT[], $3::BIGINT[], $4::BIGINT[], $5::BIGINT[])
+		ON CONFLICT DO NOTHING
+	`, fileID, pq.Array(paths), pq.Array(sizes), pq.Array(starts), pq.Array(ends))
+	if err != nil {
+		return fmt.Errorf("failed to save packed slices: %v", err)
+	}
+	return nil
+}
+
+// GetPackedSlices 返回给定相对路径已打包进 car 文件的原始文件及切片，按相对路径分组
+func (d *Database) GetPackedSlices(paths []string) (map[string][]RawFileInfo, error) {
+	packed := make(map[string][]RawFileInfo)
+	if len(paths) == 0 {
+		return packed, nil
+	}
+	rows, err := d.db.Query(`
+		SELECT path, size, start_offset, end_offset
+		FROM packed_slices
+		WHERE path = ANY($1)
+	`, pq.Array(paths))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query packed slices: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var info RawFileInfo
+		if err := rows.Scan(&info.RelativePath, &info.Size, &info.Start, &info.End); err != nil {
+			return nil, fmt.Errorf("failed to scan packed slice: %v", err)
+		}
+		packed[info.RelativePath] = append(packed[info.RelativePath], info)
+	}
+	return packed, rows.Err()
+}
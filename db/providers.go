@@ -0,0 +1,255 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ProviderState 表示存储提供者是否接收新订单
+type ProviderState string
+
+const (
+	ProviderStateEnabled ProviderState = "enabled" // 接收新订单
+	ProviderStatePaused  ProviderState = "paused"  // 暂停发单，已有订单照常跟踪
+)
+
+// Provider is a storage provider deals are sent to, with the limits deal
+// respects when sending it deals. A limit of 0 means no limit.
+type Provider struct {
+	MinerID          string        `json:"miner_id"`
+	Label            string        `json:"label"`
+	MaxDealsPerDay   int           `json:"max_deals_per_day"`   // 24 小时内最多接收的订单数
+	MaxDealsPerHour  int           `json:"max_deals_per_hour"`  // 1 小时内最多接收的订单数
+	MaxBytesPerDay   int64         `json:"max_bytes_per_day"`   // 24 小时内最多接收的 piece 字节数
+	MaxBytesInFlight int64         `json:"max_bytes_in_flight"` // 已发单但未封装完成的 piece 字节数上限
+	AllowedWallets   []string      `json:"allowed_wallets"`     // 允许发单的客户钱包，为空时不限制
+	StoragePrice     int64         `json:"storage_price"`       // attoFIL per GiB per epoch
+	Verified         bool          `json:"verified"`            // 是否发送 Fil+ 订单
+	State            ProviderState `json:"state"`
+	MaxFailureRate   float64       `json:"max_failure_rate"` // 近期失败率超过该值时不再发单
+	CreatedAt        time.Time     `json:"created_at"`
+	UpdatedAt        time.Time     `json:"updated_at"`
+}
+
+// AllowsWallet reports whether deals may be sent to the provider from wallet
+func (p *Provider) AllowsWallet(wallet string) bool {
+	if len(p.AllowedWallets) == 0 {
+		return true
+	}
+	for _, w := range p.AllowedWallets {
+		if w == wallet {
+			return true
+		}
+	}
+	return false
+}
+
+// ProviderUsage is the recent activity of a storage provider. Attempts counts
+// the proposals sent to it, failures the proposals it rejected and the deals
+// that ended in an error.
+type ProviderUsage struct {
+	MinerID       string `json:"miner_id"`
+	Deals         int    `json:"deals"`           // 统计窗口内接收的订单数
+	BytesInFlight int64  `json:"bytes_in_flight"` // 有效但尚未进入 Proving 的订单的 piece 字节数
+	Attempts      int    `json:"attempts"`
+	Failures      int    `json:"failures"`
+}
+
+// FailureRate returns the share of failed attempts, 0 without attempts
+func (u ProviderUsage) FailureRate() float64 {
+	if u.Attempts == 0 {
+		return 0
+	}
+	rate := float64(u.Failures) / float64(u.Attempts)
+	if rate > 1 {
+		// Deals sent before attempts were recorded may fail too
+		rate = 1
+	}
+	return rate
+}
+
+// providerColumns lists the providers columns in the order read by scanProvider
+const providerColumns = `miner_id, label, max_deals_per_day, max_deals_per_hour, max_bytes_per_day, max_bytes_in_flight, allowed_wallets, storage_price, verified, state, max_failure_rate, created_at, updated_at`
+
+// scanProvider reads a providers row selected with providerColumns
+func scanProvider(row rowScanner) (Provider, error) {
+	var p Provider
+	err := row.Scan(
+		&p.MinerID,
+		&p.Label,
+		&p.MaxDealsPerDay,
+		&p.MaxDealsPerHour,
+		&p.MaxBytesPerDay,
+		&p.MaxBytesInFlight,
+		pq.Array(&p.AllowedWallets),
+		&p.StoragePrice,
+		&p.Verified,
+		&p.State,
+		&p.MaxFailureRate,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	return p, err
+}
+
+// AddProvider registers a storage provider, the miner ID must not be taken
+func (d *Database) AddProvider(p *Provider) error {
+	if p.State == "" {
+		p.State = ProviderStateEnabled
+	}
+	if p.AllowedWallets == nil {
+		p.AllowedWallets = []string{}
+	}
+	err := d.db.QueryRow(`
+		INSERT INTO providers (miner_id, label, max_deals_per_day, max_deals_per_hour, max_bytes_per_day, max_bytes_in_flight, allowed_wallets, storage_price, verified, state, max_failure_rate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING created_at, updated_at`,
+		p.MinerID, p.Label, p.MaxDealsPerDay, p.MaxDealsPerHour, p.MaxBytesPerDay, p.MaxBytesInFlight, pq.Array(p.AllowedWallets),
+		p.StoragePrice, p.Verified, p.State, p.MaxFailureRate,
+	).Scan(&p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert provider: %v", err)
+	}
+	return nil
+}
+
+// UpdateProvider saves the settings of a registered storage provider
+func (d *Database) UpdateProvider(p *Provider) error {
+	if p.AllowedWallets == nil {
+		p.AllowedWallets = []string{}
+	}
+	result, err := d.db.Exec(`
+		UPDATE providers
+		SET label = $1, max_deals_per_day = $2, max_deals_per_hour = $3, max_bytes_per_day = $4, max_bytes_in_flight = $5,
+		    allowed_wallets = $6, storage_price = $7, verified = $8, state = $9, max_failure_rate = $10, updated_at = CURRENT_TIMESTAMP
+		WHERE miner_id = $11`,
+		p.Label, p.MaxDealsPerDay, p.MaxDealsPerHour, p.MaxBytesPerDay, p.MaxBytesInFlight, pq.Array(p.AllowedWallets),
+		p.StoragePrice, p.Verified, p.State, p.MaxFailureRate, p.MinerID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update provider: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("provider %s not found", p.MinerID)
+	}
+	return nil
+}
+
+// DeleteProvider removes a storage provider from the registry, its deals are
+// kept
+func (d *Database) DeleteProvider(minerID string) error {
+	result, err := d.db.Exec(`DELETE FROM providers WHERE miner_id = $1`, minerID)
+	if err != nil {
+		return fmt.Errorf("failed to delete provider: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("provider %s not found", minerID)
+	}
+	return nil
+}
+
+// GetProvider returns nil when the storage provider is not registered
+func (d *Database) GetProvider(minerID string) (*Provider, error) {
+	p, err := scanProvider(d.db.QueryRow(`
+		SELECT `+providerColumns+`
+		FROM providers
+		WHERE miner_id = $1
+	`, minerID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get provider: %v", err)
+	}
+	return &p, nil
+}
+
+// ListProviders returns every registered storage provider ordered by miner ID
+func (d *Database) ListProviders() ([]Provider, error) {
+	rows, err := d.db.Query(`
+		SELECT ` + providerColumns + `
+		FROM providers
+		ORDER BY miner_id ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query providers: %v", err)
+	}
+	defer rows.Close()
+
+	var providers []Provider
+	for rows.Next() {
+		p, err := scanProvider(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan provider: %v", err)
+		}
+		providers = append(providers, p)
+	}
+	return providers, rows.Err()
+}
+
+// GetProviderUsage returns the activity of every storage provider with deals
+// or attempts since the given time, keyed by miner ID. Bytes in flight count
+// all active deals not proving yet, whenever they were sent.
+func (d *Database) GetProviderUsage(since time.Time) (map[string]ProviderUsage, error) {
+	rows, err := d.db.Query(`
+		WITH recent_deals AS (
+			SELECT storage_provider AS provider,
+				COUNT(*) AS deals,
+				COUNT(*) FILTER (WHERE status LIKE 'Error%') AS failed
+			FROM deals
+			WHERE created_at >= $1
+			GROUP BY storage_provider
+		), in_flight AS (
+			SELECT d.storage_provider AS provider,
+				SUM((SELECT f.piece_size FROM files f WHERE f.comm_p = d.commp LIMIT 1)) AS bytes
+			FROM deals d
+			WHERE `+inFlightDeal("d")+`
+			GROUP BY d.storage_provider
+		), attempts AS (
+			SELECT provider,
+				COUNT(*) FILTER (WHERE status IN ($2, $3)) AS attempts,
+				COUNT(*) FILTER (WHERE status = $3) AS rejected
+			FROM deal_attempts
+			WHERE created_at >= $1
+			GROUP BY provider
+		)
+		SELECT p.provider,
+			COALESCE(r.deals, 0),
+			COALESCE(i.bytes, 0),
+			COALESCE(a.attempts, 0),
+			COALESCE(a.rejected, 0) + COALESCE(r.failed, 0)
+		FROM (
+			SELECT provider FROM recent_deals
+			UNION SELECT provider FROM in_flight
+			UNION SELECT provider FROM attempts
+		) p
+		LEFT JOIN recent_deals r ON r.provider = p.provider
+		LEFT JOIN in_flight i ON i.provider = p.provider
+		LEFT JOIN attempts a ON a.provider = p.provider
+	`, since, AttemptAccepted, AttemptRejected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query provider usage: %v", err)
+	}
+	defer rows.Close()
+
+	usage := make(map[string]ProviderUsage)
+	for rows.Next() {
+		var u ProviderUsage
+		if err := rows.Scan(&u.MinerID, &u.Deals, &u.BytesInFlight, &u.Attempts, &u.Failures); err != nil {
+			return nil, fmt.Errorf("failed to scan provider usage: %v", err)
+		}
+		usage[u.MinerID] = u
+	}
+	return usage, rows.Err()
+}
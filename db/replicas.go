@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// activeDeal returns the condition matching the deals of a table alias that
+// count as a replica: every deal but those boost reports as failed
+func activeDeal(alias string) string {
+	return alias + ".status NOT LIKE 'Error%'"
+}
+
+// inFlightDeal returns the condition matching the active deals of a table
+// alias whose data is not sealed yet
+func inFlightDeal(alias string) string {
+	return alias + ".status NOT IN ('Sealing: Proving', 'Announcing') AND " + activeDeal(alias)
+}
+
+// FileReplicas is a car file with the replicas it should have and the
+// providers already holding an active deal for its piece
+type FileReplicas struct {
+	CarFile
+	Target    int      `json:"target"`
+	Providers []string `json:"providers"`
+}
+
+// ListUnderReplicatedFiles returns the car files whose piece has fewer active
+// deals, counted once per provider, than its target. The target is replicas
+// when it is not 0, otherwise the target_replicas of the file's dataset, 1 for
+// files without a dataset. pieceCids limits the files to those pieces when
+// not nil, limit caps the number of files when not 0. The files come newest
+// first, after continues the listing past the last file of a previous page
+// when not nil.
+func (d *Database) ListUnderReplicatedFiles(pieceCids []string, replicas int, limit int, after *CarFile) ([]FileReplicas, error) {
+	var pieces interface{}
+	if pieceCids != nil {
+		pieces = pq.Array(pieceCids)
+	}
+	var afterTime, afterID interface{}
+	if after != nil {
+		afterTime, afterID = after.CreatedAt, after.ID
+	}
+	query := `
+		SELECT ` + qualifiedColumns(fileColumns, "f") + `,
+		       COALESCE(NULLIF($2::int, 0), ds.target_replicas, 1) AS target,
+		       COALESCE(array_agg(DISTINCT d.storage_provider) FILTER (WHERE d.uuid IS NOT NULL), '{}') AS providers
+		FROM files f
+		LEFT JOIN datasets ds ON ds.id = f.dataset_id
+		LEFT JOIN deals d ON d.commp = f.comm_p AND ` + activeDeal("d") + `
+		WHERE ($1::text[] IS NULL OR f.piece_cid = ANY($1))
+		AND ($3::timestamptz IS NULL OR (f.created_at, f.id) < ($3::timestamptz, $4::text))
+		GROUP BY f.id, ds.target_replicas
+		HAVING COUNT(DISTINCT d.storage_provider) < COALESCE(NULLIF($2::int, 0), ds.target_replicas, 1)
+		ORDER BY f.created_at DESC, f.id DESC
+	`
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := d.db.Query(query, pieces, replicas, afterTime, afterID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query under-replicated files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []FileReplicas
+	for rows.Next() {
+		var f FileReplicas
+		f.CarFile, err = scanFile(extraScanner{rows, []interface{}{&f.Target, pq.Array(&f.Providers)}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file: %v", err)
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// extraScanner reads columns selected after those of a scan function
+type extraScanner struct {
+	rowScanner
+	extra []interface{}
+}
+
+func (s extraScanner) Scan(dest ...interface{}) error {
+	return s.rowScanner.Scan(append(dest, s.extra...)...)
+}
+
+// ListFileDeals returns every deal of a car file, the oldest first. Deals sent
+// before deals were linked to files are matched by CommP.
+func (d *Database) ListFileDeals(fileID string) ([]Deal, error) {
+	rows, err := d.db.Query(`
+		SELECT `+qualifiedColumns(dealColumns, "d")+`
+		FROM deals d
+		JOIN files f ON f.id = $1
+		WHERE d.file_id = f.id
+		OR (d.file_id IS NULL AND d.commp = f.comm_p)
+		ORDER BY d.created_at ASC
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deals: %v", err)
+	}
+	defer rows.Close()
+
+	var deals []Deal
+	for rows.Next() {
+		deal, err := scanDeal(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan deal: %v", err)
+		}
+		deals = append(deals, deal)
+	}
+	return deals, rows.Err()
+}
+
+// UpdateDealError marks a car file failed when no deal could be sent for it.
+// The deals already sent for the file are kept.
+func (d *Database) UpdateDealError(id string, dealErr string) error {
+	result, err := d.db.Exec(`
+		UPDATE files
+		SET deal_status = $1, deal_time = CURRENT_TIMESTAMP, deal_error = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, DealStatusFailed, dealErr, id)
+	if err != nil {
+		return fmt.Errorf("failed to update deal error: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("car file with id %s not found", id)
+	}
+	return nil
+}
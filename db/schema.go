@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,9 +13,13 @@ import (
 )
 
 type RawFileInfo struct {
-	Name         string `json:"name"`
-	Size         int64  `json:"size"`
-	RelativePath string `json:"relative_path"`
+	Name         string     `json:"name"`
+	Size         int64      `json:"size"`
+	RelativePath string     `json:"relative_path"`
+	Start        int64      `json:"start,omitempty"`    // 切片起始偏移，整个文件时为 0
+	End          int64      `json:"end,omitempty"`      // 切片结束偏移，整个文件时为 0
+	ModTime      *time.Time `json:"mod_time,omitempty"` // 打包时的修改时间，旧记录为空
+	SHA256       string     `json:"sha256,omitempty"`   // 打包的字节 [Start, End) 的 sha256，旧记录为空
 }
 
 // DealStatus 表示订单发送状态
@@ -42,11 +47,45 @@ type Deal struct {
 	StartEpoch         int64     `json:"start_epoch"`
 	EndEpoch           int64     `json:"end_epoch"`
 	ProviderCollateral float64   `json:"provider_collateral"`
-	Status             string    `json:"status"` // For tracking deal status
+	Status             string    `json:"status"`  // For tracking deal status
+	FileID             *string   `json:"file_id"` // 订单所属的 car 文件，旧订单为空，按 commp 关联
 	CreatedAt          time.Time `json:"created_at"`
 	UpdatedAt          time.Time `json:"updated_at"`
 }
 
+// dealColumns lists the deals columns in the order read by scanDeal
+const dealColumns = `uuid, storage_provider, client_wallet, payload_cid, commp, start_epoch, end_epoch, provider_collateral, status, file_id, created_at, updated_at`
+
+// scanDeal reads a deals row selected with dealColumns
+func scanDeal(row rowScanner) (Deal, error) {
+	var deal Deal
+	err := row.Scan(
+		&deal.UUID,
+		&deal.StorageProvider,
+		&deal.ClientWallet,
+		&deal.PayloadCid,
+		&deal.CommP,
+		&deal.StartEpoch,
+		&deal.EndEpoch,
+		&deal.ProviderCollateral,
+		&deal.Status,
+		&deal.FileID,
+		&deal.CreatedAt,
+		&deal.UpdatedAt,
+	)
+	return deal, err
+}
+
+// qualifiedColumns prefixes every column of a column list with a table alias,
+// for queries joining several tables
+func qualifiedColumns(columns, alias string) string {
+	cols := strings.Split(columns, ", ")
+	for i, col := range cols {
+		cols[i] = alias + "." + col
+	}
+	return strings.Join(cols, ", ")
+}
+
 type CarFile struct {
 	ID               string           `json:"id"`
 	CommP            string           `json:"commp"`
@@ -59,12 +98,46 @@ type CarFile struct {
 	DealStatus       DealStatus       `json:"deal_status"`
 	DealTime         *time.Time       `json:"deal_time"`         // 发单时间
 	DealError        string           `json:"deal_error"`        // 发单失败的错误信息
-	DealID           *string          `json:"deal_id"`           // Reference to Deal UUID, nullable
 	RegenerateStatus RegenerateStatus `json:"regenerate_status"` // 重新生成状态
+	CarVersion       int              `json:"car_version"`       // car 文件版本，1 或 2
+	UnixfsParams     string           `json:"unixfs_params"`     // JSON string of util.UnixfsParams, empty means the defaults
+	DatasetID        *string          `json:"dataset_id"`        // 所属数据集，nullable
 	CreatedAt        time.Time        `json:"created_at"`
 	UpdatedAt        time.Time        `json:"updated_at"` // 记录更新时间
 }
 
+// fileColumns lists the files columns in the order read by scanFile
+const fileColumns = `id, comm_p, data_cid, piece_cid, piece_size, car_size, file_path, raw_files, deal_status, deal_time, deal_error, regenerate_status, car_version, unixfs_params, dataset_id, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFile reads a files row selected with fileColumns
+func scanFile(row rowScanner) (CarFile, error) {
+	var file CarFile
+	err := row.Scan(
+		&file.ID,
+		&file.CommP,
+		&file.DataCid,
+		&file.PieceCid,
+		&file.PieceSize,
+		&file.CarSize,
+		&file.FilePath,
+		&file.RawFiles,
+		&file.DealStatus,
+		&file.DealTime,
+		&file.DealError,
+		&file.RegenerateStatus,
+		&file.CarVersion,
+		&file.UnixfsParams,
+		&file.DatasetID,
+		&file.CreatedAt,
+		&file.UpdatedAt,
+	)
+	return file, err
+}
+
 type User struct {
 	ID        string    `json:"id"`
 	Username  string    `json:"username"`
@@ -146,6 +219,7 @@ func InitDB(config *DBConfig) (*Database, error) {
 			end_epoch BIGINT NOT NULL,
 			provider_collateral REAL NOT NULL,
 			status TEXT NOT NULL,
+			file_id TEXT,
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)
@@ -155,6 +229,30 @@ func InitDB(config *DBConfig) (*Database, error) {
 		return nil, fmt.Errorf("failed to create deals table: %v", err)
 	}
 
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_deals_commp ON deals (commp, storage_provider)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create deals commp index: %v", err)
+	}
+
+	// Create datasets table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS datasets (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			source_dir TEXT NOT NULL,
+			client TEXT NOT NULL DEFAULT '',
+			target_replicas INTEGER NOT NULL DEFAULT 1,
+			unixfs_params TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create datasets table: %v", err)
+	}
+
 	// Create files table if not exists
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS files (
@@ -168,9 +266,11 @@ func InitDB(config *DBConfig) (*Database, error) {
 			raw_files TEXT NOT NULL,
 			deal_status TEXT NOT NULL DEFAULT 'pending',
 			deal_time TIMESTAMP WITH TIME ZONE,
-			deal_error TEXT,
-			deal_id UUID REFERENCES deals(uuid),
+			deal_error TEXT NOT NULL DEFAULT '',
 			regenerate_status TEXT NOT NULL DEFAULT 'pending',
+			car_version INTEGER NOT NULL DEFAULT 1,
+			unixfs_params TEXT NOT NULL DEFAULT '',
+			dataset_id TEXT REFERENCES datasets(id),
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)
@@ -180,6 +280,164 @@ func InitDB(config *DBConfig) (*Database, error) {
 		return nil, fmt.Errorf("failed to create files table: %v", err)
 	}
 
+	// Create packed_slices table if not exists, filled from the raw files of
+	// the car files already generated when it is created
+	_, err = db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.tables WHERE table_name = 'packed_slices'
+			) THEN
+				CREATE TABLE packed_slices (
+					file_id TEXT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+					path TEXT NOT NULL,
+					size BIGINT NOT NULL,
+					start_offset BIGINT NOT NULL,
+					end_offset BIGINT NOT NULL,
+					PRIMARY KEY (file_id, path, start_offset)
+				);
+				CREATE INDEX idx_packed_slices_path ON packed_slices (path);
+				INSERT INTO packed_slices (file_id, path, size, start_offset, end_offset)
+				SELECT f.id, e->>'relative_path', (e->>'size')::BIGINT,
+					COALESCE((e->>'start')::BIGINT, 0), COALESCE((e->>'end')::BIGINT, 0)
+				FROM files f,
+					jsonb_array_elements(CASE WHEN jsonb_typeof(f.raw_files::jsonb) = 'array' THEN f.raw_files::jsonb ELSE '[]'::jsonb END) e
+				ON CONFLICT DO NOTHING;
+			END IF;
+		END $$
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create packed_slices table: %v", err)
+	}
+
+	// Create file_cids table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS file_cids (
+			file_id TEXT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+			path TEXT NOT NULL,
+			cid TEXT NOT NULL,
+			is_dir BOOLEAN NOT NULL,
+			size BIGINT NOT NULL,
+			PRIMARY KEY (file_id, path)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create file_cids table: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_file_cids_path ON file_cids (path)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create file_cids path index: %v", err)
+	}
+
+	// Create source_files table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS source_files (
+			id BIGSERIAL PRIMARY KEY,
+			dataset_id TEXT NOT NULL REFERENCES datasets(id) ON DELETE CASCADE,
+			path TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			mod_time TIMESTAMP WITH TIME ZONE NOT NULL,
+			sha256 TEXT NOT NULL DEFAULT '',
+			md5 TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'unpacked',
+			claimed_by TEXT NOT NULL DEFAULT '',
+			claimed_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (dataset_id, path)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create source_files table: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_source_files_status ON source_files (dataset_id, status, path)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create source_files status index: %v", err)
+	}
+
+	// Create source_file_slices table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS source_file_slices (
+			source_file_id BIGINT NOT NULL REFERENCES source_files(id) ON DELETE CASCADE,
+			start_offset BIGINT NOT NULL,
+			end_offset BIGINT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (source_file_id, start_offset)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create source_file_slices table: %v", err)
+	}
+
+	// Create providers table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS providers (
+			miner_id TEXT PRIMARY KEY,
+			label TEXT NOT NULL DEFAULT '',
+			max_deals_per_day INTEGER NOT NULL DEFAULT 0,
+			max_deals_per_hour INTEGER NOT NULL DEFAULT 0,
+			max_bytes_per_day BIGINT NOT NULL DEFAULT 0,
+			max_bytes_in_flight BIGINT NOT NULL DEFAULT 0,
+			allowed_wallets TEXT[] NOT NULL DEFAULT '{}',
+			storage_price BIGINT NOT NULL DEFAULT 0,
+			verified BOOLEAN NOT NULL DEFAULT TRUE,
+			state TEXT NOT NULL DEFAULT 'enabled',
+			max_failure_rate REAL NOT NULL DEFAULT 0,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create providers table: %v", err)
+	}
+
+	// Create deal_attempts table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS deal_attempts (
+			id BIGSERIAL PRIMARY KEY,
+			provider TEXT NOT NULL,
+			wallet TEXT NOT NULL DEFAULT '',
+			piece_cid TEXT NOT NULL DEFAULT '',
+			piece_size BIGINT NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'sending',
+			deal_uuid UUID,
+			error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create deal_attempts table: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_deal_attempts_provider ON deal_attempts (provider, created_at)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create deal_attempts provider index: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_deal_attempts_wallet ON deal_attempts (wallet, created_at)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create deal_attempts wallet index, run db/migrations/add_deal_rate_limits.sql on databases created before: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_deal_attempts_piece ON deal_attempts (piece_cid, provider)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create deal_attempts piece index, run db/migrations/add_deal_rate_limits.sql on databases created before: %v", err)
+	}
+
 	// Drop the old car_files table if it exists
 	_, err = db.Exec(`DROP TABLE IF EXISTS car_files`)
 	if err != nil {
@@ -214,19 +472,35 @@ func (d *Database) InsertFile(file *CarFile) error {
 		file.RegenerateStatus = RegenerateStatusPending
 	}
 
-	err := d.db.QueryRow(`
-		INSERT INTO files (id, comm_p, data_cid, piece_cid, piece_size, car_size, file_path, raw_files, deal_status, deal_time, deal_error, deal_id, regenerate_status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	// Set default car version if not provided
+	if file.CarVersion == 0 {
+		file.CarVersion = 1
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO files (id, comm_p, data_cid, piece_cid, piece_size, car_size, file_path, raw_files, deal_status, deal_time, deal_error, regenerate_status, car_version, unixfs_params, dataset_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 		RETURNING id, created_at, updated_at`,
-		file.ID, file.CommP, file.DataCid, file.PieceCid, file.PieceSize, file.CarSize, file.FilePath, file.RawFiles, file.DealStatus, file.DealTime, file.DealError, file.DealID, file.RegenerateStatus,
+		file.ID, file.CommP, file.DataCid, file.PieceCid, file.PieceSize, file.CarSize, file.FilePath, file.RawFiles, file.DealStatus, file.DealTime, file.DealError, file.RegenerateStatus, file.CarVersion, file.UnixfsParams, file.DatasetID,
 	).Scan(&file.ID, &file.CreatedAt, &file.UpdatedAt)
-
-	return err
+	if err != nil {
+		return err
+	}
+	if err := insertPackedSlices(tx, file.ID, file.RawFiles); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (d *Database) ListFiles() ([]CarFile, error) {
 	rows, err := d.db.Query(`
-		SELECT id, comm_p, data_cid, piece_cid, piece_size, car_size, file_path, raw_files, deal_status, deal_time, deal_error, deal_id, regenerate_status, created_at, updated_at
+		SELECT ` + fileColumns + `
 		FROM files
 		ORDER BY created_at ASC
 	`)
@@ -237,24 +511,7 @@ func (d *Database) ListFiles() ([]CarFile, error) {
 
 	var files []CarFile
 	for rows.Next() {
-		var file CarFile
-		err := rows.Scan(
-			&file.ID,
-			&file.CommP,
-			&file.DataCid,
-			&file.PieceCid,
-			&file.PieceSize,
-			&file.CarSize,
-			&file.FilePath,
-			&file.RawFiles,
-			&file.DealStatus,
-			&file.DealTime,
-			&file.DealError,
-			&file.DealID,
-			&file.RegenerateStatus,
-			&file.CreatedAt,
-			&file.UpdatedAt,
-		)
+		file, err := scanFile(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -263,36 +520,43 @@ func (d *Database) ListFiles() ([]CarFile, error) {
 	return files, rows.Err()
 }
 
+// ListDatasetFiles returns the car files packed from a dataset
+func (d *Database) ListDatasetFiles(datasetID string) ([]CarFile, error) {
+	rows, err := d.db.Query(`
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE dataset_id = $1
+		ORDER BY created_at ASC
+	`, datasetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query files of dataset %s: %v", datasetID, err)
+	}
+	defer rows.Close()
+
+	var files []CarFile
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file: %v", err)
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
 func (d *Database) GetFile(id string) (*CarFile, error) {
-	file := &CarFile{}
-	err := d.db.QueryRow(`
-		SELECT id, comm_p, data_cid, piece_cid, piece_size, car_size, file_path, raw_files, deal_status, deal_time, deal_error, deal_id, regenerate_status, created_at, updated_at
+	file, err := scanFile(d.db.QueryRow(`
+		SELECT `+fileColumns+`
 		FROM files
 		WHERE id = $1
-	`, id).Scan(
-		&file.ID,
-		&file.CommP,
-		&file.DataCid,
-		&file.PieceCid,
-		&file.PieceSize,
-		&file.CarSize,
-		&file.FilePath,
-		&file.RawFiles,
-		&file.DealStatus,
-		&file.DealTime,
-		&file.DealError,
-		&file.DealID,
-		&file.RegenerateStatus,
-		&file.CreatedAt,
-		&file.UpdatedAt,
-	)
+	`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return file, nil
+	return &file, nil
 }
 
 func (d *Database) DeleteFile(id string) error {
@@ -315,7 +579,7 @@ func (d *Database) DeleteFile(id string) error {
 
 func (d *Database) SearchFiles(params SearchParams) ([]CarFile, error) {
 	query := `
-		SELECT id, comm_p, data_cid, piece_cid, piece_size, car_size, file_path, raw_files, deal_status, deal_time, deal_error, deal_id, regenerate_status, created_at, updated_at 
+		SELECT ` + fileColumns + `
 		FROM files 
 		WHERE 1=1
 	`
@@ -350,24 +614,7 @@ func (d *Database) SearchFiles(params SearchParams) ([]CarFile, error) {
 
 	var files []CarFile
 	for rows.Next() {
-		var file CarFile
-		err := rows.Scan(
-			&file.ID,
-			&file.CommP,
-			&file.DataCid,
-			&file.PieceCid,
-			&file.PieceSize,
-			&file.CarSize,
-			&file.FilePath,
-			&file.RawFiles,
-			&file.DealStatus,
-			&file.DealTime,
-			&file.DealError,
-			&file.DealID,
-			&file.RegenerateStatus,
-			&file.CreatedAt,
-			&file.UpdatedAt,
-		)
+		file, err := scanFile(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -381,7 +628,7 @@ func (d *Database) DB() *sql.DB {
 	return d.db
 }
 
-func (d *Database) UpdateDealSentStatus(id string, status DealStatus, dealUUID string) error {
+func (d *Database) UpdateDealSentStatus(id string, status DealStatus) error {
 	now := time.Now()
 	tx, err := d.db.Begin()
 	if err != nil {
@@ -392,9 +639,9 @@ func (d *Database) UpdateDealSentStatus(id string, status DealStatus, dealUUID s
 	// Update files table
 	result, err := tx.Exec(`
 		UPDATE files 
-		SET deal_status = $1, deal_time = $2, deal_id = $3, updated_at = $4
-		WHERE id = $5`,
-		status, now, dealUUID, now, id,
+		SET deal_status = $1, deal_time = $2, deal_error = '', updated_at = $3
+		WHERE id = $4`,
+		status, now, now, id,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update files: %v", err)
@@ -475,6 +722,15 @@ func (d *Database) CreateUser(username, password string) error {
 }
 
 func (d *Database) InsertDeal(deal *Deal) error {
+	return insertDeal(d.db, deal)
+}
+
+// queryRower is a *sql.DB or a *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func insertDeal(q queryRower, deal *Deal) error {
 	// Generate UUID if not provided
 	if deal.UUID == "" {
 		u, err := uuid.NewRandom()
@@ -492,12 +748,12 @@ func (d *Database) InsertDeal(deal *Deal) error {
 		deal.UpdatedAt = now
 	}
 
-	err := d.db.QueryRow(`
-		INSERT INTO deals (uuid, storage_provider, client_wallet, payload_cid, commp, start_epoch, end_epoch, provider_collateral, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	err := q.QueryRow(`
+		INSERT INTO deals (uuid, storage_provider, client_wallet, payload_cid, commp, start_epoch, end_epoch, provider_collateral, status, file_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		RETURNING uuid, created_at, updated_at`,
 		deal.UUID, deal.StorageProvider, deal.ClientWallet, deal.PayloadCid, deal.CommP,
-		deal.StartEpoch, deal.EndEpoch, deal.ProviderCollateral, deal.Status,
+		deal.StartEpoch, deal.EndEpoch, deal.ProviderCollateral, deal.Status, deal.FileID,
 		deal.CreatedAt, deal.UpdatedAt,
 	).Scan(&deal.UUID, &deal.CreatedAt, &deal.UpdatedAt)
 
@@ -505,33 +761,19 @@ func (d *Database) InsertDeal(deal *Deal) error {
 }
 
 func (d *Database) GetDeal(uuid string) (*Deal, error) {
-	deal := &Deal{}
-	err := d.db.QueryRow(`
-		SELECT uuid, storage_provider, client_wallet, payload_cid, commp, start_epoch, end_epoch, 
-		       provider_collateral, status, created_at, updated_at
+	deal, err := scanDeal(d.db.QueryRow(`
+		SELECT `+dealColumns+`
 		FROM deals
 		WHERE uuid = $1`,
 		uuid,
-	).Scan(
-		&deal.UUID,
-		&deal.StorageProvider,
-		&deal.ClientWallet,
-		&deal.PayloadCid,
-		&deal.CommP,
-		&deal.StartEpoch,
-		&deal.EndEpoch,
-		&deal.ProviderCollateral,
-		&deal.Status,
-		&deal.CreatedAt,
-		&deal.UpdatedAt,
-	)
+	))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return deal, nil
+	return &deal, nil
 }
 
 func (d *Database) UpdateDealStatus(uuid string, status string) error {
@@ -546,8 +788,7 @@ func (d *Database) UpdateDealStatus(uuid string, status string) error {
 
 func (d *Database) ListDeals() ([]Deal, error) {
 	rows, err := d.db.Query(`
-		SELECT uuid, storage_provider, client_wallet, payload_cid, commp, start_epoch, end_epoch,
-		       provider_collateral, status, created_at, updated_at
+		SELECT ` + dealColumns + `
 		FROM deals
 		ORDER BY created_at DESC
 	`)
@@ -558,20 +799,7 @@ func (d *Database) ListDeals() ([]Deal, error) {
 
 	var deals []Deal
 	for rows.Next() {
-		var deal Deal
-		err := rows.Scan(
-			&deal.UUID,
-			&deal.StorageProvider,
-			&deal.ClientWallet,
-			&deal.PayloadCid,
-			&deal.CommP,
-			&deal.StartEpoch,
-			&deal.EndEpoch,
-			&deal.ProviderCollateral,
-			&deal.Status,
-			&deal.CreatedAt,
-			&deal.UpdatedAt,
-		)
+		deal, err := scanDeal(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -582,9 +810,7 @@ func (d *Database) ListDeals() ([]Deal, error) {
 
 func (d *Database) GetDealsByStatus(status string) ([]Deal, error) {
 	rows, err := d.db.Query(`
-		SELECT uuid, storage_provider, client_wallet, payload_cid, commp, 
-			   start_epoch, end_epoch, provider_collateral, status, 
-			   created_at, updated_at
+		SELECT `+dealColumns+`
 		FROM deals
 		WHERE status = $1
 		ORDER BY created_at ASC
@@ -596,20 +822,7 @@ func (d *Database) GetDealsByStatus(status string) ([]Deal, error) {
 
 	var deals []Deal
 	for rows.Next() {
-		var deal Deal
-		err := rows.Scan(
-			&deal.UUID,
-			&deal.StorageProvider,
-			&deal.ClientWallet,
-			&deal.PayloadCid,
-			&deal.CommP,
-			&deal.StartEpoch,
-			&deal.EndEpoch,
-			&deal.ProviderCollateral,
-			&deal.Status,
-			&deal.CreatedAt,
-			&deal.UpdatedAt,
-		)
+		deal, err := scanDeal(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan deal: %v", err)
 		}
@@ -619,11 +832,34 @@ func (d *Database) GetDealsByStatus(status string) ([]Deal, error) {
 	return deals, nil
 }
 
+// GetDealsByCommP 获取指定 commp 的所有订单
+func (d *Database) GetDealsByCommP(commp string) ([]Deal, error) {
+	rows, err := d.db.Query(`
+		SELECT `+dealColumns+`
+		FROM deals
+		WHERE commp = $1
+		ORDER BY created_at ASC
+	`, commp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deals: %v", err)
+	}
+	defer rows.Close()
+
+	var deals []Deal
+	for rows.Next() {
+		deal, err := scanDeal(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan deal: %v", err)
+		}
+		deals = append(deals, deal)
+	}
+
+	return deals, rows.Err()
+}
+
 func (d *Database) GetDealsForUpdate() ([]Deal, error) {
 	rows, err := d.db.Query(`
-		SELECT uuid, storage_provider, client_wallet, payload_cid, commp, 
-			   start_epoch, end_epoch, provider_collateral, status, 
-			   created_at, updated_at
+		SELECT ` + dealColumns + `
 		FROM deals
 		WHERE status NOT IN ('proposed', 'Sealing: Proving', 'Error: user manually terminated the deal')
 		ORDER BY created_at ASC
@@ -635,20 +871,7 @@ func (d *Database) GetDealsForUpdate() ([]Deal, error) {
 
 	var deals []Deal
 	for rows.Next() {
-		var deal Deal
-		err := rows.Scan(
-			&deal.UUID,
-			&deal.StorageProvider,
-			&deal.ClientWallet,
-			&deal.PayloadCid,
-			&deal.CommP,
-			&deal.StartEpoch,
-			&deal.EndEpoch,
-			&deal.ProviderCollateral,
-			&deal.Status,
-			&deal.CreatedAt,
-			&deal.UpdatedAt,
-		)
+		deal, err := scanDeal(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan deal: %v", err)
 		}
@@ -660,9 +883,7 @@ func (d *Database) GetDealsForUpdate() ([]Deal, error) {
 
 func (d *Database) GetFilesByPieceCids(pieceCids []string) ([]CarFile, error) {
 	query := `
-		SELECT id, comm_p, data_cid, piece_cid, piece_size, car_size, 
-			   file_path, raw_files, deal_status, deal_time, deal_error, 
-			   deal_id, regenerate_status, created_at, updated_at
+		SELECT ` + fileColumns + `
 		FROM files
 		WHERE piece_cid = ANY($1)
 		ORDER BY created_at DESC
@@ -676,24 +897,7 @@ func (d *Database) GetFilesByPieceCids(pieceCids []string) ([]CarFile, error) {
 
 	var files []CarFile
 	for rows.Next() {
-		var file CarFile
-		err := rows.Scan(
-			&file.ID,
-			&file.CommP,
-			&file.DataCid,
-			&file.PieceCid,
-			&file.PieceSize,
-			&file.CarSize,
-			&file.FilePath,
-			&file.RawFiles,
-			&file.DealStatus,
-			&file.DealTime,
-			&file.DealError,
-			&file.DealID,
-			&file.RegenerateStatus,
-			&file.CreatedAt,
-			&file.UpdatedAt,
-		)
+		file, err := scanFile(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan file: %v", err)
 		}
@@ -705,9 +909,7 @@ func (d *Database) GetFilesByPieceCids(pieceCids []string) ([]CarFile, error) {
 
 func (d *Database) ListPendingFiles() ([]CarFile, error) {
 	query := `
-		SELECT id, comm_p, data_cid, piece_cid, piece_size, car_size, 
-			   file_path, raw_files, deal_status, deal_time, deal_error, 
-			   deal_id, regenerate_status, created_at, updated_at
+		SELECT ` + fileColumns + `
 		FROM files
 		WHERE deal_status = $1
 		ORDER BY created_at DESC
@@ -721,24 +923,7 @@ func (d *Database) ListPendingFiles() ([]CarFile, error) {
 
 	var files []CarFile
 	for rows.Next() {
-		var file CarFile
-		err := rows.Scan(
-			&file.ID,
-			&file.CommP,
-			&file.DataCid,
-			&file.PieceCid,
-			&file.PieceSize,
-			&file.CarSize,
-			&file.FilePath,
-			&file.RawFiles,
-			&file.DealStatus,
-			&file.DealTime,
-			&file.DealError,
-			&file.DealID,
-			&file.RegenerateStatus,
-			&file.CreatedAt,
-			&file.UpdatedAt,
-		)
+		file, err := scanFile(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan file: %v", err)
 		}
@@ -755,9 +940,7 @@ func (d *Database) GetFilesByDealStatus(status string, startTime, endTime *time.
 
 	// Base query
 	query = `
-		SELECT id, comm_p, data_cid, piece_cid, piece_size, car_size, 
-			   file_path, raw_files, deal_status, deal_time, deal_error, 
-			   deal_id, regenerate_status, created_at, updated_at
+		SELECT ` + fileColumns + `
 		FROM files
 		WHERE 1=1
 	`
@@ -793,24 +976,7 @@ func (d *Database) GetFilesByDealStatus(status string, startTime, endTime *time.
 
 	var files []CarFile
 	for rows.Next() {
-		var file CarFile
-		err := rows.Scan(
-			&file.ID,
-			&file.CommP,
-			&file.DataCid,
-			&file.PieceCid,
-			&file.PieceSize,
-			&file.CarSize,
-			&file.FilePath,
-			&file.RawFiles,
-			&file.DealStatus,
-			&file.DealTime,
-			&file.DealError,
-			&file.DealID,
-			&file.RegenerateStatus,
-			&file.CreatedAt,
-			&file.UpdatedAt,
-		)
+		file, err := scanFile(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan file: %v", err)
 		}
@@ -842,65 +1008,53 @@ func (d *Database) UpdateRegenerateStatus(id string, status RegenerateStatus) er
 	return nil
 }
 
+// GetFileByCommP returns nil when no car file has the given CommP
 func (d *Database) GetFileByCommP(commp string) (*CarFile, error) {
-	var file CarFile
-	var rawFiles sql.NullString
-	var dealTime sql.NullTime
-	var dealID sql.NullString
-	var regenerateStatus sql.NullString
-
-	query := `
-		SELECT id, commp, data_cid, piece_cid, piece_size, car_size, file_path, 
-		raw_files, deal_status, deal_time, deal_error, deal_id, regenerate_status
-		FROM files WHERE commp = $1
-	`
-
-	err := d.db.QueryRow(query, commp).Scan(
-		&file.ID,
-		&file.CommP,
-		&file.DataCid,
-		&file.PieceCid,
-		&file.PieceSize,
-		&file.CarSize,
-		&file.FilePath,
-		&rawFiles,
-		&file.DealStatus,
-		&dealTime,
-		&file.DealError,
-		&dealID,
-		&regenerateStatus,
-	)
-
+	file, err := scanFile(d.db.QueryRow(`
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE comm_p = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, commp))
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("file with commp %s not found", commp)
+		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("error querying file: %w", err)
 	}
+	return &file, nil
+}
 
-	// 处理可空字段
-	if rawFiles.Valid {
-		file.RawFiles = rawFiles.String
-	}
-	if dealTime.Valid {
-		file.DealTime = &dealTime.Time
-	}
-	if dealID.Valid {
-		file.DealID = &dealID.String
-	}
-	if regenerateStatus.Valid {
-		file.RegenerateStatus = RegenerateStatus(regenerateStatus.String)
+// ListFilesInDir returns the car files recorded with a path directly under dir
+func (d *Database) ListFilesInDir(dir string) ([]CarFile, error) {
+	rows, err := d.db.Query(`
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE left(file_path, length($1) + 1) = $1 || '/'
+		AND position('/' in substr(file_path, length($1) + 2)) = 0
+		ORDER BY file_path ASC
+	`, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query files in %s: %v", dir, err)
 	}
+	defer rows.Close()
 
-	return &file, nil
+	var files []CarFile
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file: %v", err)
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
 }
 
 // GetProposedDealsWithRegeneratedFiles 获取status为proposed且对应文件regenerate_status为success的订单
 func (d *Database) GetProposedDealsWithRegeneratedFiles() ([]Deal, error) {
 	query := `
-		SELECT DISTINCT d.uuid, d.storage_provider, d.client_wallet, d.payload_cid, 
-		d.commp, d.start_epoch, d.end_epoch, d.provider_collateral, d.status, 
-		d.created_at, d.updated_at
+		SELECT DISTINCT ` + qualifiedColumns(dealColumns, "d") + `
 		FROM deals d
 		JOIN files f ON d.commp = f.comm_p
 		WHERE d.status = 'proposed'
@@ -915,20 +1069,7 @@ func (d *Database) GetProposedDealsWithRegeneratedFiles() ([]Deal, error) {
 
 	var deals []Deal
 	for rows.Next() {
-		var deal Deal
-		err := rows.Scan(
-			&deal.UUID,
-			&deal.StorageProvider,
-			&deal.ClientWallet,
-			&deal.PayloadCid,
-			&deal.CommP,
-			&deal.StartEpoch,
-			&deal.EndEpoch,
-			&deal.ProviderCollateral,
-			&deal.Status,
-			&deal.CreatedAt,
-			&deal.UpdatedAt,
-		)
+		deal, err := scanDeal(rows)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning deal: %w", err)
 		}
@@ -942,14 +1083,24 @@ func (d *Database) GetProposedDealsWithRegeneratedFiles() ([]Deal, error) {
 	return deals, nil
 }
 
+// GetDealsForClear 获取可以删除 car 文件的订单：订单已在证明或公告中，
+// 文件的副本数已达标，且同一 piece 没有其他仍需导入或封装的有效订单
 func (d *Database) GetDealsForClear() ([]Deal, error) {
 	rows, err := d.db.Query(`
-		SELECT uuid, commp, storage_provider, client_wallet, status, created_at, updated_at
-		FROM deals
-		WHERE status = 'Sealing: Proving'
-		OR status = 'Announcing'
-		ORDER BY created_at DESC
-	`)
+		SELECT d.uuid, d.commp, d.storage_provider, d.client_wallet, d.status, d.created_at, d.updated_at
+		FROM deals d
+		WHERE d.status IN ('Sealing: Proving', 'Announcing')
+		AND NOT EXISTS (
+			SELECT 1 FROM files f
+			WHERE f.comm_p = d.commp AND f.deal_status <> $1
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM deals o
+			WHERE o.commp = d.commp
+			AND `+inFlightDeal("o")+`
+		)
+		ORDER BY d.created_at DESC
+	`, DealStatusSuccess)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/minerdao/lotus-car/config"
+)
+
+// testDatabase connects to the database of the config file at
+// LOTUS_CAR_TEST_CONFIG. Without it the test is skipped, unless
+// LOTUS_CAR_REQUIRE_TEST_DB is set, as it is in CI, where it fails.
+func testDatabase(t *testing.T) *Database {
+	t.Helper()
+	cfgPath := os.Getenv("LOTUS_CAR_TEST_CONFIG")
+	if cfgPath == "" {
+		if os.Getenv("LOTUS_CAR_REQUIRE_TEST_DB") != "" {
+			t.Fatal("LOTUS_CAR_REQUIRE_TEST_DB is set but LOTUS_CAR_TEST_CONFIG is not")
+		}
+		t.Skip("LOTUS_CAR_TEST_CONFIG is not set")
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := InitFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// insertTestFile records a car file with a unique piece, removed when the
+// test ends
+func insertTestFile(t *testing.T, database *Database, rawFiles string) *CarFile {
+	t.Helper()
+	commp := "baga-db-test-" + uuid.New().String()
+	f := &CarFile{
+		CommP:     commp,
+		DataCid:   "bafy-db-test",
+		PieceCid:  commp,
+		PieceSize: 2048,
+		CarSize:   100,
+		FilePath:  "/tmp/" + commp + ".car",
+		RawFiles:  rawFiles,
+	}
+	if err := database.InsertFile(f); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.DeleteFile(f.ID) })
+	return f
+}
+
+func TestFileDealStatus(t *testing.T) {
+	database := testDatabase(t)
+	f := insertTestFile(t, database, "[]")
+
+	if err := database.UpdateDealError(f.ID, "no provider took the deal"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := database.GetFile(f.ID)
+	if err != nil || got.DealStatus != DealStatusFailed || got.DealError != "no provider took the deal" {
+		t.Fatalf("file after deal error: %+v, %v", got, err)
+	}
+
+	// A deal sent later clears the error
+	if err := database.UpdateDealSentStatus(f.ID, DealStatusSuccess); err != nil {
+		t.Fatal(err)
+	}
+	got, err = database.GetFile(f.ID)
+	if err != nil || got.DealStatus != DealStatusSuccess || got.DealError != "" {
+		t.Fatalf("file after deal sent: %+v, %v", got, err)
+	}
+	files, err := database.GetFilesByPieceCids([]string{f.PieceCid})
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files by piece after deal sent: %+v, %v", files, err)
+	}
+}
+
+func TestListUnderReplicatedFilesPages(t *testing.T) {
+	database := testDatabase(t)
+	var pieces []string
+	for i := 0; i < 3; i++ {
+		pieces = append(pieces, insertTestFile(t, database, "[]").PieceCid)
+	}
+
+	seen := make(map[string]bool)
+	var after *CarFile
+	for page := 0; ; page++ {
+		files, err := database.ListUnderReplicatedFiles(pieces, 1, 2, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		if page > 2 {
+			t.Fatalf("listing did not end after %d pages", page)
+		}
+		for _, f := range files {
+			if seen[f.ID] {
+				t.Fatalf("file %s listed twice", f.ID)
+			}
+			seen[f.ID] = true
+			if f.Target != 1 || len(f.Providers) != 0 {
+				t.Fatalf("file %s has target %d and providers %v", f.ID, f.Target, f.Providers)
+			}
+		}
+		after = &files[len(files)-1].CarFile
+	}
+	if len(seen) != len(pieces) {
+		t.Fatalf("listed %d files, want %d", len(seen), len(pieces))
+	}
+}
+
+func TestGetPackedSlices(t *testing.T) {
+	database := testDatabase(t)
+	dir := "db-test-" + uuid.New().String()
+	f := insertTestFile(t, database, `[{"name":"a","size":10,"relative_path":"`+dir+`/a"},{"name":"b","size":30,"relative_path":"`+dir+`/b","start":0,"end":20}]`)
+
+	packed, err := database.GetPackedSlices([]string{dir + "/a", dir + "/b", dir + "/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := packed[dir+"/a"], packed[dir+"/b"]
+	if len(packed) != 2 || len(a) != 1 || a[0].Size != 10 || a[0].End != 0 ||
+		len(b) != 1 || b[0].Size != 30 || b[0].Start != 0 || b[0].End != 20 {
+		t.Fatalf("packed slices %+v", packed)
+	}
+
+	// The slices go with their car file
+	if err := database.DeleteFile(f.ID); err != nil {
+		t.Fatal(err)
+	}
+	packed, err = database.GetPackedSlices([]string{dir + "/a"})
+	if err != nil || len(packed) != 0 {
+		t.Fatalf("packed slices after the car file was deleted: %+v, %v", packed, err)
+	}
+}
@@ -0,0 +1,405 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SourceFileStatus 表示源文件打包状态
+type SourceFileStatus string
+
+const (
+	SourceFileStatusUnpacked SourceFileStatus = "unpacked" // 未打包
+	SourceFileStatusPacking  SourceFileStatus = "packing"  // 已被某个 generate 领取，正在打包
+	SourceFileStatusPacked   SourceFileStatus = "packed"   // 已打包进 car 文件
+)
+
+// SourceFile is one file of a dataset as recorded by index
+type SourceFile struct {
+	ID        int64            `json:"id"`
+	DatasetID string           `json:"dataset_id"`
+	Path      string           `json:"path"` // 相对于数据集源目录的路径
+	Size      int64            `json:"size"`
+	ModTime   time.Time        `json:"mod_time"`
+	SHA256    string           `json:"sha256"`
+	MD5       string           `json:"md5"`
+	Status    SourceFileStatus `json:"status"`
+	ClaimedBy string           `json:"claimed_by"` // 领取该文件的主机
+	ClaimedAt *time.Time       `json:"claimed_at"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+// SourceFileStats counts the files of a dataset in one status
+type SourceFileStats struct {
+	Status SourceFileStatus `json:"status"`
+	Files  int64            `json:"files"`
+	Bytes  int64            `json:"bytes"`
+}
+
+// SourceFileSlice is a byte range [Start, End) of a split source file that
+// is saved in a car file
+type SourceFileSlice struct {
+	SourceFileID int64 `json:"source_file_id"`
+	Start        int64 `json:"start"`
+	End          int64 `json:"end"`
+}
+
+// SyncResult reports how SyncSourceFiles changed a dataset
+type SyncResult struct {
+	Upserted int64 // new or changed files
+	Removed  int64 // unpacked files no longer in the index
+	Reset    int64 // packed or packing files whose content changed, set back to unpacked
+}
+
+// contentChanged returns the SQL condition under which the source file row
+// old no longer holds the bytes described by the row new. A hash only counts
+// when both rows have one, so indexing without --hash does not reset files.
+func contentChanged(old, new string) string {
+	return fmt.Sprintf(`(%[1]s.size <> %[2]s.size OR %[1]s.mod_time <> %[2]s.mod_time
+		OR (%[1]s.sha256 <> '' AND %[2]s.sha256 <> '' AND %[1]s.sha256 <> %[2]s.sha256)
+		OR (%[1]s.md5 <> '' AND %[2]s.md5 <> '' AND %[1]s.md5 <> %[2]s.md5))`, old, new)
+}
+
+// sourceFileColumns lists the source_files columns in the order read by scanSourceFile
+const sourceFileColumns = `id, dataset_id, path, size, mod_time, sha256, md5, status, claimed_by, claimed_at, created_at, updated_at`
+
+// scanSourceFile reads a source_files row selected with sourceFileColumns
+func scanSourceFile(row rowScanner) (SourceFile, error) {
+	var f SourceFile
+	err := row.Scan(
+		&f.ID,
+		&f.DatasetID,
+		&f.Path,
+		&f.Size,
+		&f.ModTime,
+		&f.SHA256,
+		&f.MD5,
+		&f.Status,
+		&f.ClaimedBy,
+		&f.ClaimedAt,
+		&f.CreatedAt,
+		&f.UpdatedAt,
+	)
+	return f, err
+}
+
+// SyncSourceFiles makes the source files of a dataset match a complete index,
+// read from next until it returns nil so the index never has to fit in
+// memory. New files are added as unpacked and changed files are updated. A
+// packed or packing file whose content changed is set back to unpacked and
+// its saved slices are dropped, since the car files no longer hold its bytes.
+// Unpacked files missing from the index are removed, packed ones are kept
+// since they are part of a car file.
+func (d *Database) SyncSourceFiles(datasetID string, next func() (*SourceFile, error)) (SyncResult, error) {
+	var result SyncResult
+	tx, err := d.db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TEMP TABLE source_files_sync (
+			path TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			mod_time TIMESTAMP WITH TIME ZONE NOT NULL,
+			sha256 TEXT NOT NULL,
+			md5 TEXT NOT NULL
+		) ON COMMIT DROP
+	`)
+	if err != nil {
+		return result, fmt.Errorf("failed to create sync table: %v", err)
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("source_files_sync", "path", "size", "mod_time", "sha256", "md5"))
+	if err != nil {
+		return result, fmt.Errorf("failed to prepare copy: %v", err)
+	}
+	for {
+		f, err := next()
+		if err != nil {
+			stmt.Close()
+			return result, err
+		}
+		if f == nil {
+			break
+		}
+		if _, err := stmt.Exec(f.Path, f.Size, f.ModTime, f.SHA256, f.MD5); err != nil {
+			stmt.Close()
+			return result, fmt.Errorf("failed to copy source file %s: %v", f.Path, err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return result, fmt.Errorf("failed to flush source files: %v", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return result, fmt.Errorf("failed to close copy: %v", err)
+	}
+
+	err = tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM source_files s
+		JOIN source_files_sync t ON t.path = s.path
+		WHERE s.dataset_id = $1
+		AND s.status <> $2
+		AND `+contentChanged("s", "t"), datasetID, SourceFileStatusUnpacked).Scan(&result.Reset)
+	if err != nil {
+		return result, fmt.Errorf("failed to count changed source files: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM source_file_slices sl
+		USING source_files s, source_files_sync t
+		WHERE sl.source_file_id = s.id
+		AND s.dataset_id = $1
+		AND t.path = s.path
+		AND `+contentChanged("s", "t"), datasetID)
+	if err != nil {
+		return result, fmt.Errorf("failed to drop slices of changed source files: %v", err)
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO source_files (dataset_id, path, size, mod_time, sha256, md5)
+		SELECT $1, path, size, mod_time, sha256, md5 FROM source_files_sync
+		ON CONFLICT (dataset_id, path) DO UPDATE SET
+			size = EXCLUDED.size,
+			mod_time = EXCLUDED.mod_time,
+			sha256 = EXCLUDED.sha256,
+			md5 = EXCLUDED.md5,
+			status = CASE WHEN `+contentChanged("source_files", "EXCLUDED")+` THEN $2 ELSE source_files.status END,
+			claimed_by = CASE WHEN `+contentChanged("source_files", "EXCLUDED")+` THEN '' ELSE source_files.claimed_by END,
+			claimed_at = CASE WHEN `+contentChanged("source_files", "EXCLUDED")+` THEN NULL ELSE source_files.claimed_at END,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE (source_files.size, source_files.mod_time, source_files.sha256, source_files.md5)
+			IS DISTINCT FROM (EXCLUDED.size, EXCLUDED.mod_time, EXCLUDED.sha256, EXCLUDED.md5)
+	`, datasetID, SourceFileStatusUnpacked)
+	if err != nil {
+		return result, fmt.Errorf("failed to upsert source files: %v", err)
+	}
+	result.Upserted, _ = res.RowsAffected()
+
+	res, err = tx.Exec(`
+		DELETE FROM source_files s
+		WHERE s.dataset_id = $1
+		AND s.status = $2
+		AND NOT EXISTS (SELECT 1 FROM source_files_sync t WHERE t.path = s.path)
+	`, datasetID, SourceFileStatusUnpacked)
+	if err != nil {
+		return result, fmt.Errorf("failed to remove source files: %v", err)
+	}
+	result.Removed, _ = res.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return result, nil
+}
+
+// ClaimSourceFiles marks unpacked files of a dataset as packing by claimedBy
+// and returns them ordered by path, until at least maxBytes are claimed or
+// the dataset runs out. maxBytes <= 0 claims every unpacked file. Rows locked
+// by a concurrent claim are skipped, so packers on different hosts never get
+// the same file. Claims older than staleAfter are considered abandoned and
+// claimed again, 0 never takes over a claim.
+func (d *Database) ClaimSourceFiles(datasetID string, maxBytes int64, claimedBy string, staleAfter time.Duration) ([]SourceFile, error) {
+	const batchSize = 1000
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var ids []int64
+	var total int64
+	lastPath := ""
+	for maxBytes <= 0 || total < maxBytes {
+		rows, err := tx.Query(`
+			SELECT id, path, size
+			FROM source_files
+			WHERE dataset_id = $1
+			AND path > $2
+			AND (status = $3 OR ($4 > 0 AND status = $5 AND claimed_at < CURRENT_TIMESTAMP - $4 * INTERVAL '1 second'))
+			ORDER BY path ASC
+			LIMIT $6
+			FOR UPDATE SKIP LOCKED
+		`, datasetID, lastPath, SourceFileStatusUnpacked, int64(staleAfter.Seconds()), SourceFileStatusPacking, batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select source files: %v", err)
+		}
+		n := 0
+		for rows.Next() {
+			var id, size int64
+			if err := rows.Scan(&id, &lastPath, &size); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan source file: %v", err)
+			}
+			n++
+			if maxBytes > 0 && total >= maxBytes {
+				continue
+			}
+			ids = append(ids, id)
+			total += size
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if n < batchSize {
+			break
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(`
+		UPDATE source_files
+		SET status = $1, claimed_by = $2, claimed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ANY($3)
+		RETURNING `+sourceFileColumns,
+		SourceFileStatusPacking, claimedBy, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim source files: %v", err)
+	}
+	var files []SourceFile
+	for rows.Next() {
+		f, err := scanSourceFile(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan source file: %v", err)
+		}
+		files = append(files, f)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// ReleaseSourceFiles hands claimed files that were not packed back to the
+// dataset
+func (d *Database) ReleaseSourceFiles(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := d.db.Exec(`
+		UPDATE source_files
+		SET status = $1, claimed_by = '', claimed_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ANY($2) AND status = $3
+	`, SourceFileStatusUnpacked, pq.Array(ids), SourceFileStatusPacking)
+	if err != nil {
+		return fmt.Errorf("failed to release source files: %v", err)
+	}
+	return nil
+}
+
+// MarkSourceFilesPacked marks claimed files as packed once every car file
+// holding them is saved. A file set back to unpacked by SyncSourceFiles in
+// the meantime stays unpacked.
+func (d *Database) MarkSourceFilesPacked(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := d.db.Exec(`
+		UPDATE source_files
+		SET status = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ANY($2) AND status = $3
+	`, SourceFileStatusPacked, pq.Array(ids), SourceFileStatusPacking)
+	if err != nil {
+		return fmt.Errorf("failed to mark source files packed: %v", err)
+	}
+	return nil
+}
+
+// SaveSourceFileSlices records slices of split files whose car file is saved,
+// so that a later claim only packs the rest of the file
+func (d *Database) SaveSourceFileSlices(slices []SourceFileSlice) error {
+	if len(slices) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(slices))
+	starts := make([]int64, len(slices))
+	ends := make([]int64, len(slices))
+	for i, sl := range slices {
+		ids[i], starts[i], ends[i] = sl.SourceFileID, sl.Start, sl.End
+	}
+	_, err := d.db.Exec(`
+		INSERT INTO source_file_slices (source_file_id, start_offset, end_offset)
+		SELECT * FROM unnest($1::BIGINT[], $2::BIGINT[], $3::BIGINT[])
+		ON CONFLICT (source_file_id, start_offset) DO UPDATE SET end_offset = EXCLUDED.end_offset
+	`, pq.Array(ids), pq.Array(starts), pq.Array(ends))
+	if err != nil {
+		return fmt.Errorf("failed to save source file slices: %v", err)
+	}
+	return nil
+}
+
+// ListSourceFileSlices returns the saved slices of the given source files,
+// keyed by source file id
+func (d *Database) ListSourceFileSlices(ids []int64) (map[int64][]SourceFileSlice, error) {
+	slices := make(map[int64][]SourceFileSlice)
+	if len(ids) == 0 {
+		return slices, nil
+	}
+	rows, err := d.db.Query(`
+		SELECT source_file_id, start_offset, end_offset
+		FROM source_file_slices
+		WHERE source_file_id = ANY($1)
+		ORDER BY source_file_id ASC, start_offset ASC
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source file slices: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sl SourceFileSlice
+		if err := rows.Scan(&sl.SourceFileID, &sl.Start, &sl.End); err != nil {
+			return nil, fmt.Errorf("failed to scan source file slice: %v", err)
+		}
+		slices[sl.SourceFileID] = append(slices[sl.SourceFileID], sl)
+	}
+	return slices, rows.Err()
+}
+
+// GetSourceFileStats returns the number of files and bytes of a dataset in
+// each status
+func (d *Database) GetSourceFileStats(datasetID string) ([]SourceFileStats, error) {
+	rows, err := d.db.Query(`
+		SELECT status, COUNT(*), COALESCE(SUM(size), 0)
+		FROM source_files
+		WHERE dataset_id = $1
+		GROUP BY status
+		ORDER BY status ASC
+	`, datasetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source file stats: %v", err)
+	}
+	defer rows.Close()
+
+	var stats []SourceFileStats
+	for rows.Next() {
+		var s SourceFileStats
+		if err := rows.Scan(&s.Status, &s.Files, &s.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan source file stats: %v", err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
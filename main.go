@@ -7,17 +7,21 @@ import (
 	"os"
 
 	clearcar "github.com/minerdao/lotus-car/cmd/clear-car"
+	"github.com/minerdao/lotus-car/cmd/dataset"
 	"github.com/minerdao/lotus-car/cmd/deal"
 	exportfile "github.com/minerdao/lotus-car/cmd/export-file"
+	exportmanifest "github.com/minerdao/lotus-car/cmd/export-manifest"
 	"github.com/minerdao/lotus-car/cmd/generate"
 	importdeal "github.com/minerdao/lotus-car/cmd/import-deal"
 	"github.com/minerdao/lotus-car/cmd/index"
 	initcfg "github.com/minerdao/lotus-car/cmd/init-cfg"
 	initdb "github.com/minerdao/lotus-car/cmd/init-db"
+	"github.com/minerdao/lotus-car/cmd/provider"
 	"github.com/minerdao/lotus-car/cmd/regenerate"
 	"github.com/minerdao/lotus-car/cmd/server"
 	updatedeal "github.com/minerdao/lotus-car/cmd/update-deal"
 	"github.com/minerdao/lotus-car/cmd/user"
+	"github.com/minerdao/lotus-car/cmd/verify"
 	"github.com/minerdao/lotus-car/version"
 	"github.com/urfave/cli/v2"
 )
@@ -40,15 +44,19 @@ func main() {
 		Commands: []*cli.Command{
 			initcfg.Command(),
 			initdb.Command(),
+			dataset.Command(),
 			index.Command(),
 			generate.Command(),
 			regenerate.Command(),
+			verify.Command(),
+			provider.Command(),
 			deal.Command(),
 			clearcar.Command(),
 			importdeal.Command(),
 			server.Command(),
 			user.Command(),
 			exportfile.Command(),
+			exportmanifest.Command(),
 			updatedeal.Command(),
 			{
 				Name:  "version",
@@ -0,0 +1,29 @@
+package market
+
+import (
+	"context"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// DealStatus is the state of a deal as reported by its storage provider
+type DealStatus struct {
+	UUID        string
+	Status      string
+	Label       string
+	PublishCid  string
+	ChainDealID int64
+}
+
+// DealBackend carries deals through their life with the storage providers:
+// deal proposes them, import-deal hands the car files over and update-deal
+// follows their state.
+type DealBackend interface {
+	DealProposer
+
+	// Import hands the car file of a proposed offline deal to its provider
+	Import(ctx context.Context, deal db.Deal, carPath string) error
+
+	// Status returns the state of a deal as reported by its provider
+	Status(ctx context.Context, deal db.Deal) (*DealStatus, error)
+}
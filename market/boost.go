@@ -0,0 +1,211 @@
+package market
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/util"
+)
+
+// BoostCLI is the DealBackend of the boost executables: deals are proposed
+// and followed with the boost client and imported with boostd. The client is
+// asked for JSON output when proposing, so changes to its human readable
+// output do not break the parsing.
+type BoostCLI struct {
+	Path       string // boost executable, "boost" when empty
+	BoostdPath string // boostd executable, "boostd" when empty
+	APIInfo    string // FULLNODE_API_INFO of the Lotus node used by boost, the environment value when empty
+}
+
+var _ DealBackend = (*BoostCLI)(nil)
+
+// Args returns the arguments boost is run with for a proposal
+func (b *BoostCLI) Args(p Proposal) []string {
+	return []string{
+		"--json",
+		"offline-deal",
+		"--provider=" + p.Provider,
+		"--commp=" + p.PieceCid,
+		"--piece-size=" + strconv.FormatUint(p.PieceSize, 10),
+		"--wallet=" + p.Wallet,
+		"--payload-cid=" + p.PayloadCid,
+		"--verified=" + strconv.FormatBool(p.Verified),
+		"--duration=" + strconv.FormatInt(p.Duration, 10),
+		"--storage-price=" + strconv.FormatInt(p.StoragePrice, 10),
+		"--start-epoch=" + strconv.FormatInt(p.StartEpoch, 10),
+	}
+}
+
+// Propose runs boost offline-deal without a shell, so no argument is ever
+// interpreted by one
+func (b *BoostCLI) Propose(ctx context.Context, p Proposal) (*db.Deal, error) {
+	out, err := b.run(ctx, b.Path, "boost", b.Args(p))
+	if err != nil {
+		return nil, err
+	}
+	return ParseProposeOutput(out)
+}
+
+// Import runs boostd import-data, which needs access to the boostd repo of
+// the provider
+func (b *BoostCLI) Import(ctx context.Context, deal db.Deal, carPath string) error {
+	_, err := b.run(ctx, b.BoostdPath, "boostd", []string{"import-data", deal.UUID, carPath})
+	return err
+}
+
+// Status runs boost deal-status with the wallet the deal was sent from
+func (b *BoostCLI) Status(ctx context.Context, deal db.Deal) (*DealStatus, error) {
+	out, err := b.run(ctx, b.Path, "boost", []string{
+		"deal-status",
+		"--provider=" + deal.StorageProvider,
+		"--deal-uuid=" + deal.UUID,
+		"--wallet=" + deal.ClientWallet,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseStatusOutput(out)
+}
+
+func (b *BoostCLI) run(ctx context.Context, path, defaultPath string, args []string) (string, error) {
+	if path == "" {
+		path = defaultPath
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = os.Environ()
+	if b.APIInfo != "" {
+		cmd.Env = append(cmd.Env, "FULLNODE_API_INFO="+b.APIInfo)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s failed: %v, stderr: %s", path, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// ParseProposeOutput parses the output of boost offline-deal, the JSON output
+// of --json and the text output of older clients that ignore it
+func ParseProposeOutput(out string) (*db.Deal, error) {
+	out = strings.TrimSpace(out)
+	if !strings.HasPrefix(out, "{") {
+		return util.ParseDealResponse(out)
+	}
+
+	// Numbers are kept as written instead of being formatted as floats
+	var resp map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(out))
+	dec.UseNumber()
+	if err := dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to parse deal response: %v", err)
+	}
+	field := func(key string) string {
+		if v, ok := resp[key]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+	deal := &db.Deal{
+		UUID:            field("dealUuid"),
+		StorageProvider: field("provider"),
+		ClientWallet:    field("clientWallet"),
+		PayloadCid:      field("payloadCid"),
+		CommP:           field("commp"),
+		Status:          "proposed",
+	}
+	if deal.UUID == "" {
+		return nil, fmt.Errorf("deal UUID not found in response")
+	}
+
+	var err error
+	if v := field("startEpoch"); v != "" {
+		if deal.StartEpoch, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse start epoch: %v", err)
+		}
+	}
+	if v := field("endEpoch"); v != "" {
+		if deal.EndEpoch, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse end epoch: %v", err)
+		}
+	}
+	if v := field("providerCollateral"); v != "" {
+		if deal.ProviderCollateral, err = parseCollateral(v); err != nil {
+			return nil, fmt.Errorf("failed to parse provider collateral: %v", err)
+		}
+	}
+	return deal, nil
+}
+
+// ParseStatusOutput parses the output of boost deal-status
+func ParseStatusOutput(out string) (*DealStatus, error) {
+	status := &DealStatus{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "deal uuid":
+			status.UUID = value
+		case "deal status":
+			status.Status = value
+		case "deal label":
+			status.Label = value
+		case "publish cid":
+			status.PublishCid = value
+		case "chain deal id":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse chain deal id: %w", err)
+			}
+			status.ChainDealID = id
+		}
+	}
+	if status.Status == "" {
+		return nil, fmt.Errorf("deal status not found in response")
+	}
+	return status, nil
+}
+
+// parseCollateral returns a collateral in mFIL, as saved in the deals table.
+// A bare number is in attoFIL, otherwise the unit follows the number.
+func parseCollateral(v string) (float64, error) {
+	parts := strings.Fields(v)
+	if len(parts) == 0 {
+		return 0, fmt.Errorf("empty collateral")
+	}
+	amount, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) == 1 {
+		return amount / 1e15, nil
+	}
+	switch parts[1] {
+	case "FIL":
+		return amount * 1e3, nil
+	case "mFIL":
+		return amount, nil
+	case "μFIL", "uFIL":
+		return amount / 1e3, nil
+	case "nFIL":
+		return amount / 1e6, nil
+	case "pFIL":
+		return amount / 1e9, nil
+	case "fFIL":
+		return amount / 1e12, nil
+	case "aFIL", "attoFIL":
+		return amount / 1e15, nil
+	}
+	return 0, fmt.Errorf("unknown unit %q", parts[1])
+}
@@ -0,0 +1,152 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// fakeBoost writes a boost executable that records its arguments and
+// environment and prints out
+func fakeBoost(t *testing.T, out string) (path, argsFile string) {
+	dir := t.TempDir()
+	path = filepath.Join(dir, "boost")
+	argsFile = filepath.Join(dir, "args")
+	script := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > " + argsFile + "\necho \"$FULLNODE_API_INFO\" >> " + argsFile + "\ncat <<'EOF'\n" + out + "\nEOF\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path, argsFile
+}
+
+func TestBoostCLIPropose(t *testing.T) {
+	p := Proposal{
+		Provider:   "f01234",
+		Wallet:     "f1client",
+		PieceCid:   "baga6ea4seaqpiece",
+		PieceSize:  32 << 30,
+		PayloadCid: "bafyroot",
+		StartEpoch: 4000000,
+		Duration:   1000,
+		Verified:   true,
+	}
+
+	jsonOut := `{"dealUuid":"c8a5ae0e-6f2a-4bd0-9f70-46c9f1cd4c2f","provider":"f01234","clientWallet":"f1client","payloadCid":"bafyroot","commp":"baga6ea4seaqpiece","startEpoch":4000000,"endEpoch":"4001000","providerCollateral":"2500000000000000"}`
+	textOut := `sent deal proposal
+  deal uuid: c8a5ae0e-6f2a-4bd0-9f70-46c9f1cd4c2f
+  storage provider: f01234
+  client wallet: f1client
+  payload cid: bafyroot
+  commp: baga6ea4seaqpiece
+  start epoch: 4000000
+  end epoch: 4001000
+  provider collateral: 2.5 mFIL`
+
+	for name, out := range map[string]string{"json": jsonOut, "text": textOut} {
+		path, argsFile := fakeBoost(t, out)
+		b := &BoostCLI{Path: path, APIInfo: "https://api.node.glif.io"}
+		deal, err := b.Propose(context.Background(), p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if deal.UUID != "c8a5ae0e-6f2a-4bd0-9f70-46c9f1cd4c2f" || deal.StorageProvider != "f01234" ||
+			deal.StartEpoch != 4000000 || deal.EndEpoch != 4001000 || deal.ProviderCollateral != 2.5 || deal.Status != "proposed" {
+			t.Fatalf("%s: parsed %+v", name, deal)
+		}
+
+		args, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(b.Args(p), "https://api.node.glif.io")
+		if got := strings.Split(strings.TrimSpace(string(args)), "\n"); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("%s: boost ran with %q, want %q", name, got, want)
+		}
+	}
+
+	path, _ := fakeBoost(t, "failed to connect")
+	if _, err := (&BoostCLI{Path: path}).Propose(context.Background(), p); err == nil {
+		t.Fatalf("expected output without a deal uuid to fail")
+	}
+}
+
+func TestFakeProposer(t *testing.T) {
+	rejected := errors.New("no capacity")
+	f := &FakeProposer{Reject: map[string]error{"f02": rejected}}
+	deal, err := f.Propose(context.Background(), Proposal{Provider: "f01", PieceCid: "piece", StartEpoch: 10, Duration: 5})
+	if err != nil || deal.UUID == "" || deal.StorageProvider != "f01" || deal.EndEpoch != 15 {
+		t.Fatalf("unexpected deal %+v, %v", deal, err)
+	}
+	if _, err := f.Propose(context.Background(), Proposal{Provider: "f02"}); err != rejected {
+		t.Fatalf("expected the proposal to be rejected, got %v", err)
+	}
+	if n := len(f.Proposals()); n != 2 {
+		t.Fatalf("recorded %d proposals, want 2", n)
+	}
+}
+
+func TestBoostCLIStatus(t *testing.T) {
+	path, argsFile := fakeBoost(t, `got deal status response
+  deal uuid: c8a5ae0e-6f2a-4bd0-9f70-46c9f1cd4c2f
+  deal status: Sealing: Proving
+  deal label: bafyroot
+  publish cid: bafypublish
+  chain deal id: 123456`)
+	b := &BoostCLI{Path: path}
+	d := db.Deal{UUID: "c8a5ae0e-6f2a-4bd0-9f70-46c9f1cd4c2f", StorageProvider: "f01234", ClientWallet: "f1client"}
+	status, err := b.Status(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "Sealing: Proving" || status.PublishCid != "bafypublish" || status.ChainDealID != 123456 {
+		t.Fatalf("parsed %+v", status)
+	}
+	args, _ := os.ReadFile(argsFile)
+	if !strings.HasPrefix(string(args), "deal-status\n--provider=f01234\n--deal-uuid="+d.UUID+"\n--wallet=f1client\n") {
+		t.Fatalf("boost ran with %q", args)
+	}
+}
+
+func TestFakeBackend(t *testing.T) {
+	ctx := context.Background()
+	car := filepath.Join(t.TempDir(), "piece.car")
+	if err := os.WriteFile(car, []byte("car"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &FakeBackend{
+		RejectImport: map[string]error{"f02": errors.New("boostd is down")},
+		Script:       []string{"Sealing: PreCommit1", "Sealing: Proving"},
+	}
+	d, err := f.Propose(ctx, Proposal{Provider: "f01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStatus := func(want string) {
+		t.Helper()
+		status, err := f.Status(ctx, *d)
+		if err != nil || status.Status != want {
+			t.Fatalf("status %+v, %v, want %q", status, err, want)
+		}
+	}
+	wantStatus(StatusAwaitingImport)
+	if err := f.Import(ctx, *d, car); err != nil {
+		t.Fatal(err)
+	}
+	wantStatus("Sealing: PreCommit1")
+	wantStatus("Sealing: Proving")
+	wantStatus("Sealing: Proving")
+
+	rejected, _ := f.Propose(ctx, Proposal{Provider: "f02"})
+	if err := f.Import(ctx, *rejected, car); err == nil {
+		t.Fatalf("expected the import to be rejected")
+	}
+	if _, err := f.Status(ctx, db.Deal{UUID: "unknown"}); err == nil {
+		t.Fatalf("expected an unknown deal to fail")
+	}
+}
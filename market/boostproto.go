@@ -0,0 +1,39 @@
+package market
+
+import (
+	markettypes "github.com/filecoin-project/go-state-types/builtin/v15/market"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+//go:generate go run ./gen
+
+// DealProtocolID is the libp2p protocol boost providers accept deal proposals
+// on
+const DealProtocolID = "/fil/storage/mk/1.2.0"
+
+// DealParams is the message sent to a provider over DealProtocolID. It has
+// the fields and CBOR encoding of DealParams in boost storagemarket/types.
+type DealParams struct {
+	DealUUID           uuid.UUID
+	IsOffline          bool
+	ClientDealProposal markettypes.ClientDealProposal
+	DealDataRoot       cid.Cid
+	Transfer           Transfer // zero for offline deals
+	RemoveUnsealedCopy bool
+	SkipIPNIAnnounce   bool
+}
+
+// Transfer tells the provider how to fetch the data of an online deal
+type Transfer struct {
+	Type     string
+	ClientID string
+	Params   []byte
+	Size     uint64
+}
+
+// DealResponse is the answer of the provider to DealParams
+type DealResponse struct {
+	Accepted bool
+	Message  string // why the deal was rejected
+}
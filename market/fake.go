@@ -0,0 +1,150 @@
+package market
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/minerdao/lotus-car/db"
+)
+
+// FakeProposer accepts proposals without any network, for tests. Every
+// proposal is recorded, proposals to a provider listed in Reject fail with
+// the given error.
+type FakeProposer struct {
+	Reject map[string]error
+
+	mu        sync.Mutex
+	proposals []Proposal
+	deals     map[string]db.Deal
+}
+
+var _ DealProposer = (*FakeProposer)(nil)
+
+func (f *FakeProposer) Propose(ctx context.Context, p Proposal) (*db.Deal, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.proposals = append(f.proposals, p)
+	if err := f.Reject[p.Provider]; err != nil {
+		return nil, err
+	}
+	deal := db.Deal{
+		UUID:            uuid.New().String(),
+		StorageProvider: p.Provider,
+		ClientWallet:    p.Wallet,
+		PayloadCid:      p.PayloadCid,
+		CommP:           p.PieceCid,
+		StartEpoch:      p.StartEpoch,
+		EndEpoch:        p.StartEpoch + p.Duration,
+		Status:          "proposed",
+	}
+	if f.deals == nil {
+		f.deals = make(map[string]db.Deal)
+	}
+	f.deals[deal.UUID] = deal
+	return &deal, nil
+}
+
+// Proposals returns the proposals received so far, accepted or not
+func (f *FakeProposer) Proposals() []Proposal {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Proposal(nil), f.proposals...)
+}
+
+// deal returns a deal accepted by Propose
+func (f *FakeProposer) deal(uuid string) (db.Deal, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deal, ok := f.deals[uuid]
+	return deal, ok
+}
+
+// StatusAwaitingImport is the status FakeBackend reports for a deal whose car
+// file was not imported yet
+const StatusAwaitingImport = "Awaiting Offline Data Import"
+
+// FakeBackend is a scripted DealBackend without any network, for tests.
+// Proposals are handled as by FakeProposer. Import records the car file of a
+// deal, imports to a provider listed in RejectImport fail with the given
+// error. Once a deal is imported, every Status call moves it one step along
+// Script, where it stays on the last step. Status fails for deals the backend
+// did not accept.
+type FakeBackend struct {
+	FakeProposer
+	RejectImport map[string]error
+	Script       []string // "Sealing: Proving" when empty
+
+	mu      sync.Mutex
+	imports map[string]string
+	steps   map[string]int
+}
+
+var _ DealBackend = (*FakeBackend)(nil)
+
+func (f *FakeBackend) Import(ctx context.Context, deal db.Deal, carPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, ok := f.deal(deal.UUID); !ok {
+		return fmt.Errorf("unknown deal %s", deal.UUID)
+	}
+	if err := f.RejectImport[deal.StorageProvider]; err != nil {
+		return err
+	}
+	if _, err := os.Stat(carPath); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.imports == nil {
+		f.imports = make(map[string]string)
+	}
+	f.imports[deal.UUID] = carPath
+	return nil
+}
+
+func (f *FakeBackend) Status(ctx context.Context, deal db.Deal) (*DealStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := f.deal(deal.UUID); !ok {
+		return nil, fmt.Errorf("unknown deal %s", deal.UUID)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := &DealStatus{UUID: deal.UUID, Status: StatusAwaitingImport}
+	if _, ok := f.imports[deal.UUID]; !ok {
+		return status, nil
+	}
+	script := f.Script
+	if len(script) == 0 {
+		script = []string{"Sealing: Proving"}
+	}
+	if f.steps == nil {
+		f.steps = make(map[string]int)
+	}
+	step := f.steps[deal.UUID]
+	if step >= len(script) {
+		step = len(script) - 1
+	}
+	f.steps[deal.UUID] = step + 1
+	status.Status = script[step]
+	return status, nil
+}
+
+// Imports returns the car file imported for every deal, keyed by deal UUID
+func (f *FakeBackend) Imports() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	imports := make(map[string]string, len(f.imports))
+	for k, v := range f.imports {
+		imports[k] = v
+	}
+	return imports
+}
@@ -0,0 +1,22 @@
+// Command gen writes the CBOR encoders of the boost deal protocol messages
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/minerdao/lotus-car/market"
+	gen "github.com/whyrusleeping/cbor-gen"
+)
+
+func main() {
+	err := gen.WriteMapEncodersToFile("./cbor_gen.go", "market",
+		market.DealParams{},
+		market.Transfer{},
+		market.DealResponse{},
+	)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,165 @@
+package market
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// infoWithToken matches an API info starting with a JWT, as parsed by Lotus
+var infoWithToken = regexp.MustCompile(`^[a-zA-Z0-9\-_]+?\.[a-zA-Z0-9\-_]+?\.([a-zA-Z0-9\-_]+)?:.+$`)
+
+// LotusClient calls the few methods of the Lotus full node JSON-RPC API the
+// native deal proposer needs
+type LotusClient struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// NewLotusClient parses an API info in the FULLNODE_API_INFO format, either
+// token:/ip4/127.0.0.1/tcp/1234/http or an http(s) URL with an optional
+// token: prefix
+func NewLotusClient(apiInfo string) (*LotusClient, error) {
+	c := &LotusClient{Client: http.DefaultClient}
+	addr := apiInfo
+	if infoWithToken.MatchString(apiInfo) {
+		sp := strings.SplitN(apiInfo, ":", 2)
+		c.Token, addr = sp[0], sp[1]
+	}
+
+	if strings.HasPrefix(addr, "/") {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API address %s: %v", addr, err)
+		}
+		scheme := "http"
+		if _, err := ma.ValueForProtocol(multiaddr.P_HTTPS); err == nil {
+			scheme = "https"
+		}
+		_, hostport, err := manet.DialArgs(ma)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API address %s: %v", addr, err)
+		}
+		c.URL = scheme + "://" + hostport + "/rpc/v1"
+		return c, nil
+	}
+
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return nil, fmt.Errorf("invalid API address %s", addr)
+	}
+	c.URL = strings.TrimSuffix(addr, "/")
+	if !strings.Contains(strings.TrimPrefix(strings.TrimPrefix(c.URL, "http://"), "https://"), "/") {
+		c.URL += "/rpc/v1"
+	}
+	return c, nil
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// call runs a JSON-RPC method and decodes its result into result
+func (c *LotusClient) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %s", method, resp.Status)
+	}
+
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", method, err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("%s failed: %s", method, rpcResp.Error.Message)
+	}
+	if err := json.Unmarshal(rpcResp.Result, result); err != nil {
+		return fmt.Errorf("failed to decode %s result: %v", method, err)
+	}
+	return nil
+}
+
+// MinerInfo is the part of StateMinerInfo needed to reach a provider
+type MinerInfo struct {
+	PeerId     *string
+	Multiaddrs [][]byte
+}
+
+// StateMinerInfo returns the peer info a provider published on chain
+func (c *LotusClient) StateMinerInfo(ctx context.Context, provider address.Address) (*MinerInfo, error) {
+	var info MinerInfo
+	if err := c.call(ctx, "Filecoin.StateMinerInfo", &info, provider, nil); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CollateralBounds is the range of provider collateral accepted for a deal
+type CollateralBounds struct {
+	Min big.Int
+	Max big.Int
+}
+
+// StateDealProviderCollateralBounds returns the provider collateral bounds of
+// a deal of size bytes
+func (c *LotusClient) StateDealProviderCollateralBounds(ctx context.Context, size abi.PaddedPieceSize, verified bool) (*CollateralBounds, error) {
+	var bounds CollateralBounds
+	if err := c.call(ctx, "Filecoin.StateDealProviderCollateralBounds", &bounds, size, verified, nil); err != nil {
+		return nil, err
+	}
+	return &bounds, nil
+}
+
+// WalletSign signs msg with a wallet of the node
+func (c *LotusClient) WalletSign(ctx context.Context, wallet address.Address, msg []byte) (*crypto.Signature, error) {
+	var sig struct {
+		Type crypto.SigType
+		Data []byte
+	}
+	if err := c.call(ctx, "Filecoin.WalletSign", &sig, wallet, msg); err != nil {
+		return nil, err
+	}
+	return &crypto.Signature{Type: sig.Type, Data: sig.Data}, nil
+}
@@ -0,0 +1,203 @@
+package market
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	mathbig "math/big"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	markettypes "github.com/filecoin-project/go-state-types/builtin/v15/market"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// streamTimeout bounds the exchange of a proposal with a provider
+const streamTimeout = time.Minute
+
+// NativeProposer proposes offline deals straight to boost providers over
+// libp2p with DealProtocolID, without the boost client. The peer info and
+// collateral bounds of a provider are read from a Lotus node, which also
+// signs the proposals, so the client wallet must be in that node.
+type NativeProposer struct {
+	node *LotusClient
+	host host.Host
+}
+
+var _ DealProposer = (*NativeProposer)(nil)
+
+// NewNativeProposer starts a libp2p host used to reach the providers. apiInfo
+// is the Lotus API in the FULLNODE_API_INFO format, with a token allowed to
+// sign.
+func NewNativeProposer(apiInfo string) (*NativeProposer, error) {
+	node, err := NewLotusClient(apiInfo)
+	if err != nil {
+		return nil, err
+	}
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start libp2p host: %v", err)
+	}
+	return &NativeProposer{node: node, host: h}, nil
+}
+
+// Close stops the libp2p host
+func (n *NativeProposer) Close() error {
+	return n.host.Close()
+}
+
+func (n *NativeProposer) Propose(ctx context.Context, p Proposal) (*db.Deal, error) {
+	provider, err := address.NewFromString(p.Provider)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provider %s: %v", p.Provider, err)
+	}
+	client, err := address.NewFromString(p.Wallet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wallet %s: %v", p.Wallet, err)
+	}
+	pieceCid, err := cid.Parse(p.PieceCid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid piece CID %s: %v", p.PieceCid, err)
+	}
+	payloadCid, err := cid.Parse(p.PayloadCid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload CID %s: %v", p.PayloadCid, err)
+	}
+
+	proposal, err := n.dealProposal(ctx, p, provider, client, pieceCid, payloadCid)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := proposal.MarshalCBOR(buf); err != nil {
+		return nil, fmt.Errorf("failed to serialize deal proposal: %v", err)
+	}
+	sig, err := n.node.WalletSign(ctx, client, buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign deal proposal: %v", err)
+	}
+
+	params := DealParams{
+		DealUUID:  uuid.New(),
+		IsOffline: true,
+		ClientDealProposal: markettypes.ClientDealProposal{
+			Proposal:        *proposal,
+			ClientSignature: *sig,
+		},
+		DealDataRoot: payloadCid,
+	}
+	resp, err := n.send(ctx, provider, &params)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Accepted {
+		return nil, fmt.Errorf("deal proposal rejected by %s: %s", p.Provider, resp.Message)
+	}
+
+	collateral, _ := new(mathbig.Float).SetInt(proposal.ProviderCollateral.Int).Float64()
+	return &db.Deal{
+		UUID:               params.DealUUID.String(),
+		StorageProvider:    p.Provider,
+		ClientWallet:       p.Wallet,
+		PayloadCid:         p.PayloadCid,
+		CommP:              p.PieceCid,
+		StartEpoch:         int64(proposal.StartEpoch),
+		EndEpoch:           int64(proposal.EndEpoch),
+		ProviderCollateral: collateral / 1e15,
+		Status:             "proposed",
+	}, nil
+}
+
+// dealProposal fills the deal terms the way the boost client does: the price
+// is per GiB and the provider collateral is 20% above the minimum, so small
+// fluctuations do not fail the deal
+func (n *NativeProposer) dealProposal(ctx context.Context, p Proposal, provider, client address.Address, pieceCid, payloadCid cid.Cid) (*markettypes.DealProposal, error) {
+	pieceSize := abi.PaddedPieceSize(p.PieceSize)
+	if err := pieceSize.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid piece size %d: %v", p.PieceSize, err)
+	}
+	bounds, err := n.node.StateDealProviderCollateralBounds(ctx, pieceSize, p.Verified)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get collateral bounds: %v", err)
+	}
+	label, err := markettypes.NewLabelFromString(payloadCid.String())
+	if err != nil {
+		return nil, err
+	}
+
+	price := big.Div(big.Mul(big.NewInt(p.StoragePrice), big.NewIntUnsigned(p.PieceSize)), big.NewInt(1<<30))
+	return &markettypes.DealProposal{
+		PieceCID:             pieceCid,
+		PieceSize:            pieceSize,
+		VerifiedDeal:         p.Verified,
+		Client:               client,
+		Provider:             provider,
+		Label:                label,
+		StartEpoch:           abi.ChainEpoch(p.StartEpoch),
+		EndEpoch:             abi.ChainEpoch(p.StartEpoch + p.Duration),
+		StoragePricePerEpoch: price,
+		ProviderCollateral:   big.Div(big.Mul(bounds.Min, big.NewInt(6)), big.NewInt(5)),
+		ClientCollateral:     big.Zero(),
+	}, nil
+}
+
+// send connects to the provider with the addresses it published on chain and
+// exchanges the deal params for its response
+func (n *NativeProposer) send(ctx context.Context, provider address.Address, params *DealParams) (*DealResponse, error) {
+	info, err := n.node.StateMinerInfo(ctx, provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get miner info of %s: %v", provider, err)
+	}
+	if info.PeerId == nil {
+		return nil, fmt.Errorf("%s has no peer ID on chain", provider)
+	}
+	pid, err := peer.Decode(*info.PeerId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID of %s: %v", provider, err)
+	}
+	addrInfo := peer.AddrInfo{ID: pid}
+	for _, b := range info.Multiaddrs {
+		ma, err := multiaddr.NewMultiaddrBytes(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiaddr of %s: %v", provider, err)
+		}
+		addrInfo.Addrs = append(addrInfo.Addrs, ma)
+	}
+	if len(addrInfo.Addrs) == 0 {
+		return nil, fmt.Errorf("%s has no multiaddrs on chain", provider)
+	}
+
+	if err := n.host.Connect(ctx, addrInfo); err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", provider, err)
+	}
+	s, err := n.host.NewStream(ctx, pid, DealProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open deal stream to %s: %v", provider, err)
+	}
+	defer s.Close()
+
+	deadline := time.Now().Add(streamTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	s.SetDeadline(deadline)
+
+	if err := params.MarshalCBOR(s); err != nil {
+		return nil, fmt.Errorf("failed to send deal params to %s: %v", provider, err)
+	}
+	var resp DealResponse
+	if err := resp.UnmarshalCBOR(bufio.NewReader(s)); err != nil {
+		return nil, fmt.Errorf("failed to read deal response from %s: %v", provider, err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,183 @@
+package market
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/multiformats/go-multihash"
+)
+
+// fakeProvider starts a libp2p host answering DealProtocolID with accept, and
+// records the params it receives
+func fakeProvider(t *testing.T, accept bool) (host.Host, chan DealParams) {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	received := make(chan DealParams, 1)
+	h.SetStreamHandler(DealProtocolID, func(s network.Stream) {
+		defer s.Close()
+		var params DealParams
+		if err := params.UnmarshalCBOR(bufio.NewReader(s)); err != nil {
+			t.Errorf("failed to read deal params: %v", err)
+			return
+		}
+		received <- params
+		resp := DealResponse{Accepted: accept}
+		if !accept {
+			resp.Message = "no space left"
+		}
+		if err := resp.MarshalCBOR(s); err != nil {
+			t.Errorf("failed to write deal response: %v", err)
+		}
+	})
+	return h, received
+}
+
+// fakeLotus serves the Lotus API methods used by NativeProposer, reporting
+// provider as the peer of every miner
+func fakeLotus(t *testing.T, provider host.Host) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token.of.test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req rpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid request: %v", err)
+			return
+		}
+		var result interface{}
+		switch req.Method {
+		case "Filecoin.StateMinerInfo":
+			pid := provider.ID().String()
+			var addrs [][]byte
+			for _, a := range provider.Addrs() {
+				addrs = append(addrs, a.Bytes())
+			}
+			result = map[string]interface{}{"PeerId": pid, "Multiaddrs": addrs}
+		case "Filecoin.StateDealProviderCollateralBounds":
+			result = map[string]string{"Min": "1000", "Max": "5000"}
+		case "Filecoin.WalletSign":
+			result = map[string]interface{}{"Type": crypto.SigTypeSecp256k1, "Data": []byte("signature")}
+		default:
+			t.Errorf("unexpected method %s", req.Method)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testProposal(t *testing.T) Proposal {
+	pieceCid, err := commcid.DataCommitmentV1ToCID(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh, err := multihash.Sum([]byte("payload"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Proposal{
+		Provider:     "f01234",
+		Wallet:       "f01000",
+		PieceCid:     pieceCid.String(),
+		PieceSize:    32 << 30,
+		PayloadCid:   cid.NewCidV1(cid.DagProtobuf, mh).String(),
+		StartEpoch:   4000000,
+		Duration:     1000,
+		Verified:     true,
+		StoragePrice: 2,
+	}
+}
+
+func TestNativeProposerPropose(t *testing.T) {
+	provider, received := fakeProvider(t, true)
+	lotus := fakeLotus(t, provider)
+
+	n, err := NewNativeProposer("token.of.test:" + lotus.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	p := testProposal(t)
+	deal, err := n.Propose(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := <-received
+
+	if deal.UUID != params.DealUUID.String() || deal.Status != "proposed" {
+		t.Fatalf("unexpected deal %+v for params %s", deal, params.DealUUID)
+	}
+	if deal.StartEpoch != 4000000 || deal.EndEpoch != 4001000 || deal.StorageProvider != "f01234" {
+		t.Fatalf("unexpected deal terms %+v", deal)
+	}
+	if !params.IsOffline || params.DealDataRoot.String() != p.PayloadCid {
+		t.Fatalf("expected an offline deal of %s, got %+v", p.PayloadCid, params)
+	}
+	prop := params.ClientDealProposal.Proposal
+	if prop.PieceCID.String() != p.PieceCid || uint64(prop.PieceSize) != p.PieceSize || !prop.VerifiedDeal {
+		t.Fatalf("unexpected proposal %+v", prop)
+	}
+	if prop.Provider.String() != "f01234" || prop.Client.String() != "f01000" {
+		t.Fatalf("unexpected parties %s and %s", prop.Client, prop.Provider)
+	}
+	if label, _ := prop.Label.ToString(); label != p.PayloadCid {
+		t.Fatalf("unexpected label %q", label)
+	}
+	// 2 attoFIL per GiB for 32 GiB, collateral 20% above the minimum
+	if prop.StoragePricePerEpoch.Int64() != 64 || prop.ProviderCollateral.Int64() != 1200 {
+		t.Fatalf("unexpected price %s or collateral %s", prop.StoragePricePerEpoch, prop.ProviderCollateral)
+	}
+	if string(params.ClientDealProposal.ClientSignature.Data) != "signature" {
+		t.Fatalf("proposal is not signed by the node")
+	}
+}
+
+func TestNativeProposerRejected(t *testing.T) {
+	provider, _ := fakeProvider(t, false)
+	lotus := fakeLotus(t, provider)
+
+	n, err := NewNativeProposer("token.of.test:" + lotus.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	_, err = n.Propose(context.Background(), testProposal(t))
+	if err == nil || !strings.Contains(err.Error(), "no space left") {
+		t.Fatalf("expected the rejection message, got %v", err)
+	}
+}
+
+func TestNewLotusClient(t *testing.T) {
+	for info, url := range map[string]string{
+		"https://api.node.glif.io":                   "https://api.node.glif.io/rpc/v1",
+		"https://api.node.glif.io/rpc/v0":            "https://api.node.glif.io/rpc/v0",
+		"eyJh.eyJB.sig:/ip4/127.0.0.1/tcp/1234/http": "http://127.0.0.1:1234/rpc/v1",
+		"eyJh.eyJB.sig:https://example.com/rpc/v1":   "https://example.com/rpc/v1",
+	} {
+		c, err := NewLotusClient(info)
+		if err != nil {
+			t.Fatalf("%s: %v", info, err)
+		}
+		if c.URL != url {
+			t.Fatalf("%s: expected %s, got %s", info, url, c.URL)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package market talks to storage providers on behalf of the client: it
+// proposes storage deals for the pieces of the car files.
+package market
+
+import (
+	"context"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// Proposal holds the terms of a storage deal for one piece
+type Proposal struct {
+	Provider     string // storage provider ID, such as f01234
+	Wallet       string // client wallet address
+	PieceCid     string
+	PieceSize    uint64
+	PayloadCid   string
+	StartEpoch   int64
+	Duration     int64 // in epochs
+	Verified     bool
+	StoragePrice int64 // attoFIL per GiB per epoch
+}
+
+// DealProposer sends deal proposals to storage providers. Propose returns the
+// deal accepted by the provider with the status "proposed", an error means
+// the provider did not accept the deal.
+type DealProposer interface {
+	Propose(ctx context.Context, p Proposal) (*db.Deal, error)
+}
@@ -0,0 +1,75 @@
+package market
+
+import (
+	"fmt"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// MinFailureAttempts is the number of recent attempts a provider needs before
+// its failure rate is held against it, so a single rejection does not stop it
+const MinFailureAttempts = 5
+
+// Quotas turns registered providers into the quotas of a run of deals sent
+// from wallet. Each provider gets what is left of its daily deals and bytes in
+// flight after its recent usage. Paused providers, providers that do not
+// accept the wallet, providers failing more often than they allow and
+// providers without anything left are skipped, with the reason keyed by miner
+// ID. When only is not empty, just the providers it lists are used, each
+// capped by its quota there, and all of them must be registered.
+func Quotas(providers []db.Provider, usage map[string]db.ProviderUsage, wallet string, only []ProviderQuota) ([]ProviderQuota, map[string]string, error) {
+	registered := make(map[string]db.Provider, len(providers))
+	for _, p := range providers {
+		registered[p.MinerID] = p
+	}
+	candidates := only
+	if len(candidates) == 0 {
+		for _, p := range providers {
+			candidates = append(candidates, ProviderQuota{Provider: p.MinerID})
+		}
+	}
+
+	var quotas []ProviderQuota
+	skipped := make(map[string]string)
+	for _, c := range candidates {
+		p, ok := registered[c.Provider]
+		if !ok {
+			return nil, nil, fmt.Errorf("provider %s is not registered, add it with provider add", c.Provider)
+		}
+		u := usage[p.MinerID]
+		q := ProviderQuota{Provider: p.MinerID, Quota: c.Quota}
+
+		switch {
+		case p.State != db.ProviderStateEnabled:
+			skipped[p.MinerID] = fmt.Sprintf("provider is %s", p.State)
+			continue
+		case !p.AllowsWallet(wallet):
+			skipped[p.MinerID] = fmt.Sprintf("wallet %s is not allowed", wallet)
+			continue
+		case p.MaxFailureRate > 0 && u.Attempts >= MinFailureAttempts && u.FailureRate() > p.MaxFailureRate:
+			skipped[p.MinerID] = fmt.Sprintf("failure rate %.2f is above %.2f", u.FailureRate(), p.MaxFailureRate)
+			continue
+		}
+
+		if p.MaxDealsPerDay > 0 {
+			left := p.MaxDealsPerDay - u.Deals
+			if left <= 0 {
+				skipped[p.MinerID] = fmt.Sprintf("took %d deals in the last day, the limit is %d", u.Deals, p.MaxDealsPerDay)
+				continue
+			}
+			if q.Quota == 0 || left < q.Quota {
+				q.Quota = left
+			}
+		}
+		if p.MaxBytesInFlight > 0 {
+			left := p.MaxBytesInFlight - u.BytesInFlight
+			if left <= 0 {
+				skipped[p.MinerID] = fmt.Sprintf("%d bytes in flight, the limit is %d", u.BytesInFlight, p.MaxBytesInFlight)
+				continue
+			}
+			q.Bytes = left
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, skipped, nil
+}
@@ -0,0 +1,120 @@
+package market
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProviderQuota is a storage provider replicas are sent to, with the number
+// of deals and piece bytes it may take in one run
+type ProviderQuota struct {
+	Provider string
+	Quota    int   // 0 for no limit
+	Bytes    int64 // 0 for no limit
+}
+
+// ParseProviders parses provider specs of the form "f01234" or "f01234:100",
+// where the number after the colon is the quota of the provider
+func ParseProviders(specs []string) ([]ProviderQuota, error) {
+	var providers []ProviderQuota
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		for _, s := range strings.Split(spec, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			p := ProviderQuota{Provider: s}
+			if i := strings.IndexByte(s, ':'); i >= 0 {
+				quota, err := strconv.Atoi(s[i+1:])
+				if err != nil || quota < 0 {
+					return nil, fmt.Errorf("invalid quota in provider %q", s)
+				}
+				p.Provider, p.Quota = s[:i], quota
+			}
+			if p.Provider == "" {
+				return nil, fmt.Errorf("missing provider ID in %q", s)
+			}
+			if seen[p.Provider] {
+				return nil, fmt.Errorf("provider %s is listed twice", p.Provider)
+			}
+			seen[p.Provider] = true
+			providers = append(providers, p)
+		}
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no storage provider given")
+	}
+	return providers, nil
+}
+
+// Replicator spreads the replicas of the pieces over providers. Each replica
+// of a piece goes to a different provider, the one that took the fewest deals
+// in this run so far, in the order the providers were given on a tie. A
+// provider is not picked anymore once it used its quota, nor for a piece that
+// does not fit in the bytes it has left.
+type Replicator struct {
+	providers []ProviderQuota
+	sent      map[string]int
+	bytes     map[string]int64
+	dropped   map[string]bool
+}
+
+func NewReplicator(providers []ProviderQuota) *Replicator {
+	return &Replicator{
+		providers: providers,
+		sent:      make(map[string]int),
+		bytes:     make(map[string]int64),
+		dropped:   make(map[string]bool),
+	}
+}
+
+// Next returns the provider for another replica of a piece of pieceSize bytes
+// already held by the providers in holding, "" when no provider is left for
+// the piece
+func (r *Replicator) Next(holding []string, pieceSize uint64) string {
+	held := make(map[string]bool, len(holding))
+	for _, p := range holding {
+		held[p] = true
+	}
+	best := ""
+	for _, p := range r.providers {
+		if held[p.Provider] || r.dropped[p.Provider] || (p.Quota > 0 && r.sent[p.Provider] >= p.Quota) {
+			continue
+		}
+		if p.Bytes > 0 && r.bytes[p.Provider]+int64(pieceSize) > p.Bytes {
+			continue
+		}
+		if best == "" || r.sent[p.Provider] < r.sent[best] {
+			best = p.Provider
+		}
+	}
+	return best
+}
+
+// Sent records a deal for a piece of pieceSize bytes taken by a provider
+func (r *Replicator) Sent(provider string, pieceSize uint64) {
+	r.sent[provider]++
+	r.bytes[provider] += int64(pieceSize)
+}
+
+// Drop stops picking a provider for the rest of the run, such as when it
+// reached a limit shared with other deal processes
+func (r *Replicator) Drop(provider string) {
+	r.dropped[provider] = true
+}
+
+// Exhausted reports whether every provider used its quota of deals or was
+// dropped
+func (r *Replicator) Exhausted() bool {
+	for _, p := range r.providers {
+		if r.dropped[p.Provider] {
+			continue
+		}
+		if p.Quota == 0 || r.sent[p.Provider] < p.Quota {
+			return false
+		}
+	}
+	return true
+}
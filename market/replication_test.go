@@ -0,0 +1,134 @@
+package market
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+func TestParseProviders(t *testing.T) {
+	got, err := ParseProviders([]string{"f01000:2", "f02000, f03000:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProviderQuota{{Provider: "f01000", Quota: 2}, {Provider: "f02000"}, {Provider: "f03000"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parsed %+v, want %+v", got, want)
+	}
+
+	for _, bad := range [][]string{nil, {"f01000:x"}, {"f01000:-1"}, {":3"}, {"f01000", "f01000:2"}} {
+		if _, err := ParseProviders(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestReplicator(t *testing.T) {
+	r := NewReplicator([]ProviderQuota{{Provider: "f01", Quota: 1}, {Provider: "f02"}, {Provider: "f03", Quota: 2}})
+
+	// Three replicas of a fresh piece go to three providers
+	var holding []string
+	for i := 0; i < 3; i++ {
+		p := r.Next(holding, 1)
+		if p == "" {
+			t.Fatalf("no provider for replica %d", i+1)
+		}
+		r.Sent(p, 1)
+		holding = append(holding, p)
+	}
+	if want := []string{"f01", "f02", "f03"}; !reflect.DeepEqual(holding, want) {
+		t.Fatalf("replicas went to %v, want %v", holding, want)
+	}
+	if p := r.Next(holding, 1); p != "" {
+		t.Fatalf("a fourth replica went to %s", p)
+	}
+
+	// f01 used its quota, f02 and f03 took one deal each
+	if p := r.Next(nil, 1); p != "f02" {
+		t.Fatalf("next provider %s, want f02", p)
+	}
+	if p := r.Next([]string{"f02"}, 1); p != "f03" {
+		t.Fatalf("next provider %s, want f03", p)
+	}
+	r.Sent("f03", 1)
+	if p := r.Next([]string{"f02"}, 1); p != "" {
+		t.Fatalf("f03 took more than its quota, got %s", p)
+	}
+	if r.Exhausted() {
+		t.Fatalf("f02 has no quota, the replicator is never exhausted")
+	}
+
+	limited := NewReplicator([]ProviderQuota{{Provider: "f01", Quota: 1}})
+	limited.Sent("f01", 1)
+	if !limited.Exhausted() {
+		t.Fatalf("expected the replicator to be exhausted")
+	}
+
+	// A dropped provider is not picked anymore
+	dropped := NewReplicator([]ProviderQuota{{Provider: "f01"}, {Provider: "f02"}})
+	dropped.Drop("f01")
+	if p := dropped.Next(nil, 1); p != "f02" {
+		t.Fatalf("next provider %s, want f02", p)
+	}
+	dropped.Drop("f02")
+	if !dropped.Exhausted() {
+		t.Fatalf("expected the replicator to be exhausted once every provider is dropped")
+	}
+
+	// A piece goes to a provider with enough bytes left for it
+	bytes := NewReplicator([]ProviderQuota{{Provider: "f01", Bytes: 100}, {Provider: "f02", Bytes: 200}})
+	if p := bytes.Next(nil, 150); p != "f02" {
+		t.Fatalf("150 bytes went to %q, want f02", p)
+	}
+	bytes.Sent("f02", 150)
+	if p := bytes.Next(nil, 100); p != "f01" {
+		t.Fatalf("100 bytes went to %q, want f01", p)
+	}
+	bytes.Sent("f01", 100)
+	if p := bytes.Next(nil, 64); p != "" {
+		t.Fatalf("64 bytes went to %q past its byte limit", p)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	providers := []db.Provider{
+		{MinerID: "f01", State: db.ProviderStateEnabled, MaxDealsPerDay: 10, MaxBytesInFlight: 1000},
+		{MinerID: "f02", State: db.ProviderStatePaused},
+		{MinerID: "f03", State: db.ProviderStateEnabled, AllowedWallets: []string{"f1other"}},
+		{MinerID: "f04", State: db.ProviderStateEnabled, MaxFailureRate: 0.5},
+		{MinerID: "f05", State: db.ProviderStateEnabled, MaxDealsPerDay: 2},
+		{MinerID: "f06", State: db.ProviderStateEnabled, AllowedWallets: []string{"f1client"}},
+	}
+	usage := map[string]db.ProviderUsage{
+		"f01": {Deals: 4, BytesInFlight: 400},
+		"f04": {Attempts: 6, Failures: 4},
+		"f05": {Deals: 2},
+	}
+
+	quotas, skipped, err := Quotas(providers, usage, "f1client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProviderQuota{{Provider: "f01", Quota: 6, Bytes: 600}, {Provider: "f06"}}
+	if !reflect.DeepEqual(quotas, want) {
+		t.Fatalf("quotas %+v, want %+v", quotas, want)
+	}
+	for _, p := range []string{"f02", "f03", "f04", "f05"} {
+		if skipped[p] == "" {
+			t.Fatalf("expected %s to be skipped, skipped %v", p, skipped)
+		}
+	}
+
+	// Providers given on the command line keep the smaller quota
+	quotas, _, err = Quotas(providers, usage, "f1client", []ProviderQuota{{Provider: "f01", Quota: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ProviderQuota{{Provider: "f01", Quota: 3, Bytes: 600}}; !reflect.DeepEqual(quotas, want) {
+		t.Fatalf("quotas %+v, want %+v", quotas, want)
+	}
+	if _, _, err := Quotas(providers, usage, "f1client", []ProviderQuota{{Provider: "f09"}}); err == nil {
+		t.Fatalf("expected an unregistered provider to fail")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minerdao/lotus-car/cmd/deal"
+	importdeal "github.com/minerdao/lotus-car/cmd/import-deal"
+	updatedeal "github.com/minerdao/lotus-car/cmd/update-deal"
+	"github.com/minerdao/lotus-car/config"
+	"github.com/minerdao/lotus-car/db"
+	"github.com/minerdao/lotus-car/market"
+)
+
+// TestDealPipeline runs deal, import-deal and update-deal against a scripted
+// backend, so no Boost, Lotus or network is needed. It needs a PostgreSQL
+// database it may write to, set LOTUS_CAR_TEST_CONFIG to a config file
+// pointing at one. With LOTUS_CAR_REQUIRE_TEST_DB set, as it is in CI, the
+// test fails instead of being skipped without one.
+func TestDealPipeline(t *testing.T) {
+	cfgPath := os.Getenv("LOTUS_CAR_TEST_CONFIG")
+	if cfgPath == "" {
+		if os.Getenv("LOTUS_CAR_REQUIRE_TEST_DB") != "" {
+			t.Fatal("LOTUS_CAR_REQUIRE_TEST_DB is set but LOTUS_CAR_TEST_CONFIG is not")
+		}
+		t.Skip("LOTUS_CAR_TEST_CONFIG is not set")
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.InitFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// A car file recorded in the database and present in the car directory,
+	// named by its CommP as generate does
+	carDir := t.TempDir()
+	newCarFile := func() *db.CarFile {
+		commp := "baga-pipeline-test-" + uuid.New().String()
+		f := &db.CarFile{
+			CommP:      commp,
+			DataCid:    "bafy-pipeline-test",
+			PieceCid:   commp,
+			PieceSize:  2048,
+			CarSize:    100,
+			FilePath:   filepath.Join(carDir, commp+".car"),
+			RawFiles:   "[]",
+			DealStatus: db.DealStatusPending,
+		}
+		if err := os.WriteFile(f.FilePath, make([]byte, f.CarSize), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := database.InsertFile(f); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { database.DeleteFile(f.ID) })
+		return f
+	}
+	pieceCidsFile := func(f *db.CarFile) string {
+		p := filepath.Join(t.TempDir(), "pieces.txt")
+		if err := os.WriteFile(p, []byte(f.PieceCid+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	dealOpts := func(f *db.CarFile, replicas int, miners ...string) deal.Options {
+		var providers []market.ProviderQuota
+		for _, m := range miners {
+			providers = append(providers, market.ProviderQuota{Provider: m})
+		}
+		return deal.Options{
+			Providers:     providers,
+			Replicas:      replicas,
+			Wallet:        "f1pipelinetest",
+			FromPieceCids: pieceCidsFile(f),
+			StartEpochDay: 1,
+			Duration:      518400,
+			ReallyDoIt:    true,
+		}
+	}
+	// Deals go to registered providers only
+	for _, miner := range []string{"f01000", "f02000", "f03000", "f0rejecting"} {
+		database.DeleteProvider(miner)
+		if err := database.AddProvider(&db.Provider{MinerID: miner, Verified: true}); err != nil {
+			t.Fatal(err)
+		}
+		miner := miner
+		t.Cleanup(func() { database.DeleteProvider(miner) })
+	}
+
+	ctx := context.Background()
+	backend := &market.FakeBackend{
+		FakeProposer: market.FakeProposer{Reject: map[string]error{"f0rejecting": errors.New("no capacity")}},
+		Script:       []string{"Sealing: PreCommit1", "Sealing: Proving"},
+	}
+
+	f := newCarFile()
+	if err := deal.SendDeals(ctx, database, backend, dealOpts(f, 1, "f01000")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := database.GetFile(f.ID); err != nil || got.DealStatus != db.DealStatusSuccess {
+		t.Fatalf("file after deal: %+v, %v", got, err)
+	}
+	deals, err := database.GetDealsByCommP(f.CommP)
+	if err != nil || len(deals) != 1 || deals[0].Status != "proposed" || deals[0].StorageProvider != "f01000" {
+		t.Fatalf("deals after deal: %+v, %v", deals, err)
+	}
+	dealUUID := deals[0].UUID
+
+	checkStatus := func(step, want string) {
+		t.Helper()
+		d, err := database.GetDeal(dealUUID)
+		if err != nil || d == nil || d.Status != want {
+			t.Fatalf("after %s: deal %+v, %v, want status %q", step, d, err, want)
+		}
+	}
+
+	if err := importdeal.ImportDeals(ctx, database, backend, importdeal.Options{CarDirs: []string{carDir}}); err != nil {
+		t.Fatal(err)
+	}
+	if backend.Imports()[dealUUID] != f.FilePath {
+		t.Fatalf("car file of deal %s was not imported: %v", dealUUID, backend.Imports())
+	}
+	checkStatus("import-deal", "imported")
+
+	if err := updatedeal.UpdateDeals(ctx, database, backend, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus("first update-deal", "Sealing: PreCommit1")
+	if err := updatedeal.UpdateDeals(ctx, database, backend, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus("second update-deal", "Sealing: Proving")
+
+	// A provider rejecting the deal leaves the file failed and no deal saved
+	rejected := newCarFile()
+	if err := deal.SendDeals(ctx, database, backend, dealOpts(rejected, 1, "f0rejecting")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := database.GetFile(rejected.ID); err != nil || got.DealStatus != db.DealStatusFailed {
+		t.Fatalf("file after rejected deal: %+v, %v", got, err)
+	}
+	if deals, err := database.GetDealsByCommP(rejected.CommP); err != nil || len(deals) != 0 {
+		t.Fatalf("deals after rejected deal: %+v, %v", deals, err)
+	}
+	usage, err := database.GetProviderUsage(time.Now().Add(-time.Hour))
+	if err != nil || usage["f0rejecting"].Failures == 0 || usage["f01000"].Deals == 0 {
+		t.Fatalf("provider usage after deals: %+v, %v", usage, err)
+	}
+
+	// A paused provider gets no deal
+	paused := newCarFile()
+	p, err := database.GetProvider("f03000")
+	if err != nil || p == nil {
+		t.Fatalf("provider f03000: %+v, %v", p, err)
+	}
+	p.State = db.ProviderStatePaused
+	if err := database.UpdateProvider(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := deal.SendDeals(ctx, database, backend, dealOpts(paused, 1, "f03000")); err != nil {
+		t.Fatal(err)
+	}
+	if deals, err := database.ListFileDeals(paused.ID); err != nil || len(deals) != 0 {
+		t.Fatalf("deals sent to a paused provider: %+v, %v", deals, err)
+	}
+	p.State = db.ProviderStateEnabled
+	if err := database.UpdateProvider(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replicas go to distinct providers, skipping the one rejecting the deal,
+	// and nothing more is sent once the piece has them all
+	replicated := newCarFile()
+	opts := dealOpts(replicated, 2, "f0rejecting", "f01000", "f02000", "f03000")
+	for run := 0; run < 2; run++ {
+		if err := deal.SendDeals(ctx, database, backend, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := database.GetFile(replicated.ID); err != nil || got.DealStatus != db.DealStatusSuccess {
+		t.Fatalf("file after replicated deals: %+v, %v", got, err)
+	}
+	deals, err = database.ListFileDeals(replicated.ID)
+	if err != nil || len(deals) != 2 || deals[0].StorageProvider != "f01000" || deals[1].StorageProvider != "f02000" {
+		t.Fatalf("deals after replicated deals: %+v, %v", deals, err)
+	}
+
+	// A provider taking one deal per hour gets the first file only, and a
+	// piece reserved for a provider can't be reserved again until rejected
+	limited := "f0ratelimit-" + uuid.New().String()[:8]
+	if err := database.AddProvider(&db.Provider{MinerID: limited, MaxDealsPerHour: 1, Verified: true}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.DeleteProvider(limited) })
+	first, second := newCarFile(), newCarFile()
+	for _, f := range []*db.CarFile{first, second} {
+		if err := deal.SendDeals(ctx, database, backend, dealOpts(f, 1, limited)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deals, err := database.ListFileDeals(first.ID); err != nil || len(deals) != 1 {
+		t.Fatalf("deals of the first file: %+v, %v", deals, err)
+	}
+	if deals, err := database.ListFileDeals(second.ID); err != nil || len(deals) != 0 {
+		t.Fatalf("deals past the hourly limit: %+v, %v", deals, err)
+	}
+
+	reservation := db.DealReservation{Provider: "f02000", Wallet: "f1pipelinetest", PieceCid: second.CommP, PieceSize: 2048, Replicas: 1}
+	id, err := database.ReserveDeal(reservation, db.RateLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limit *db.LimitError
+	if _, err := database.ReserveDeal(reservation, db.RateLimits{}); !errors.As(err, &limit) || limit.Scope != db.LimitPiece {
+		t.Fatalf("expected a piece limit reserving twice, got %v", err)
+	}
+	if err := database.RejectDealAttempt(id, "rejected by test"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := database.ReserveDeal(reservation, db.RateLimits{}); err != nil {
+		t.Fatalf("reserving after a rejection: %v", err)
+	} else {
+		database.RejectDealAttempt(id, "rejected by test")
+	}
+}
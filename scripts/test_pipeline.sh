@@ -0,0 +1,44 @@
+#!/bin/bash
+
+# This script runs the deal pipeline and database tests against a throwaway PostgreSQL
+# started with docker, the container is removed when the test ends.
+# Usage: ./scripts/test_pipeline.sh [go test flags]
+
+set -e
+
+CONTAINER="lotus-car-test-db-$$"
+PORT="${LOTUS_CAR_TEST_DB_PORT:-55432}"
+CONFIG_FILE="$(mktemp)"
+
+cleanup() {
+    docker rm -f "$CONTAINER" >/dev/null 2>&1 || true
+    rm -f "$CONFIG_FILE"
+}
+trap cleanup EXIT
+
+docker run -d --name "$CONTAINER" \
+    -e POSTGRES_USER=postgres \
+    -e POSTGRES_PASSWORD=postgres \
+    -e POSTGRES_DB=lotus_car_test \
+    -p "127.0.0.1:$PORT:5432" \
+    postgres:16 >/dev/null
+
+echo "Waiting for PostgreSQL on port $PORT..."
+for i in $(seq 1 30); do
+    if docker exec "$CONTAINER" pg_isready -U postgres -d lotus_car_test >/dev/null 2>&1; then
+        break
+    fi
+    sleep 1
+done
+
+cat > "$CONFIG_FILE" <<CONFIG
+database:
+  host: 127.0.0.1
+  port: $PORT
+  user: postgres
+  password: postgres
+  dbname: lotus_car_test
+  sslmode: disable
+CONFIG
+
+LOTUS_CAR_TEST_CONFIG="$CONFIG_FILE" LOTUS_CAR_REQUIRE_TEST_DB=1 go test -count=1 "$@" . ./db
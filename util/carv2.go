@@ -0,0 +1,65 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+)
+
+// ReadCarV2Header reads the pragma and header of a CARv2 file. ok is false
+// when r does not start with the CARv2 pragma.
+func ReadCarV2Header(r io.Reader) (header carv2.Header, ok bool, err error) {
+	pragma := make([]byte, carv2.PragmaSize)
+	if _, err = io.ReadFull(r, pragma); err != nil {
+		return
+	}
+	if !bytes.Equal(pragma, carv2.Pragma) {
+		return
+	}
+	ok = true
+	_, err = header.ReadFrom(r)
+	return
+}
+
+// writeCarV2 writes the selective car as a CARv2: pragma, header, the CARv1
+// payload and a car-multihash-index-sorted index built with go-car/v2. The
+// DAG is traversed once to size the payload for the header, the index
+// records are collected while the blocks are dumped.
+func writeCarV2(ctx context.Context, sc car.SelectiveCar, w io.Writer) error {
+	var records []index.Record
+	prepared, err := sc.Prepare(func(b car.Block) error {
+		// Identity CIDs carry their data inline and are never indexed
+		if b.BlockCID.Prefix().MhType == multihash.IDENTITY {
+			return nil
+		}
+		records = append(records, index.Record{Cid: b.BlockCID, Offset: b.Offset})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	header := carv2.NewHeader(prepared.Size())
+	if _, err := w.Write(carv2.Pragma); err != nil {
+		return err
+	}
+	if _, err := header.WriteTo(w); err != nil {
+		return err
+	}
+
+	if err := prepared.Dump(ctx, w); err != nil {
+		return err
+	}
+
+	idx := index.NewMultihashSorted()
+	if err := idx.Load(records); err != nil {
+		return err
+	}
+	_, err = index.WriteTo(idx, w)
+	return err
+}
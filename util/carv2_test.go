@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestGenerateCarV2(t *testing.T) {
+	parent := t.TempDir()
+	var fileList []Finfo
+	for i, size := range []int{10, 3 << 20, 1 << 20} {
+		p := filepath.Join(parent, string(rune('a'+i)))
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileList = append(fileList, Finfo{Path: p, Size: int64(size)})
+	}
+
+	var v1Car, v2Car bytes.Buffer
+	_, v1Cid, _, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{}, &v1Car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, v2Cid, _, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{CarVersion: 2}, &v2Car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1Cid != v2Cid {
+		t.Fatalf("root cid %s of CARv2 does not match %s", v2Cid, v1Cid)
+	}
+
+	r, err := carv2.NewReader(bytes.NewReader(v2Car.Bytes()))
+	if err != nil {
+		t.Fatalf("go-car/v2 cannot open the output: %v", err)
+	}
+	if r.Version != 2 || r.Header.DataSize != uint64(v1Car.Len()) || !r.Header.HasIndex() {
+		t.Fatalf("unexpected header %+v for payload of %d bytes", r.Header, v1Car.Len())
+	}
+	stats, err := r.Inspect(true)
+	if err != nil {
+		t.Fatalf("go-car/v2 rejects the output: %v", err)
+	}
+	if stats.IndexCodec != multicodec.CarMultihashIndexSorted {
+		t.Fatalf("unexpected index codec %s", stats.IndexCodec)
+	}
+
+	dr, err := r.DataReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, v1Car.Bytes()) {
+		t.Fatalf("CARv2 payload differs from the CARv1 output")
+	}
+
+	ir, err := r.IndexReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.ReadFrom(ir)
+	if err != nil {
+		t.Fatalf("go-car/v2 cannot load the index: %v", err)
+	}
+	iterable, ok := idx.(index.IterableIndex)
+	if !ok {
+		t.Fatalf("index %s cannot be iterated", idx.Codec())
+	}
+
+	// Every index record must point at a section holding the indexed block
+	records := 0
+	err = iterable.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		section := bytes.NewReader(payload[offset:])
+		if _, err := binary.ReadUvarint(section); err != nil {
+			return err
+		}
+		_, c, err := cid.CidFromReader(section)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(c.Hash(), mh) {
+			t.Fatalf("index record at offset %d points at block %s", offset, c)
+		}
+		records++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records == 0 || uint64(records) != stats.BlockCount {
+		t.Fatalf("index holds %d records for %d blocks", records, stats.BlockCount)
+	}
+}
@@ -2,23 +2,25 @@ package util
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
-	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/ipfs/go-blockservice"
-	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dss "github.com/ipfs/go-datastore/sync"
+	leveldb "github.com/ipfs/go-ds-leveldb"
 	"github.com/ipfs/go-filestore"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	chunker "github.com/ipfs/go-ipfs-chunker"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	files "github.com/ipfs/go-ipfs-files"
+	posinfo "github.com/ipfs/go-ipfs-posinfo"
 	format "github.com/ipfs/go-ipld-format"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
@@ -27,7 +29,7 @@ import (
 	"github.com/ipfs/go-unixfs"
 	"github.com/ipfs/go-unixfs/importer/balanced"
 	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
-	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipfs/go-unixfs/importer/trickle"
 	"github.com/ipld/go-car"
 	ipldprime "github.com/ipld/go-ipld-prime"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
@@ -80,6 +82,25 @@ type Finfo struct {
 	End   int64
 }
 
+// Len returns the number of bytes taken from the file, which is the slice
+// length when only a part of the file is used.
+func (f Finfo) Len() int64 {
+	if f.End == 0 {
+		return f.Size - f.Start
+	}
+	return f.End - f.Start
+}
+
+// IsSlice reports whether only a part of the file is used.
+func (f Finfo) IsSlice() bool {
+	return f.Len() != f.Size
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 type fileSlice struct {
 	r        *os.File
 	offset   int64
@@ -97,41 +118,126 @@ func (fs *fileSlice) Read(p []byte) (n int, err error) {
 		fs.end = fs.fileSize
 	}
 	if fs.offset == 0 && fs.start > 0 {
-		_, err = fs.r.Seek(fs.start, 0)
+		_, err = fs.r.Seek(fs.start, io.SeekStart)
 		if err != nil {
 			logger.Warn(err)
 			return 0, err
 		}
 		fs.offset = fs.start
 	}
-	if fs.end-fs.offset == 0 {
+	leftLen := fs.end - fs.offset
+	if leftLen == 0 {
 		return 0, io.EOF
 	}
-	if fs.end-fs.offset < 0 {
+	if leftLen < 0 {
 		return 0, xerrors.Errorf("read data out bound of the slice")
 	}
-	plen := len(p)
-	leftLen := fs.end - fs.offset
-	if leftLen > int64(plen) {
-		n, err = fs.r.Read(p)
-		if err != nil {
-			return
-		}
-		fs.offset += int64(n)
-		return
-	}
-	b := make([]byte, leftLen)
-	n, err = fs.r.Read(b)
-	if err != nil {
-		return
+	if int64(len(p)) > leftLen {
+		p = p[:leftLen]
 	}
+	n, err = fs.r.Read(p)
 	fs.offset += int64(n)
+	return
+}
 
-	return copy(p, b), io.EOF
+// offsetDAGService shifts the filestore position of leaves built from a file
+// slice, so that they reference the slice location inside the source file
+// instead of an offset relative to the slice start.
+type offsetDAGService struct {
+	ipld.DAGService
+	offset uint64
+}
+
+func (s *offsetDAGService) Add(ctx context.Context, nd ipld.Node) error {
+	return s.DAGService.Add(ctx, s.shift(nd))
+}
+
+func (s *offsetDAGService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		s.shift(nd)
+	}
+	return s.DAGService.AddMany(ctx, nds)
 }
 
-func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDir string, output io.Writer) (ipldDag *FsNode, cid string, cidMap map[string]CidMapValue, err error) {
-	batching := dss.MutexWrap(datastore.NewMapDatastore())
+func (s *offsetDAGService) shift(nd ipld.Node) ipld.Node {
+	if fsn, ok := nd.(*posinfo.FilestoreNode); ok && fsn.PosInfo != nil {
+		fsn.PosInfo.Offset += s.offset
+	}
+	return nd
+}
+
+// CarOptions controls how GenerateCar builds a car file. Only CarVersion and
+// Unixfs change the car bytes, the other options only change the resources
+// used to produce them.
+type CarOptions struct {
+	// Unixfs holds the DAG layout params, the zero value means
+	// DefaultUnixfsParams.
+	Unixfs UnixfsParams
+
+	// CarVersion selects the output format: 0 or 1 writes a plain CARv1, 2
+	// writes a CARv2 wrapping the same CARv1 payload with a sorted index.
+	CarVersion int
+
+	// BlockstoreDir keeps the intermediate blocks in a temporary on-disk
+	// blockstore created under this directory instead of in memory, so memory
+	// stays bounded for car files holding millions of small files.
+	BlockstoreDir string
+
+	// SourceHashes, when not nil, receives the hex sha256 of the bytes packed
+	// from every file, keyed by the path given in the file list. The hash is
+	// computed while the file is chunked, so the file is not read again.
+	SourceHashes map[string]string
+}
+
+// WorkerTmpDir returns the tmpDir argument of GenerateCar for one of workers
+// concurrent calls. Slices of one file share a relative path, so every worker
+// needs its own copy destination below tmpDir.
+func WorkerTmpDir(tmpDir string, worker, workers int) string {
+	if tmpDir == "" || workers <= 1 {
+		return tmpDir
+	}
+	return filepath.Join(tmpDir, fmt.Sprintf("worker-%d", worker))
+}
+
+// GenerateCar builds a UnixFS DAG of the files below parentPath and writes it
+// to output as a car file. The files may be given in any order and identical
+// entries are merged, so the same set of files always gives the same car.
+func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDir string, opts CarOptions, output io.Writer) (ipldDag *FsNode, cid string, cidMap map[string]CidMapValue, err error) {
+	if opts.CarVersion != 0 && opts.CarVersion != 1 && opts.CarVersion != 2 {
+		err = xerrors.Errorf("unsupported car version %d", opts.CarVersion)
+		return
+	}
+	params := opts.Unixfs
+	if params == (UnixfsParams{}) {
+		params = DefaultUnixfsParams()
+	}
+	if err = params.Validate(); err != nil {
+		return
+	}
+	fileList, err = canonicalFileList(fileList, parentPath)
+	if err != nil {
+		return
+	}
+	var batching datastore.Batching
+	if opts.BlockstoreDir != "" {
+		var storeDir string
+		storeDir, err = os.MkdirTemp(opts.BlockstoreDir, "blockstore-")
+		if err != nil {
+			logger.Warn(err)
+			return
+		}
+		defer os.RemoveAll(storeDir)
+		var ldb *leveldb.Datastore
+		ldb, err = leveldb.NewDatastore(storeDir, &leveldb.Options{NoSync: true})
+		if err != nil {
+			logger.Warn(err)
+			return
+		}
+		defer ldb.Close()
+		batching = ldb
+	} else {
+		batching = dss.MutexWrap(datastore.NewMapDatastore())
+	}
 	bs1 := bstore.NewBlockstore(batching)
 	absParentPath, err := filepath.Abs(parentPath)
 	cidMap = make(map[string]CidMapValue)
@@ -150,26 +256,29 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 	fm.AllowFiles = true
 	bs2 := filestore.NewFilestore(bs1, fm)
 	dagServ := merkledag.NewDAGService(blockservice.New(bs2, offline.Exchange(bs2)))
-	cidBuilder, err := merkledag.PrefixForCidVersion(1)
+	cidBuilder, err := params.cidBuilder()
 	if err != nil {
 		logger.Warn(err)
 		return
 	}
 	var layers []interface{}
-	rootNode := uio.NewDirectory(dagServ)
-	rootNode.SetCidBuilder(cidBuilder)
-	layers = append(layers, &rootNode)
+	rootNode := newUnixfsDir(dagServ, cidBuilder, params.HamtThreshold)
+	layers = append(layers, rootNode)
 	previous := []string{""}
 	for _, item := range fileList {
 		if _, err := os.Stat(item.Path); err != nil {
 			return nil, "", nil, err
 		}
+		sourcePath := item.Path
 		if item.End == 0 {
 			item.End = item.Size
 		}
 		var node ipld.Node
 		var path string
 		path, err = filepath.Rel(filepath.Clean(parentPath), filepath.Clean(item.Path))
+		if err != nil {
+			return
+		}
 		if tmpDir != "" {
 			tmpPath := filepath.Join(filepath.Clean(tmpDir), path)
 			err = os.MkdirAll(filepath.Dir(tmpPath), 0777)
@@ -202,10 +311,17 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 			item.End = item.Size
 			item.Start = 0
 		}
-		node, err = BuildFileNode(ctx, item, dagServ, cidBuilder)
+		var h hash.Hash
+		if opts.SourceHashes != nil {
+			h = sha256.New()
+		}
+		node, err = buildFileNode(ctx, item, dagServ, params, h)
 		if err != nil {
 			return
 		}
+		if h != nil {
+			opts.SourceHashes[sourcePath] = hex.EncodeToString(h.Sum(nil))
+		}
 		err = dagServ.Add(ctx, node)
 		if err != nil {
 			return
@@ -229,15 +345,15 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 			lastNode := layers[len(layers)-1]
 			lastName := previous[len(previous)-1]
 			layers = layers[:len(layers)-1]
-			dirNode, ok := layers[len(layers)-1].(*uio.Directory)
+			dirNode, ok := layers[len(layers)-1].(*unixfsDir)
 			if !ok {
 				err = xerrors.Errorf("node is not directory")
 				return
 			}
-			lastDirNode, ok := lastNode.(*uio.Directory)
+			lastDirNode, ok := lastNode.(*unixfsDir)
 			if ok {
 				var n ipld.Node
-				n, err = (*lastDirNode).GetNode()
+				n, err = lastDirNode.GetNode(ctx)
 				if err != nil {
 					return
 				}
@@ -246,13 +362,13 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 					return
 				}
 				cidMap[strings.Join(previous[1:], "/")] = CidMapValue{true, n.Cid().String()}
-				err = (*dirNode).AddChild(ctx, lastName, n)
+				err = dirNode.AddChild(ctx, lastName, n)
 				if err != nil {
 					return nil, "", nil, err
 				}
 			} else {
 				lastFileNode, _ := lastNode.(ipld.Node)
-				err = (*dirNode).AddChild(ctx, lastName, lastFileNode)
+				err = dirNode.AddChild(ctx, lastName, lastFileNode)
 				if err != nil {
 					return nil, "", nil, err
 				}
@@ -263,9 +379,7 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 			if j == len(current)-1 {
 				layers = append(layers, node)
 			} else {
-				newNode := uio.NewDirectory(dagServ)
-				newNode.SetCidBuilder(cidBuilder)
-				layers = append(layers, &newNode)
+				layers = append(layers, newUnixfsDir(dagServ, cidBuilder, params.HamtThreshold))
 			}
 		}
 		previous = current
@@ -274,15 +388,15 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 		lastNode := layers[len(layers)-1]
 		lastName := previous[len(previous)-1]
 		layers = layers[:len(layers)-1]
-		dirNode, ok := layers[len(layers)-1].(*uio.Directory)
+		dirNode, ok := layers[len(layers)-1].(*unixfsDir)
 		if !ok {
 			err = xerrors.Errorf("node is not directory")
 			return
 		}
-		lastDirNode, ok := lastNode.(*uio.Directory)
+		lastDirNode, ok := lastNode.(*unixfsDir)
 		if ok {
 			var n ipld.Node
-			n, err = (*lastDirNode).GetNode()
+			n, err = lastDirNode.GetNode(ctx)
 			if err != nil {
 				return
 			}
@@ -291,20 +405,23 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 				return
 			}
 			cidMap[strings.Join(previous[1:], "/")] = CidMapValue{true, n.Cid().String()}
-			err = (*dirNode).AddChild(ctx, lastName, n)
+			err = dirNode.AddChild(ctx, lastName, n)
 			if err != nil {
 				return
 			}
 		} else {
 			lastFileNode, _ := lastNode.(ipld.Node)
-			err = (*dirNode).AddChild(ctx, lastName, lastFileNode)
+			err = dirNode.AddChild(ctx, lastName, lastFileNode)
 			if err != nil {
 				return
 			}
 		}
 		previous = previous[:len(previous)-1]
 	}
-	rootIpldNode, _ := rootNode.GetNode()
+	rootIpldNode, err := rootNode.GetNode(ctx)
+	if err != nil {
+		return
+	}
 	err = dagServ.Add(ctx, rootIpldNode)
 	if err != nil {
 		return
@@ -312,7 +429,11 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 	cidMap[""] = CidMapValue{true, rootIpldNode.Cid().String()}
 	selector := allSelector()
 	sc := car.NewSelectiveCar(ctx, bs2, []car.Dag{{Root: rootIpldNode.Cid(), Selector: selector}})
-	err = sc.Write(output)
+	if opts.CarVersion == 2 {
+		err = writeCarV2(ctx, sc, output)
+	} else {
+		err = sc.Write(output)
+	}
 	if err != nil {
 		return
 	}
@@ -330,71 +451,70 @@ func GenerateCar(ctx context.Context, fileList []Finfo, parentPath string, tmpDi
 	return
 }
 
-func ChoiceRandomFile(fileList []Finfo) (file Finfo, size int64) {
-	rand.Seed(time.Now().Unix())
-	var choicedFile = fileList[rand.Intn(len(fileList))]
-	fmt.Println(rand.Intn(len(fileList)))
-	return choicedFile, choicedFile.Size
-}
-
 func allSelector() ipldprime.Node {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
 	return ssb.ExploreRecursive(selector.RecursionLimitNone(),
 		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).
 		Node()
 }
-func BuildFileNode(ctx context.Context, item Finfo, bufDs ipld.DAGService, cidBuilder cid.Builder) (node ipld.Node, err error) {
+func BuildFileNode(ctx context.Context, item Finfo, bufDs ipld.DAGService, unixfsParams UnixfsParams) (node ipld.Node, err error) {
+	return buildFileNode(ctx, item, bufDs, unixfsParams, nil)
+}
+
+// buildFileNode is BuildFileNode, also writing the bytes read from the file
+// to h when it is not nil
+func buildFileNode(ctx context.Context, item Finfo, bufDs ipld.DAGService, unixfsParams UnixfsParams, h hash.Hash) (node ipld.Node, err error) {
+	cidBuilder, err := unixfsParams.cidBuilder()
+	if err != nil {
+		return
+	}
 	f, err := os.Open(item.Path)
 	if err != nil {
 		logger.Warn(err)
 		return
 	}
-	var r io.Reader
-	if item.Start == 0 && item.End == item.Size {
-		r, err = files.NewReaderPathFile(item.Path, f, nil)
-	} else {
-		r, err = files.NewReaderPathFile(item.Path, &fileSlice{
+	defer f.Close()
+	// The reader is wrapped by files.NewReaderPathFile, which the filestore
+	// needs to know the source path, so the hash is taken below it
+	var src io.ReadCloser = f
+	dagServ := bufDs
+	if item.Start != 0 || item.End != item.Size {
+		// fileSlice seeks to the slice start itself, the filestore offsets
+		// of the leaves are shifted by the same amount
+		src = &fileSlice{
 			r:        f,
 			start:    item.Start,
 			end:      item.End,
 			fileSize: item.Size,
-		}, nil)
+		}
+		dagServ = &offsetDAGService{DAGService: bufDs, offset: uint64(item.Start)}
 	}
+	if h != nil {
+		src = &teeReadCloser{Reader: io.TeeReader(src, h), Closer: src}
+	}
+	r, err := files.NewReaderPathFile(item.Path, src, nil)
 	if err != nil {
 		logger.Warn(err)
 		return
 	}
 
 	params := ihelper.DagBuilderParams{
-		Maxlinks:   UnixfsLinksPerLevel,
-		RawLeaves:  true,
+		Maxlinks:   unixfsParams.MaxLinks,
+		RawLeaves:  unixfsParams.RawLeaves,
 		CidBuilder: cidBuilder,
-		Dagserv:    bufDs,
+		Dagserv:    dagServ,
 		NoCopy:     true,
 	}
-	// Instead of using SetOffset, we'll create a reader that starts at the correct offset
-	if item.Start > 0 {
-		if seeker, ok := r.(io.ReadSeeker); ok {
-			_, err = seeker.Seek(item.Start, io.SeekStart)
-			if err != nil {
-				logger.Warn(err)
-				return
-			}
-		} else {
-			// If seeking is not supported, read and discard bytes until we reach the start position
-			_, err = io.CopyN(io.Discard, r, item.Start)
-			if err != nil {
-				logger.Warn(err)
-				return
-			}
-		}
-	}
-	db, err := params.New(chunker.NewSizeSplitter(r, int64(UnixfsChunkSize)))
+	db, err := params.New(chunker.NewSizeSplitter(r, int64(unixfsParams.ChunkSize)))
 	if err != nil {
 		logger.Warn(err)
 		return
 	}
-	node, err = balanced.Layout(db)
+	if unixfsParams.Layout == LayoutTrickle {
+		node, err = trickle.Layout(db)
+	} else {
+		node, err = balanced.Layout(db)
+	}
 	if err != nil {
 		logger.Warn(err)
 		return
@@ -415,7 +535,11 @@ func (b *FSBuilder) Build() (rootn *FsNode, err error) {
 	if !fsn.IsDir() {
 		return rootn, nil
 	}
-	for _, ln := range b.root.Links() {
+	links, err := dirLinks(context.Background(), b.ds, b.root, fsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, ln := range links {
 		var fn FsNode
 		fn, err = b.getNodeByLink(ln)
 		if err != nil {
@@ -461,7 +585,11 @@ func (b *FSBuilder) getNodeByLink(ln *format.Link) (fn FsNode, err error) {
 	if !fsn.IsDir() {
 		return
 	}
-	for _, ln := range nnd.Links() {
+	links, err := dirLinks(ctx, b.ds, nnd, fsn)
+	if err != nil {
+		return
+	}
+	for _, ln := range links {
 		node, err := b.getNodeByLink(ln)
 		if err != nil {
 			return node, err
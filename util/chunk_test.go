@@ -1,9 +1,12 @@
 package util
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -24,9 +27,182 @@ func TestGenerateCar(t *testing.T) {
 			Start: 1,
 			End:   4038,
 		},
-	}, "../", "", carF)
+	}, "../", "", CarOptions{}, carF)
 	fmt.Println(dag)
 	fmt.Println(cid)
 	fmt.Println(err)
 	fmt.Println(cidMap)
 }
+
+func TestGenerateCarSlice(t *testing.T) {
+	data := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	start, end := int64(1<<20+5), int64(5<<19)
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "f"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sliceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sliceDir, "f"), data[start:end], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var sliceCar, wholeCar bytes.Buffer
+	_, sliceCid, _, err := GenerateCar(context.TODO(), []Finfo{
+		{Path: filepath.Join(srcDir, "f"), Size: int64(len(data)), Start: start, End: end},
+	}, srcDir, "", CarOptions{}, &sliceCar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wholeCid, _, err := GenerateCar(context.TODO(), []Finfo{
+		{Path: filepath.Join(sliceDir, "f"), Size: end - start},
+	}, sliceDir, "", CarOptions{}, &wholeCar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sliceCid != wholeCid {
+		t.Fatalf("slice cid %s does not match cid %s of the extracted bytes", sliceCid, wholeCid)
+	}
+	if !bytes.Equal(sliceCar.Bytes(), wholeCar.Bytes()) {
+		t.Fatalf("car built from a slice differs from car built from the extracted bytes")
+	}
+}
+
+func TestGenerateCarOnDiskBlockstore(t *testing.T) {
+	parent := t.TempDir()
+	var fileList []Finfo
+	for i, size := range []int{10, 3 << 20, 0, 1 << 20} {
+		p := filepath.Join(parent, "d", fmt.Sprintf("f%d", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileList = append(fileList, Finfo{Path: p, Size: int64(size)})
+	}
+
+	var memCar, diskCar bytes.Buffer
+	_, memCid, _, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{}, &memCar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, diskCid, _, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{BlockstoreDir: t.TempDir()}, &diskCar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if memCid != diskCid {
+		t.Fatalf("root cid %s from on-disk blockstore does not match %s", diskCid, memCid)
+	}
+	if !bytes.Equal(memCar.Bytes(), diskCar.Bytes()) {
+		t.Fatalf("car built with on-disk blockstore differs from in-memory car")
+	}
+}
+
+func TestGenerateCarUnixfsParams(t *testing.T) {
+	parent := t.TempDir()
+	data := make([]byte, 2<<20+7)
+	rand.New(rand.NewSource(1)).Read(data)
+	p := filepath.Join(parent, "f")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileList := []Finfo{{Path: p, Size: int64(len(data))}}
+
+	build := func(params UnixfsParams) string {
+		var buf bytes.Buffer
+		_, c, cidMap, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{Unixfs: params}, &buf)
+		if err != nil {
+			t.Fatalf("params %s: %v", params, err)
+		}
+		return c + " " + cidMap["f"].Cid
+	}
+
+	defaults := build(UnixfsParams{})
+	if explicit := build(DefaultUnixfsParams()); explicit != defaults {
+		t.Fatalf("zero params %s differ from default params %s", defaults, explicit)
+	}
+
+	seen := map[string]bool{defaults: true}
+	for _, params := range []UnixfsParams{
+		{ChunkSize: 256 << 10, MaxLinks: 1024, RawLeaves: true, CidVersion: 1, Layout: LayoutBalanced},
+		{ChunkSize: 256 << 10, MaxLinks: 174, RawLeaves: false, CidVersion: 0, Layout: LayoutBalanced},
+		{ChunkSize: 256 << 10, MaxLinks: 4, RawLeaves: true, CidVersion: 1, Layout: LayoutBalanced},
+		{ChunkSize: 256 << 10, MaxLinks: 4, RawLeaves: true, CidVersion: 1, Layout: LayoutTrickle},
+	} {
+		cids := build(params)
+		if seen[cids] {
+			t.Fatalf("params %s did not change the DAG", params)
+		}
+		seen[cids] = true
+		if again := build(params); again != cids {
+			t.Fatalf("params %s are not deterministic", params)
+		}
+	}
+
+	for _, params := range []UnixfsParams{
+		{ChunkSize: 2 << 20, MaxLinks: 1024, RawLeaves: true, CidVersion: 1, Layout: LayoutBalanced},
+		{ChunkSize: 1 << 20, MaxLinks: 1024, RawLeaves: true, CidVersion: 0, Layout: LayoutBalanced},
+		{ChunkSize: 1 << 20, MaxLinks: 1024, RawLeaves: true, CidVersion: 1, Layout: "flat"},
+	} {
+		if err := params.Validate(); err == nil {
+			t.Fatalf("expected params %s to be rejected", params)
+		}
+	}
+}
+
+func TestGenerateCarHamtThreshold(t *testing.T) {
+	parent := t.TempDir()
+	var fileList []Finfo
+	for i := 0; i < 40; i++ {
+		p := filepath.Join(parent, "flat", fmt.Sprintf("f%02d", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileList = append(fileList, Finfo{Path: p, Size: int64(len(p))})
+	}
+
+	build := func(threshold int) (*FsNode, map[string]CidMapValue) {
+		params := DefaultUnixfsParams()
+		params.HamtThreshold = threshold
+		var buf bytes.Buffer
+		dag, _, cidMap, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{Unixfs: params}, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dag, cidMap
+	}
+
+	plainDag, plain := build(0)
+	basicDag, basic := build(40)
+	shardedDag, sharded := build(39)
+	if plain["flat"] != basic["flat"] {
+		t.Fatalf("directory below the threshold differs from a plain directory")
+	}
+	if sharded["flat"] == plain["flat"] {
+		t.Fatalf("directory above the threshold was not sharded")
+	}
+	if sharded["flat/f00"] != plain["flat/f00"] {
+		t.Fatalf("sharding changed the file cids")
+	}
+
+	for _, dag := range []*FsNode{plainDag, basicDag, shardedDag} {
+		entries := dag.Link[0].Link
+		if len(entries) != 40 {
+			t.Fatalf("expected 40 entries in the DAG tree, got %d", len(entries))
+		}
+		for i, ln := range entries {
+			if ln.Name != fmt.Sprintf("f%02d", i) || ln.Size == 0 {
+				t.Fatalf("unexpected entry %d: %+v", i, ln)
+			}
+		}
+	}
+}
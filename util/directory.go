@@ -0,0 +1,104 @@
+package util
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/hamt"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// unixfsDir builds a UnixFS directory node. Without a HAMT threshold it is a
+// plain go-unixfs directory, which switches to a HAMT shard by itself once
+// its node grows past uio.HAMTShardingSize. With a threshold the decision is
+// made on the number of entries only: directories holding more than
+// hamtThreshold entries are sharded, the others never are.
+type unixfsDir struct {
+	dserv         ipld.DAGService
+	cidBuilder    cid.Builder
+	hamtThreshold int
+
+	dir   uio.Directory
+	links []*ipld.Link
+}
+
+func newUnixfsDir(dserv ipld.DAGService, cidBuilder cid.Builder, hamtThreshold int) *unixfsDir {
+	d := &unixfsDir{
+		dserv:         dserv,
+		cidBuilder:    cidBuilder,
+		hamtThreshold: hamtThreshold,
+	}
+	if hamtThreshold == 0 {
+		d.dir = uio.NewDirectory(dserv)
+		d.dir.SetCidBuilder(cidBuilder)
+	}
+	return d
+}
+
+// AddChild links node under name. Names are expected to be unique, GenerateCar
+// walks each directory once.
+func (d *unixfsDir) AddChild(ctx context.Context, name string, node ipld.Node) error {
+	if d.dir != nil {
+		return d.dir.AddChild(ctx, name, node)
+	}
+	link, err := ipld.MakeLink(node)
+	if err != nil {
+		return err
+	}
+	link.Name = name
+	d.links = append(d.links, link)
+	return nil
+}
+
+// GetNode returns the directory node, HAMT shards below it are added to the
+// DAG service on the way.
+func (d *unixfsDir) GetNode(ctx context.Context) (ipld.Node, error) {
+	if d.dir != nil {
+		return d.dir.GetNode()
+	}
+	if len(d.links) <= d.hamtThreshold {
+		nd := unixfs.EmptyDirNode()
+		nd.SetCidBuilder(d.cidBuilder)
+		for _, link := range d.links {
+			if err := nd.AddRawLink(link.Name, link); err != nil {
+				return nil, err
+			}
+		}
+		return nd, nil
+	}
+	shard, err := hamt.NewShard(d.dserv, uio.DefaultShardWidth)
+	if err != nil {
+		return nil, err
+	}
+	shard.SetCidBuilder(d.cidBuilder)
+	for _, link := range d.links {
+		if err := shard.SetLink(ctx, link.Name, link); err != nil {
+			return nil, err
+		}
+	}
+	return shard.Node()
+}
+
+// dirLinks returns the entries of a UnixFS directory ordered by name,
+// resolving HAMT shards into the links they hold
+func dirLinks(ctx context.Context, ds ipld.DAGService, nd *dag.ProtoNode, fsn *unixfs.FSNode) ([]*ipld.Link, error) {
+	if fsn.Type() != unixfs.THAMTShard {
+		return nd.Links(), nil
+	}
+	shard, err := hamt.NewHamtFromDag(ds, nd)
+	if err != nil {
+		return nil, err
+	}
+	links, err := shard.EnumLinks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Name < links[j].Name
+	})
+	return links, nil
+}
@@ -0,0 +1,13 @@
+package util
+
+import "syscall"
+
+// FreeSpace returns the bytes available to an unprivileged user on the
+// filesystem holding dir
+func FreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
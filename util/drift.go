@@ -0,0 +1,79 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// HashFileRange returns the hex sha256 of the bytes [start, end) of a file,
+// end 0 means the end of the file. It gives the same hash as
+// CarOptions.SourceHashes for a file list entry.
+func HashFileRange(path string, start, end int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if start > 0 || end > 0 {
+		if end == 0 {
+			fi, err := f.Stat()
+			if err != nil {
+				return "", err
+			}
+			end = fi.Size()
+		}
+		r = io.NewSectionReader(f, start, end-start)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SourceDrift describes how a source file differs from what was recorded
+// when it was packed, it is empty when the file is unchanged. Only the
+// recorded values are checked, records written before the mtime and hash were
+// saved are checked by size alone.
+//
+// A changed mtime alone is not drift when the hash is recorded and still
+// matches, as happens when the files are restored from a backup. checkHash
+// also reads files whose size and mtime match.
+func SourceDrift(path string, rec db.RawFileInfo, checkHash bool) string {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if !fi.Mode().IsRegular() {
+		return "not a regular file"
+	}
+	if fi.Size() != rec.Size {
+		return fmt.Sprintf("size %d, recorded %d", fi.Size(), rec.Size)
+	}
+
+	mtimeChanged := rec.ModTime != nil && !fi.ModTime().Equal(*rec.ModTime)
+	if rec.SHA256 != "" && (checkHash || mtimeChanged) {
+		sum, err := HashFileRange(path, rec.Start, rec.End)
+		if err != nil {
+			return fmt.Sprintf("failed to hash: %v", err)
+		}
+		if sum != rec.SHA256 {
+			return fmt.Sprintf("content changed: sha256 %s, recorded %s", sum, rec.SHA256)
+		}
+		return ""
+	}
+	if mtimeChanged {
+		return fmt.Sprintf("modified at %s, recorded %s", fi.ModTime().Format(time.RFC3339Nano), rec.ModTime.Format(time.RFC3339Nano))
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+func TestSourceDrift(t *testing.T) {
+	parent := t.TempDir()
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	p := filepath.Join(parent, "a")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileList := []Finfo{
+		{Path: p, Size: int64(len(data)), Start: 0, End: 1 << 20},
+		{Path: filepath.Join(parent, "b"), Size: 10},
+	}
+	if err := os.WriteFile(fileList[1].Path, data[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hashes taken while packing, with and without a tmp dir, match a
+	// separate read of the same bytes
+	for _, tmpDir := range []string{"", t.TempDir()} {
+		hashes := make(map[string]string)
+		_, _, _, err := GenerateCar(context.TODO(), fileList, parent, tmpDir, CarOptions{SourceHashes: hashes}, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range fileList {
+			sum, err := HashFileRange(f.Path, f.Start, f.End)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hashes[f.Path] != sum {
+				t.Fatalf("tmp dir %q: packed hash of %s is %s, want %s", tmpDir, f.Path, hashes[f.Path], sum)
+			}
+		}
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, _ := HashFileRange(p, 0, 1<<20)
+	modTime := fi.ModTime()
+	rec := db.RawFileInfo{Size: fi.Size(), End: 1 << 20, ModTime: &modTime, SHA256: sum}
+	if d := SourceDrift(p, rec, true); d != "" {
+		t.Fatalf("unchanged file reported as %q", d)
+	}
+
+	// Touching the file alone is not drift while the packed bytes match
+	later := modTime.Add(time.Hour)
+	if err := os.Chtimes(p, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if d := SourceDrift(p, rec, false); d != "" {
+		t.Fatalf("touched file reported as %q", d)
+	}
+	noHash := rec
+	noHash.SHA256 = ""
+	if d := SourceDrift(p, noHash, false); !strings.HasPrefix(d, "modified") {
+		t.Fatalf("touched file without hash reported as %q", d)
+	}
+
+	// Bytes outside the packed slice do not matter, bytes inside do
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{data[2<<20] ^ 0xff}, 2<<20)
+	if d := SourceDrift(p, rec, true); d != "" {
+		t.Fatalf("change outside the slice reported as %q", d)
+	}
+	f.WriteAt([]byte{data[100] ^ 0xff}, 100)
+	f.Close()
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if d := SourceDrift(p, rec, false); d != "" {
+		t.Fatalf("same mtime should not be hashed without checkHash, got %q", d)
+	}
+	if d := SourceDrift(p, rec, true); !strings.HasPrefix(d, "content changed") {
+		t.Fatalf("changed content reported as %q", d)
+	}
+
+	if d := SourceDrift(p, db.RawFileInfo{Size: 1}, false); !strings.HasPrefix(d, "size") {
+		t.Fatalf("resized file reported as %q", d)
+	}
+	if d := SourceDrift(filepath.Join(parent, "missing"), rec, false); d != "missing" {
+		t.Fatalf("missing file reported as %q", d)
+	}
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// canonicalFileList returns the files sorted by their path components
+// relative to parentPath, which is the order GenerateCar needs to build each
+// directory exactly once. Identical entries are merged, while two different
+// entries for the same path, a path outside parentPath, or a file that is also
+// used as a directory of another file are rejected.
+func canonicalFileList(fileList []Finfo, parentPath string) ([]Finfo, error) {
+	type entry struct {
+		Finfo
+		parts []string
+	}
+
+	parent := filepath.Clean(parentPath)
+	entries := make([]entry, 0, len(fileList))
+	for _, f := range fileList {
+		rel, err := filepath.Rel(parent, filepath.Clean(f.Path))
+		if err != nil {
+			return nil, xerrors.Errorf("file %s is not under parent path %s: %w", f.Path, parentPath, err)
+		}
+		if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, xerrors.Errorf("file %s is not under parent path %s", f.Path, parentPath)
+		}
+		if f.End == 0 {
+			f.End = f.Size
+		}
+		entries = append(entries, entry{f, strings.Split(rel, string(filepath.Separator))})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return comparePathParts(entries[i].parts, entries[j].parts) < 0
+	})
+
+	result := make([]Finfo, 0, len(entries))
+	files := make(map[string]bool, len(entries))
+	for i, e := range entries {
+		rel := strings.Join(e.parts, "/")
+		if i > 0 && comparePathParts(entries[i-1].parts, e.parts) == 0 {
+			prev := entries[i-1].Finfo
+			if prev.Size != e.Size || prev.Start != e.Start || prev.End != e.End {
+				return nil, xerrors.Errorf("conflicting entries for %s: [%d, %d) of %d bytes and [%d, %d) of %d bytes",
+					rel, prev.Start, prev.End, prev.Size, e.Start, e.End, e.Size)
+			}
+			continue
+		}
+		// Every file is sorted after its parent directories, so checking the
+		// files seen so far finds any file that would also be a directory
+		for j := 1; j < len(e.parts); j++ {
+			if dir := strings.Join(e.parts[:j], "/"); files[dir] {
+				return nil, xerrors.Errorf("%s is a file but also the parent directory of %s", dir, rel)
+			}
+		}
+		files[rel] = true
+		result = append(result, e.Finfo)
+	}
+	return result, nil
+}
+
+// comparePathParts orders paths component by component, so a directory and
+// everything below it are always next to each other
+func comparePathParts(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestCanonicalFileList(t *testing.T) {
+	fileList := []Finfo{
+		{Path: "/p/b", Size: 1},
+		{Path: "/p/a/y", Size: 2},
+		{Path: "/p/a.txt", Size: 3},
+		{Path: "/p/a/x", Size: 4},
+		{Path: "/p//b", Size: 1, End: 1},
+		{Path: "/p/a-b/z", Size: 5},
+	}
+	sorted, err := canonicalFileList(fileList, "/p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/p/a/x", "/p/a/y", "/p/a-b/z", "/p/a.txt", "/p/b"}
+	if len(sorted) != len(expected) {
+		t.Fatalf("expected %d files, got %v", len(expected), sorted)
+	}
+	for i, p := range expected {
+		if sorted[i].Path != p {
+			t.Fatalf("file %d: expected %s, got %s", i, p, sorted[i].Path)
+		}
+	}
+
+	for name, conflicting := range map[string][]Finfo{
+		"file used as directory": {{Path: "/p/a", Size: 1}, {Path: "/p/a/b", Size: 1}},
+		"different slices":       {{Path: "/p/a", Size: 10, End: 5}, {Path: "/p/a", Size: 10, Start: 5}},
+		"outside parent":         {{Path: "/q/a", Size: 1}},
+		"parent itself":          {{Path: "/p", Size: 1}},
+	} {
+		if _, err := canonicalFileList(conflicting, "/p"); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
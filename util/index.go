@@ -0,0 +1,345 @@
+package util
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	HashSHA256 = "sha256"
+	HashMD5    = "md5"
+)
+
+const (
+	IndexFormatJSON   = "json"   // a JSON array, the original index format
+	IndexFormatNDJSON = "ndjson" // one JSON entry per line
+)
+
+// IndexEntry is one source file of an index file. Path and Size are all that
+// generate needs, the other fields let index skip unchanged files on the next
+// run.
+type IndexEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time `json:",omitempty"`
+	SHA256  string    `json:",omitempty"`
+	MD5     string    `json:",omitempty"`
+}
+
+// Unchanged reports whether the file still has the recorded size and mtime
+// and already carries every requested hash, so it does not need to be read
+// again.
+func (e IndexEntry) Unchanged(info os.FileInfo, hashes []string) bool {
+	if e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		return false
+	}
+	for _, h := range hashes {
+		if (h == HashSHA256 && e.SHA256 == "") || (h == HashMD5 && e.MD5 == "") {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHashes returns an error for any hash name HashFile does not support
+func CheckHashes(hashes []string) error {
+	for _, h := range hashes {
+		if h != HashSHA256 && h != HashMD5 {
+			return xerrors.Errorf("unsupported hash %q, expected %s or %s", h, HashSHA256, HashMD5)
+		}
+	}
+	return nil
+}
+
+// HashFile reads the file once and returns the requested hashes as hex
+// strings, keyed by hash name.
+func HashFile(path string, hashes []string) (map[string]string, error) {
+	if err := CheckHashes(hashes); err != nil {
+		return nil, err
+	}
+	hashers := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, h := range hashes {
+		if h == HashSHA256 {
+			hashers[h] = sha256.New()
+		} else {
+			hashers[h] = md5.New()
+		}
+		writers = append(writers, hashers[h])
+	}
+	sums := make(map[string]string)
+	if len(writers) == 0 {
+		return sums, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+	for name, h := range hashers {
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// IndexFormatFor returns the format of an index file from its name, NDJSON
+// for .ndjson and .jsonl files and a JSON array otherwise
+func IndexFormatFor(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		return IndexFormatNDJSON
+	}
+	return IndexFormatJSON
+}
+
+// ComparePaths orders index paths component by component, which is the order
+// WalkSource visits files and index files are written in
+func ComparePaths(a, b string) int {
+	return comparePathParts(strings.Split(filepath.ToSlash(a), "/"), strings.Split(filepath.ToSlash(b), "/"))
+}
+
+// IndexReader reads the entries of an index file one at a time, so an index
+// never has to fit in memory. Both formats are detected automatically.
+type IndexReader struct {
+	f     *os.File
+	dec   *json.Decoder
+	array bool
+}
+
+// OpenIndex opens an index file for reading
+func OpenIndex(path string) (*IndexReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewIndexReader(f)
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("failed to read index file %s: %w", path, err)
+	}
+	r.f = f
+	return r, nil
+}
+
+// NewIndexReader reads an index in either format from r
+func NewIndexReader(r io.Reader) (*IndexReader, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	ir := &IndexReader{}
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			br.ReadByte()
+			continue
+		}
+		ir.array = b[0] == '['
+		break
+	}
+	ir.dec = json.NewDecoder(br)
+	if ir.array {
+		if _, err := ir.dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return ir, nil
+}
+
+// Next returns the next entry, or io.EOF after the last one
+func (r *IndexReader) Next() (IndexEntry, error) {
+	var e IndexEntry
+	if r.array && !r.dec.More() {
+		if _, err := r.dec.Token(); err != nil {
+			return e, err
+		}
+		return e, io.EOF
+	}
+	err := r.dec.Decode(&e)
+	return e, err
+}
+
+// Offset returns the number of bytes of the file consumed by the entries
+// read so far
+func (r *IndexReader) Offset() int64 {
+	return r.dec.InputOffset()
+}
+
+// Close closes the index file
+func (r *IndexReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// IndexWriter writes the entries of an index file one at a time to a
+// .partial file next to it. Commit moves the complete index into place, so an
+// interrupted run always leaves the previous complete index behind, and the
+// partial file can be resumed with ResumeIndex.
+type IndexWriter struct {
+	path   string
+	format string
+	f      *os.File
+	w      *bufio.Writer
+	n      int
+}
+
+// PartialIndexPath returns the file an IndexWriter writes to before Commit
+func PartialIndexPath(path string) string {
+	return path + ".partial"
+}
+
+// CreateIndex starts a new index file in the format given by its name
+func CreateIndex(path string) (*IndexWriter, error) {
+	f, err := os.Create(PartialIndexPath(path))
+	if err != nil {
+		return nil, err
+	}
+	iw := &IndexWriter{path: path, format: IndexFormatFor(path), f: f, w: bufio.NewWriterSize(f, 1<<20)}
+	if iw.format == IndexFormatJSON {
+		if _, err := iw.w.WriteString("["); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return iw, nil
+}
+
+// ResumeIndex continues the partial file of an interrupted run. It returns
+// the entries already written, in order, through fn and continues writing
+// after the last complete one. Without a partial file it starts a new index.
+func ResumeIndex(path string, fn func(IndexEntry)) (*IndexWriter, error) {
+	partial := PartialIndexPath(path)
+	r, err := OpenIndex(partial)
+	if err != nil {
+		// No partial file, or nothing usable was written to it
+		return CreateIndex(path)
+	}
+	var n int
+	var offset int64
+	for {
+		e, err := r.Next()
+		if err != nil {
+			// A run killed while writing leaves a truncated last entry
+			break
+		}
+		fn(e)
+		n++
+		offset = r.Offset()
+	}
+	r.Close()
+	if n == 0 {
+		return CreateIndex(path)
+	}
+
+	f, err := os.OpenFile(partial, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &IndexWriter{path: path, format: IndexFormatFor(path), f: f, w: bufio.NewWriterSize(f, 1<<20), n: n}, nil
+}
+
+// Write appends an entry. Entries must be written in ComparePaths order for
+// the index to be read back incrementally.
+func (iw *IndexWriter) Write(e IndexEntry) error {
+	var data []byte
+	var err error
+	var sep string
+	if iw.format == IndexFormatJSON {
+		data, err = json.MarshalIndent(e, "    ", "    ")
+		sep = ",\n    "
+		if iw.n == 0 {
+			sep = "\n    "
+		}
+	} else {
+		data, err = json.Marshal(e)
+		if iw.n > 0 {
+			sep = "\n"
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := iw.w.WriteString(sep); err != nil {
+		return err
+	}
+	if _, err := iw.w.Write(data); err != nil {
+		return err
+	}
+	iw.n++
+	return nil
+}
+
+// Count returns the number of entries written, including resumed ones
+func (iw *IndexWriter) Count() int {
+	return iw.n
+}
+
+// Flush writes buffered entries to the partial file and syncs it
+func (iw *IndexWriter) Flush() error {
+	if err := iw.w.Flush(); err != nil {
+		return err
+	}
+	return iw.f.Sync()
+}
+
+// Commit completes the index and replaces the index file with it
+func (iw *IndexWriter) Commit() error {
+	var tail string
+	if iw.format == IndexFormatJSON {
+		tail = "]\n"
+		if iw.n > 0 {
+			tail = "\n]\n"
+		}
+	} else if iw.n > 0 {
+		tail = "\n"
+	}
+	if _, err := iw.w.WriteString(tail); err != nil {
+		iw.f.Close()
+		return err
+	}
+	if err := iw.Flush(); err != nil {
+		iw.f.Close()
+		return err
+	}
+	if err := iw.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(PartialIndexPath(iw.path), iw.path)
+}
+
+// Close stops writing and keeps the partial file so it can be resumed
+func (iw *IndexWriter) Close() error {
+	if err := iw.Flush(); err != nil {
+		iw.f.Close()
+		return err
+	}
+	return iw.f.Close()
+}
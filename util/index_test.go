@@ -0,0 +1,155 @@
+package util
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "f")
+	if err := os.WriteFile(p, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sums, err := HashFile(p, []string{HashSHA256, HashMD5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums[HashSHA256] != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" || sums[HashMD5] != "5d41402abc4b2a76b9719d911017c592" {
+		t.Fatalf("unexpected hashes %v", sums)
+	}
+	if _, err := HashFile(p, []string{"crc32"}); err == nil {
+		t.Fatalf("expected unsupported hash to be rejected")
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := IndexEntry{Path: p, Size: info.Size(), ModTime: info.ModTime(), MD5: sums[HashMD5]}
+	indexFile := filepath.Join(dir, "index.json")
+	w, err := CreateIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := readIndex(t, indexFile)
+	if len(loaded) != 1 || !loaded[0].Unchanged(info, []string{HashMD5}) {
+		t.Fatalf("reloaded entry %+v does not match the file", loaded)
+	}
+	if loaded[0].Unchanged(info, []string{HashSHA256}) {
+		t.Fatalf("entry without sha256 must be indexed again when sha256 is requested")
+	}
+
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(p, later, later); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(p)
+	if loaded[0].Unchanged(info, nil) {
+		t.Fatalf("entry must be indexed again after the mtime changed")
+	}
+
+	if _, err := OpenIndex(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("opening a missing index file should fail with not exist, got %v", err)
+	}
+}
+
+// readIndex reads every entry of an index file with an IndexReader
+func readIndex(t *testing.T, path string) []IndexEntry {
+	t.Helper()
+	r, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var entries []IndexEntry
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestIndexResume(t *testing.T) {
+	for _, name := range []string{"index.json", "index.ndjson"} {
+		dir := t.TempDir()
+		indexFile := filepath.Join(dir, name)
+		entries := []IndexEntry{
+			{Path: "/src/a/x", Size: 1},
+			{Path: "/src/a.txt", Size: 2},
+			{Path: "/src/b", Size: 3},
+		}
+
+		w, err := CreateIndex(indexFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries[:2] {
+			if err := w.Write(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Simulate a run killed while writing the second entry
+		partial := PartialIndexPath(indexFile)
+		info, err := os.Stat(partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(partial, info.Size()-3); err != nil {
+			t.Fatal(err)
+		}
+
+		var resumed []string
+		w, err = ResumeIndex(indexFile, func(e IndexEntry) {
+			resumed = append(resumed, e.Path)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resumed) != 1 || resumed[0] != "/src/a/x" || w.Count() != 1 {
+			t.Fatalf("%s: resumed %v, want the first complete entry", name, resumed)
+		}
+		for _, e := range entries[1:] {
+			if err := w.Write(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Fatalf("%s: partial file must be gone after commit", name)
+		}
+
+		loaded := readIndex(t, indexFile)
+		if len(loaded) != len(entries) {
+			t.Fatalf("%s: loaded %d entries, want %d", name, len(loaded), len(entries))
+		}
+		for i := range entries {
+			if loaded[i].Path != entries[i].Path || loaded[i].Size != entries[i].Size {
+				t.Fatalf("%s: entry %d is %+v, want %+v", name, i, loaded[i], entries[i])
+			}
+			if i > 0 && ComparePaths(loaded[i-1].Path, loaded[i].Path) >= 0 {
+				t.Fatalf("%s: entries are not in walk order", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"path"
+	"sort"
+
+	"github.com/minerdao/lotus-car/db"
+)
+
+// FileCids flattens the DAG tree and CID map returned by GenerateCar into one
+// entry per UnixFS node, ordered by path.
+func FileCids(ipldDag *FsNode, cidMap map[string]CidMapValue) []db.FileCid {
+	sizes := make(map[string]uint64)
+	if ipldDag != nil {
+		sizes[""] = ipldDag.Size
+		collectSizes("", ipldDag.Link, sizes)
+	}
+
+	cids := make([]db.FileCid, 0, len(cidMap))
+	for p, v := range cidMap {
+		cids = append(cids, db.FileCid{
+			Path:  p,
+			Cid:   v.Cid,
+			IsDir: v.IsDir,
+			Size:  sizes[p],
+		})
+	}
+	sort.Slice(cids, func(i, j int) bool {
+		return cids[i].Path < cids[j].Path
+	})
+	return cids
+}
+
+func collectSizes(prefix string, links []FsNode, sizes map[string]uint64) {
+	for _, ln := range links {
+		p := path.Join(prefix, ln.Name)
+		sizes[p] = ln.Size
+		collectSizes(p, ln.Link, sizes)
+	}
+}
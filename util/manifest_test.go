@@ -0,0 +1,59 @@
+package util
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCids(t *testing.T) {
+	parent := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(parent, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var fileList []Finfo
+	for name, size := range map[string]int{"d/a": 10, "d/b": 20} {
+		p := filepath.Join(parent, name)
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileList = append(fileList, Finfo{Path: p, Size: int64(size)})
+	}
+	if fileList[0].Path > fileList[1].Path {
+		fileList[0], fileList[1] = fileList[1], fileList[0]
+	}
+
+	ipldDag, root, cidMap, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cids := FileCids(ipldDag, cidMap)
+	expected := []struct {
+		path  string
+		isDir bool
+		size  uint64
+	}{
+		{"", true, 0},
+		{"d", true, 0},
+		{"d/a", false, 10},
+		{"d/b", false, 20},
+	}
+	if len(cids) != len(expected) {
+		t.Fatalf("expected %d entries, got %v", len(expected), cids)
+	}
+	for i, e := range expected {
+		c := cids[i]
+		if c.Path != e.path || c.IsDir != e.isDir {
+			t.Fatalf("entry %d: expected %s (dir %v), got %+v", i, e.path, e.isDir, c)
+		}
+		if !e.isDir && c.Size != e.size {
+			t.Fatalf("entry %s: expected size %d, got %d", c.Path, e.size, c.Size)
+		}
+	}
+	if cids[0].Cid != root {
+		t.Fatalf("root entry cid %s does not match root %s", cids[0].Cid, root)
+	}
+}
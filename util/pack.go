@@ -0,0 +1,166 @@
+package util
+
+import (
+	"sort"
+)
+
+// PackFiles distributes files into bins holding at most capacity bytes each,
+// using first-fit-decreasing. Every file is placed exactly once. Files larger
+// than capacity are split into slices: each full slice takes a bin of its own,
+// in consecutive bins, and the remainder is packed like any other file. Two
+// slices of the same path never share a bin. The result is deterministic for
+// the same input, and each bin is sorted by path.
+func PackFiles(fileList []Finfo, capacity int64) [][]Finfo {
+	sorted := make([]Finfo, len(fileList))
+	copy(sorted, fileList)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Len() != sorted[j].Len() {
+			return sorted[i].Len() > sorted[j].Len()
+		}
+		return sorted[i].Path < sorted[j].Path
+	})
+
+	var bins [][]Finfo
+	var used []int64
+	var paths []map[string]bool
+	var items []Finfo
+	for _, f := range sorted {
+		if f.Len() <= capacity {
+			items = append(items, f)
+			continue
+		}
+		end := f.End
+		if end == 0 {
+			end = f.Size
+		}
+		start := f.Start
+		for ; end-start > capacity; start += capacity {
+			bins = append(bins, []Finfo{{Path: f.Path, Size: f.Size, Start: start, End: start + capacity}})
+			used = append(used, capacity)
+			paths = append(paths, map[string]bool{f.Path: true})
+		}
+		if end > start {
+			items = append(items, Finfo{Path: f.Path, Size: f.Size, Start: start, End: end})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Len() > items[j].Len()
+	})
+
+	for _, f := range items {
+		placed := false
+		for i := range bins {
+			if used[i]+f.Len() <= capacity && !paths[i][f.Path] {
+				bins[i] = append(bins[i], f)
+				used[i] += f.Len()
+				paths[i][f.Path] = true
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			bins = append(bins, []Finfo{f})
+			used = append(used, f.Len())
+			paths = append(paths, map[string]bool{f.Path: true})
+		}
+	}
+
+	for _, bin := range bins {
+		sort.Slice(bin, func(i, j int) bool {
+			return bin[i].Path < bin[j].Path
+		})
+	}
+	return bins
+}
+
+// SelectBins returns the first n bins, extended by any later bin that holds a
+// slice of a file split across the selected ones, so that a file is never left
+// partially packed. n <= 0 selects all bins.
+func SelectBins(bins [][]Finfo, n int) [][]Finfo {
+	if n <= 0 || n >= len(bins) {
+		return bins
+	}
+
+	selected := make([]bool, len(bins))
+	split := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		selected[i] = true
+		for _, f := range bins[i] {
+			if f.IsSlice() {
+				split[f.Path] = true
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := n; i < len(bins); i++ {
+			if selected[i] {
+				continue
+			}
+			for _, f := range bins[i] {
+				if split[f.Path] {
+					selected[i] = true
+					changed = true
+					break
+				}
+			}
+			if !selected[i] {
+				continue
+			}
+			for _, f := range bins[i] {
+				if f.IsSlice() {
+					split[f.Path] = true
+				}
+			}
+		}
+	}
+
+	var result [][]Finfo
+	for i, bin := range bins {
+		if selected[i] {
+			result = append(result, bin)
+		}
+	}
+	return result
+}
+
+// BinSize returns the total number of source bytes held by a bin.
+func BinSize(bin []Finfo) int64 {
+	var total int64
+	for _, f := range bin {
+		total += f.Len()
+	}
+	return total
+}
+
+// UncoveredSlices returns the parts of f that none of the packed slices of the
+// same file cover, in file order. A packed slice with End 0 runs to the end of
+// the file. The whole file is returned as is when nothing of it is packed, and
+// nil when it is fully packed.
+func UncoveredSlices(f Finfo, packed []Finfo) []Finfo {
+	if len(packed) == 0 {
+		return []Finfo{f}
+	}
+	sorted := make([]Finfo, len(packed))
+	copy(sorted, packed)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var result []Finfo
+	var offset int64
+	for _, p := range sorted {
+		end := p.Start + p.Len()
+		if p.Start > offset {
+			result = append(result, Finfo{Path: f.Path, Size: f.Size, Start: offset, End: min(p.Start, f.Size)})
+		}
+		offset = max(offset, end)
+		if offset >= f.Size {
+			break
+		}
+	}
+	if offset < f.Size {
+		result = append(result, Finfo{Path: f.Path, Size: f.Size, Start: offset, End: f.Size})
+	}
+	return result
+}
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestPackFiles(t *testing.T) {
+	fileList := []Finfo{
+		{Path: "d/a", Size: 6},
+		{Path: "d/b", Size: 5},
+		{Path: "d/c", Size: 4},
+		{Path: "d/d", Size: 3},
+		{Path: "d/e", Size: 2},
+	}
+
+	bins := PackFiles(fileList, 10)
+	if len(bins) != 2 {
+		t.Fatalf("expected 2 bins, got %d: %v", len(bins), bins)
+	}
+
+	seen := make(map[string]bool)
+	for _, bin := range bins {
+		if size := BinSize(bin); size > 10 {
+			t.Fatalf("bin exceeds capacity: %d", size)
+		}
+		for i, f := range bin {
+			if seen[f.Path] {
+				t.Fatalf("file %s packed twice", f.Path)
+			}
+			seen[f.Path] = true
+			if i > 0 && bin[i-1].Path > f.Path {
+				t.Fatalf("bin is not sorted by path: %v", bin)
+			}
+		}
+	}
+	if len(seen) != 5 {
+		t.Fatalf("expected 5 packed files, got %d", len(seen))
+	}
+
+	again := PackFiles(fileList, 10)
+	for i := range bins {
+		for j := range bins[i] {
+			if bins[i][j] != again[i][j] {
+				t.Fatalf("packing is not deterministic")
+			}
+		}
+	}
+}
+
+func TestPackFilesSplit(t *testing.T) {
+	fileList := []Finfo{
+		{Path: "big", Size: 25},
+		{Path: "small", Size: 4},
+	}
+
+	bins := PackFiles(fileList, 10)
+	if len(bins) != 3 {
+		t.Fatalf("expected 3 bins, got %d: %v", len(bins), bins)
+	}
+	expected := []Finfo{
+		{Path: "big", Size: 25, Start: 0, End: 10},
+		{Path: "big", Size: 25, Start: 10, End: 20},
+	}
+	for i, f := range expected {
+		if len(bins[i]) != 1 || bins[i][0] != f {
+			t.Fatalf("bin %d: expected %v, got %v", i, f, bins[i])
+		}
+	}
+	last := bins[2]
+	if len(last) != 2 || last[0] != (Finfo{Path: "big", Size: 25, Start: 20, End: 25}) || last[1].Path != "small" {
+		t.Fatalf("unexpected last bin: %v", last)
+	}
+
+	if selected := SelectBins(bins, 1); len(selected) != 3 {
+		t.Fatalf("expected all bins of the split file to be selected, got %d", len(selected))
+	}
+}
+
+func TestPackFilesSameFileSlices(t *testing.T) {
+	fileList := []Finfo{
+		{Path: "big", Size: 30, Start: 0, End: 3},
+		{Path: "big", Size: 30, Start: 20, End: 24},
+	}
+
+	bins := PackFiles(fileList, 10)
+	if len(bins) != 2 {
+		t.Fatalf("expected slices of one file in separate bins, got %v", bins)
+	}
+}
+
+func TestUncoveredSlices(t *testing.T) {
+	f := Finfo{Path: "big", Size: 30}
+
+	if got := UncoveredSlices(Finfo{Path: "empty"}, nil); len(got) != 1 {
+		t.Fatalf("expected an empty file to be packed, got %v", got)
+	}
+	if got := UncoveredSlices(f, nil); len(got) != 1 || got[0] != f {
+		t.Fatalf("expected the whole file, got %v", got)
+	}
+	if got := UncoveredSlices(f, []Finfo{{Path: "big", Size: 30}}); got != nil {
+		t.Fatalf("expected nothing for a whole packed file, got %v", got)
+	}
+
+	packed := []Finfo{
+		{Path: "big", Size: 30, Start: 10, End: 20},
+		{Path: "big", Size: 30, Start: 0, End: 5},
+	}
+	got := UncoveredSlices(f, packed)
+	expected := []Finfo{
+		{Path: "big", Size: 30, Start: 5, End: 10},
+		{Path: "big", Size: 30, Start: 20, End: 30},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+
+	full := []Finfo{
+		{Path: "big", Size: 30, Start: 0, End: 10},
+		{Path: "big", Size: 30, Start: 10, End: 20},
+		{Path: "big", Size: 30, Start: 20, End: 30},
+	}
+	if got := UncoveredSlices(f, full); got != nil {
+		t.Fatalf("expected nothing for a fully covered file, got %v", got)
+	}
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"encoding/json"
+
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	"github.com/ipfs/go-merkledag"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// LayoutBalanced is the default UnixFS layout used by go-ipfs
+	LayoutBalanced = "balanced"
+	// LayoutTrickle is the layout produced by `ipfs add --trickle`
+	LayoutTrickle = "trickle"
+)
+
+// UnixfsParams controls how files are chunked into a UnixFS DAG. Two car files
+// built from the same files with different params have different CIDs, so the
+// params are saved with every car file and reused when it is regenerated.
+type UnixfsParams struct {
+	ChunkSize  uint64 `json:"chunk_size" yaml:"chunk_size"`
+	MaxLinks   int    `json:"max_links" yaml:"max_links"`
+	RawLeaves  bool   `json:"raw_leaves" yaml:"raw_leaves"`
+	CidVersion int    `json:"cid_version" yaml:"cid_version"`
+	Layout     string `json:"layout" yaml:"layout"`
+	// HamtThreshold shards directories holding more than this many entries.
+	// 0 keeps the go-unixfs default of sharding once a directory node
+	// exceeds 256KiB.
+	HamtThreshold int `json:"hamt_threshold,omitempty" yaml:"hamt_threshold"`
+}
+
+// DefaultUnixfsParams returns the params every car file was built with before
+// they became configurable
+func DefaultUnixfsParams() UnixfsParams {
+	return UnixfsParams{
+		ChunkSize:  UnixfsChunkSize,
+		MaxLinks:   UnixfsLinksPerLevel,
+		RawLeaves:  true,
+		CidVersion: 1,
+		Layout:     LayoutBalanced,
+	}
+}
+
+// Validate checks that the params describe a DAG go-unixfs can build
+func (p UnixfsParams) Validate() error {
+	if p.ChunkSize == 0 {
+		return xerrors.Errorf("chunk size must be greater than 0")
+	}
+	if p.ChunkSize > uint64(chunker.ChunkSizeLimit) {
+		return xerrors.Errorf("chunk size %d exceeds the maximum chunk size of %d", p.ChunkSize, chunker.ChunkSizeLimit)
+	}
+	if p.MaxLinks < 2 {
+		return xerrors.Errorf("max links must be at least 2, got %d", p.MaxLinks)
+	}
+	switch p.CidVersion {
+	case 0:
+		if p.RawLeaves {
+			return xerrors.Errorf("raw leaves require cid version 1")
+		}
+	case 1:
+	default:
+		return xerrors.Errorf("unsupported cid version %d", p.CidVersion)
+	}
+	if p.HamtThreshold < 0 {
+		return xerrors.Errorf("hamt threshold must not be negative, got %d", p.HamtThreshold)
+	}
+	if p.Layout != LayoutBalanced && p.Layout != LayoutTrickle {
+		return xerrors.Errorf("unsupported layout %q, expected %s or %s", p.Layout, LayoutBalanced, LayoutTrickle)
+	}
+	return nil
+}
+
+func (p UnixfsParams) cidBuilder() (cid.Builder, error) {
+	return merkledag.PrefixForCidVersion(p.CidVersion)
+}
+
+// ParseUnixfsParams parses params saved with a car file. Car files generated
+// before the params were saved have none and use DefaultUnixfsParams.
+func ParseUnixfsParams(s string) (UnixfsParams, error) {
+	if s == "" {
+		return DefaultUnixfsParams(), nil
+	}
+	var p UnixfsParams
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		return p, xerrors.Errorf("failed to parse unixfs params: %w", err)
+	}
+	return p, p.Validate()
+}
+
+// String returns the params in the form saved with a car file
+func (p UnixfsParams) String() string {
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+// UnixfsFlags returns the command line flags read by UnixfsParamsFromFlags
+func UnixfsFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.Uint64Flag{
+			Name:  "chunk-size",
+			Usage: "UnixFS chunk size in bytes, overrides unixfs.chunk_size in config",
+		},
+		&cli.IntFlag{
+			Name:  "max-links",
+			Usage: "Maximum UnixFS links per level, overrides unixfs.max_links in config",
+		},
+		&cli.BoolFlag{
+			Name:  "raw-leaves",
+			Usage: "Use raw blocks for UnixFS leaves, overrides unixfs.raw_leaves in config",
+		},
+		&cli.IntFlag{
+			Name:  "cid-version",
+			Usage: "CID version of the DAG, overrides unixfs.cid_version in config",
+		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "UnixFS layout, balanced or trickle, overrides unixfs.layout in config",
+		},
+		&cli.IntFlag{
+			Name:  "hamt-threshold",
+			Usage: "Shard directories holding more than this many entries as HAMT, overrides unixfs.hamt_threshold in config",
+		},
+	}
+}
+
+// UnixfsParamsFromFlags returns params overridden by any UnixfsFlags set on
+// the command line
+func UnixfsParamsFromFlags(c *cli.Context, params UnixfsParams) UnixfsParams {
+	if c.IsSet("chunk-size") {
+		params.ChunkSize = c.Uint64("chunk-size")
+	}
+	if c.IsSet("max-links") {
+		params.MaxLinks = c.Int("max-links")
+	}
+	if c.IsSet("raw-leaves") {
+		params.RawLeaves = c.Bool("raw-leaves")
+	}
+	if c.IsSet("cid-version") {
+		params.CidVersion = c.Int("cid-version")
+	}
+	if c.IsSet("layout") {
+		params.Layout = c.String("layout")
+	}
+	if c.IsSet("hamt-threshold") {
+		params.HamtThreshold = c.Int("hamt-threshold")
+	}
+	return params
+}
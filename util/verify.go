@@ -0,0 +1,289 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multihash"
+)
+
+// CarExpect is what a car file is recorded to be, empty or zero fields are
+// not checked
+type CarExpect struct {
+	CommP     string
+	DataCid   string
+	PieceSize uint64
+	CarSize   uint64
+}
+
+// CarVerifyResult describes a car file as found on disk. Problems lists every
+// difference from the expected values, a car file is valid when it is empty.
+type CarVerifyResult struct {
+	Path      string
+	Size      uint64
+	Version   int
+	Roots     []cid.Cid
+	CommP     cid.Cid
+	PieceSize uint64
+	Problems  []string
+}
+
+// OK reports whether the car file matched everything that was checked
+func (r *CarVerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CarVerifyResult) addProblem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyCarFile checks the size, header and root CID of a car file and
+// streams it through CalculateCommpHashHash to check its CommP and piece
+// size. A truncated or corrupted file is reported in the result, the error is
+// only set when the file cannot be read at all.
+func VerifyCarFile(path string, expect CarExpect) (*CarVerifyResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CarVerifyResult{Path: path, Size: uint64(fi.Size())}
+	if expect.CarSize > 0 && res.Size != expect.CarSize {
+		if res.Size < expect.CarSize {
+			res.addProblem("truncated: %d of %d bytes", res.Size, expect.CarSize)
+		} else {
+			res.addProblem("car size %d, expected %d", res.Size, expect.CarSize)
+		}
+	}
+
+	header, err := readCarHeader(f, res)
+	if err != nil {
+		res.addProblem("invalid car header: %v", err)
+	} else {
+		res.Roots = header.Roots
+		if expect.DataCid != "" && (len(header.Roots) != 1 || header.Roots[0].String() != expect.DataCid) {
+			res.addProblem("root %v, expected %s", header.Roots, expect.DataCid)
+		}
+	}
+
+	// A file of the wrong size can never have the expected CommP, so the
+	// expensive part is skipped for truncated files
+	if len(res.Problems) > 0 {
+		return res, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	commCid, pieceSize, err := CalculateCommpHashHash(f, expect.PieceSize)
+	if err != nil {
+		res.addProblem("failed to calculate commp: %v", err)
+		return res, nil
+	}
+	res.CommP = commCid
+	res.PieceSize = pieceSize
+	if expect.CommP != "" && commCid.String() != expect.CommP {
+		res.addProblem("commp %s, expected %s", commCid, expect.CommP)
+	}
+	if expect.PieceSize > 0 && pieceSize != expect.PieceSize {
+		res.addProblem("piece size %d, expected %d", pieceSize, expect.PieceSize)
+	}
+	return res, nil
+}
+
+// readCarHeader reads the CARv1 header of a CARv1 or CARv2 file and checks
+// that a CARv2 payload lies within the file
+func readCarHeader(f *os.File, res *CarVerifyResult) (*car.CarHeader, error) {
+	v2, ok, err := ReadCarV2Header(f)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	var payload io.Reader
+	if ok {
+		if err != nil {
+			return nil, err
+		}
+		res.Version = 2
+		if v2.DataOffset+v2.DataSize > res.Size {
+			res.addProblem("truncated: car v2 payload ends at %d of %d bytes", v2.DataOffset+v2.DataSize, res.Size)
+		}
+		payload = io.NewSectionReader(f, int64(v2.DataOffset), int64(v2.DataSize))
+	} else {
+		res.Version = 1
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		payload = f
+	}
+	return car.ReadHeader(bufio.NewReader(payload))
+}
+
+// maxListedMissing bounds the missing blocks listed in CarDAGResult.Problems
+const maxListedMissing = 10
+
+// CarDAGResult describes the blocks of a car file. Problems lists blocks that
+// do not hash to their CID and links to blocks missing from the car file, a
+// car file is complete when it is empty.
+type CarDAGResult struct {
+	Path     string
+	Blocks   int
+	Bytes    uint64
+	Missing  []cid.Cid // linked from the DAG but not in the car file
+	Stopped  bool      // the blocks could not be read to the end, so missing blocks are not known
+	Problems []string
+}
+
+// OK reports whether every block is valid and the DAG under the roots is
+// complete
+func (r *CarDAGResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// VerifyCarDAG reads every block of a CARv1 or CARv2 file, checks that each
+// block hashes to its CID and that every block linked from the roots is in
+// the car file. Only the CIDs are kept in memory, the blocks are streamed. A
+// block that does not match its CID is reported and the scan goes on with
+// the next one, a section that cannot be read stops the scan. A corrupted
+// file is reported in the result, the error is only set when the file cannot
+// be read at all.
+func VerifyCarDAG(path string) (*CarDAGResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CarDAGResult{Path: path}
+	var payload io.Reader = f
+	v2, ok, err := ReadCarV2Header(f)
+	if ok && err == nil {
+		payload = io.NewSectionReader(f, int64(v2.DataOffset), int64(v2.DataSize))
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if ok && v2.DataOffset+v2.DataSize > uint64(fi.Size()) {
+		res.Problems = append(res.Problems, fmt.Sprintf("truncated: car v2 payload ends at %d of %d bytes", v2.DataOffset+v2.DataSize, fi.Size()))
+	}
+
+	br := bufio.NewReaderSize(payload, 1<<20)
+	header, err := car.ReadHeader(br)
+	if err == nil && header.Version != 1 {
+		err = fmt.Errorf("invalid car version: %d", header.Version)
+	}
+	if err == nil && len(header.Roots) == 0 {
+		err = fmt.Errorf("empty car, no roots")
+	}
+	if err != nil {
+		res.Problems = append(res.Problems, fmt.Sprintf("invalid car header: %v", err))
+		return res, nil
+	}
+
+	// Blocks are written parents first, so a link usually points at a block
+	// that is yet to come. Whatever is still wanted at the end is missing.
+	seen := make(map[cid.Cid]struct{})
+	wanted := make(map[cid.Cid]struct{})
+	want := func(c cid.Cid) {
+		if c.Prefix().MhType == multihash.IDENTITY {
+			return
+		}
+		if _, ok := seen[c]; !ok {
+			wanted[c] = struct{}{}
+		}
+	}
+	for _, root := range header.Roots {
+		want(root)
+	}
+	for {
+		c, data, err := carutil.ReadNode(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The next section cannot be found, the rest of the file is unread
+			res.Problems = append(res.Problems, fmt.Sprintf("block %d: %v", res.Blocks+1, err))
+			res.Stopped = true
+			break
+		}
+		res.Blocks++
+		res.Bytes += uint64(len(data))
+		seen[c] = struct{}{}
+		delete(wanted, c)
+
+		// The section was read whole, a block not matching its CID is
+		// reported and its links are not followed
+		hashed, err := c.Prefix().Sum(data)
+		if err != nil {
+			res.Problems = append(res.Problems, fmt.Sprintf("block %s: failed to hash: %v", c, err))
+			continue
+		}
+		if !hashed.Equals(c) {
+			res.Problems = append(res.Problems, fmt.Sprintf("block %s: content hashes to %s", c, hashed))
+			continue
+		}
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			res.Problems = append(res.Problems, fmt.Sprintf("block %s: %v", c, err))
+			continue
+		}
+
+		var nd ipld.Node
+		switch blk.Cid().Type() {
+		case cid.Raw:
+			continue
+		case cid.DagProtobuf:
+			nd, err = dag.DecodeProtobufBlock(blk)
+		case cid.DagCBOR:
+			nd, err = cbor.DecodeBlock(blk)
+		default:
+			res.Problems = append(res.Problems, fmt.Sprintf("block %s: unsupported codec %#x, links not checked", blk.Cid(), blk.Cid().Type()))
+			continue
+		}
+		if err != nil {
+			res.Problems = append(res.Problems, fmt.Sprintf("block %s: failed to decode: %v", blk.Cid(), err))
+			continue
+		}
+		for _, l := range nd.Links() {
+			want(l.Cid)
+		}
+	}
+
+	if res.Stopped {
+		if len(wanted) > 0 {
+			res.Problems = append(res.Problems, fmt.Sprintf("%d linked blocks not verified, the scan stopped early", len(wanted)))
+		}
+		return res, nil
+	}
+	for c := range wanted {
+		res.Missing = append(res.Missing, c)
+	}
+	sort.Slice(res.Missing, func(i, j int) bool {
+		return res.Missing[i].KeyString() < res.Missing[j].KeyString()
+	})
+	for i, c := range res.Missing {
+		if i == maxListedMissing {
+			res.Problems = append(res.Problems, fmt.Sprintf("and %d more missing blocks", len(res.Missing)-i))
+			break
+		}
+		res.Problems = append(res.Problems, fmt.Sprintf("missing block %s", c))
+	}
+	return res, nil
+}
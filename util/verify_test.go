@@ -0,0 +1,216 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+)
+
+func TestVerifyCarFile(t *testing.T) {
+	parent := t.TempDir()
+	var fileList []Finfo
+	for i, size := range []int{10, 2 << 20} {
+		p := filepath.Join(parent, string(rune('a'+i)))
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileList = append(fileList, Finfo{Path: p, Size: int64(size)})
+	}
+
+	for _, version := range []int{1, 2} {
+		carPath := filepath.Join(t.TempDir(), "out.car")
+		out, err := os.Create(carPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, root, _, err := GenerateCar(context.TODO(), fileList, parent, "", CarOptions{CarVersion: version}, out)
+		out.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first pass records what the file is, the second checks it
+		first, err := VerifyCarFile(carPath, CarExpect{PieceSize: 8 << 20})
+		if err != nil || !first.OK() {
+			t.Fatalf("v%d: unexpected result %+v, %v", version, first, err)
+		}
+		if first.Version != version || len(first.Roots) != 1 || first.Roots[0].String() != root {
+			t.Fatalf("v%d: read version %d roots %v, want root %s", version, first.Version, first.Roots, root)
+		}
+		expect := CarExpect{
+			CommP:     first.CommP.String(),
+			DataCid:   root,
+			PieceSize: first.PieceSize,
+			CarSize:   first.Size,
+		}
+		if res, err := VerifyCarFile(carPath, expect); err != nil || !res.OK() {
+			t.Fatalf("v%d: valid car failed verification: %v, %v", version, res.Problems, err)
+		}
+
+		// Corrupt one byte in the middle of the file
+		f, err := os.OpenFile(carPath, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1)
+		f.ReadAt(b, int64(first.Size/2))
+		b[0] ^= 0xff
+		f.WriteAt(b, int64(first.Size/2))
+		f.Close()
+		if res, err := VerifyCarFile(carPath, expect); err != nil || res.OK() {
+			t.Fatalf("v%d: corrupted car passed verification: %v", version, err)
+		}
+
+		if err := os.Truncate(carPath, int64(first.Size-100)); err != nil {
+			t.Fatal(err)
+		}
+		res, err := VerifyCarFile(carPath, expect)
+		if err != nil || res.OK() {
+			t.Fatalf("v%d: truncated car passed verification: %v", version, err)
+		}
+	}
+}
+
+func TestVerifyCarDAG(t *testing.T) {
+	parent := t.TempDir()
+	var fileList []Finfo
+	for i, size := range []int{10, 3 << 20} {
+		p := filepath.Join(parent, string(rune('a'+i)))
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileList = append(fileList, Finfo{Path: p, Size: int64(size)})
+	}
+
+	dir := t.TempDir()
+	for _, version := range []int{1, 2} {
+		carPath := filepath.Join(dir, fmt.Sprintf("v%d.car", version))
+		out, err := os.Create(carPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = GenerateCar(context.TODO(), fileList, parent, "", CarOptions{CarVersion: version}, out)
+		out.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := VerifyCarDAG(carPath)
+		if err != nil || !res.OK() {
+			t.Fatalf("v%d: valid car failed verification: %+v, %v", version, res, err)
+		}
+		// root directory, two file roots and the three leaves of the large file
+		if res.Blocks != 6 {
+			t.Fatalf("v%d: read %d blocks, want 6", version, res.Blocks)
+		}
+	}
+
+	// Rewrite the CARv1 without its last block
+	in, err := os.Open(filepath.Join(dir, "v1.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	cr, err := car.NewCarReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blks []blocks.Block
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, blk)
+	}
+	writeCar := func(name string, blks []blocks.Block) string {
+		var buf bytes.Buffer
+		if err := car.WriteHeader(cr.Header, &buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range blks {
+			if err := carutil.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	missing := blks[len(blks)-1]
+	res, err := VerifyCarDAG(writeCar("missing.car", blks[:len(blks)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK() || len(res.Missing) != 1 || !res.Missing[0].Equals(missing.Cid()) {
+		t.Fatalf("expected block %s to be missing, got %v", missing.Cid(), res.Problems)
+	}
+
+	data := append([]byte{}, missing.RawData()...)
+	data[0] ^= 0xff
+	corrupt, err := blocks.NewBlockWithCid(data, missing.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = VerifyCarDAG(writeCar("corrupt.car", append(blks[:len(blks)-1:len(blks)-1], corrupt)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK() {
+		t.Fatalf("expected the corrupted block to fail verification")
+	}
+
+	// A corrupted block in the middle is the only problem, the blocks after
+	// it are still read
+	mid := blks[1]
+	data = append([]byte{}, mid.RawData()...)
+	data[len(data)-1] ^= 0xff
+	corrupt, err = blocks.NewBlockWithCid(data, mid.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCorrupt := append(append(append([]blocks.Block{}, blks[:1]...), corrupt), blks[2:]...)
+	res, err = VerifyCarDAG(writeCar("corrupt-middle.car", withCorrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Problems) != 1 || len(res.Missing) != 0 || res.Blocks != len(blks) {
+		t.Fatalf("expected one corrupted block and no missing ones, got %d blocks, %v", res.Blocks, res.Problems)
+	}
+
+	// A truncated file stops the scan, the blocks not read are not reported
+	// missing
+	full := writeCar("full.car", blks)
+	fi, err := os.Stat(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(full, fi.Size()-int64(len(missing.RawData())/2)); err != nil {
+		t.Fatal(err)
+	}
+	res, err = VerifyCarDAG(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK() || !res.Stopped || len(res.Missing) != 0 {
+		t.Fatalf("expected the scan of a truncated car to stop without missing blocks, got %+v", res)
+	}
+}
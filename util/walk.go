@@ -0,0 +1,189 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	SymlinkSkip   = "skip"   // ignore every symlink
+	SymlinkFiles  = "files"  // follow symlinks to files, skip symlinks to directories
+	SymlinkFollow = "follow" // follow symlinks to files and directories
+)
+
+// WalkOptions selects the source files WalkSource reports
+type WalkOptions struct {
+	// Include keeps only files matching one of the patterns, all files when
+	// empty. Exclude drops files and whole directories matching one of the
+	// patterns. A pattern containing a slash is matched against the path
+	// relative to the root, any other pattern against the base name, using
+	// filepath.Match syntax.
+	Include   []string
+	Exclude   []string
+	Symlinks  string // SymlinkSkip, SymlinkFiles or SymlinkFollow, empty means SymlinkFiles
+	SkipEmpty bool   // skip zero-byte files
+}
+
+// Validate checks the symlink policy and the glob patterns
+func (o WalkOptions) Validate() error {
+	switch o.Symlinks {
+	case "", SymlinkSkip, SymlinkFiles, SymlinkFollow:
+	default:
+		return xerrors.Errorf("unsupported symlink policy %q, expected %s, %s or %s", o.Symlinks, SymlinkSkip, SymlinkFiles, SymlinkFollow)
+	}
+	for _, p := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return xerrors.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// WalkError is an entry WalkSource could not read
+type WalkError struct {
+	Path string
+	Err  error
+}
+
+func (e WalkError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// WalkSource calls fn for every regular file under root selected by opts, in
+// lexical order. Entries that cannot be read, such as broken symlinks or
+// directories without permission, do not stop the walk and are returned
+// instead. An error returned by fn stops the walk and is returned as is.
+// info describes the file itself, or the target of a followed symlink.
+func WalkSource(root string, opts WalkOptions, fn func(path string, info os.FileInfo) error) ([]WalkError, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Symlinks == "" {
+		opts.Symlinks = SymlinkFiles
+	}
+	w := &sourceWalker{root: root, opts: opts, fn: fn}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.walkDir(root, []string{real}); err != nil {
+		return w.errs, err
+	}
+	return w.errs, nil
+}
+
+type sourceWalker struct {
+	root string
+	opts WalkOptions
+	fn   func(path string, info os.FileInfo) error
+	errs []WalkError
+}
+
+func (w *sourceWalker) report(p string, err error) {
+	w.errs = append(w.errs, WalkError{Path: p, Err: err})
+}
+
+// walkDir walks one directory. ancestors holds the real paths of the
+// directories above it, so a symlink pointing back up is not followed forever.
+func (w *sourceWalker) walkDir(dir string, ancestors []string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.report(dir, err)
+		return nil
+	}
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		rel, err := filepath.Rel(w.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if matchAny(w.opts.Exclude, rel, entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			w.report(p, err)
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if w.opts.Symlinks == SymlinkSkip {
+				continue
+			}
+			info, err = os.Stat(p)
+			if err != nil {
+				w.report(p, xerrors.Errorf("broken symlink: %w", err))
+				continue
+			}
+			if info.IsDir() {
+				if w.opts.Symlinks != SymlinkFollow {
+					continue
+				}
+				real, err := filepath.EvalSymlinks(p)
+				if err != nil {
+					w.report(p, err)
+					continue
+				}
+				if containsString(ancestors, real) {
+					w.report(p, xerrors.Errorf("symlink loop to %s", real))
+					continue
+				}
+				if err := w.walkDir(p, append(ancestors, real)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if info.IsDir() {
+			real := filepath.Join(ancestors[len(ancestors)-1], entry.Name())
+			if err := w.walkDir(p, append(ancestors, real)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if w.opts.SkipEmpty && info.Size() == 0 {
+			continue
+		}
+		if len(w.opts.Include) > 0 && !matchAny(w.opts.Include, rel, entry.Name()) {
+			continue
+		}
+		if err := w.fn(p, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchAny reports whether a path matches one of the patterns, see
+// WalkOptions for how patterns are matched
+func matchAny(patterns []string, rel, name string) bool {
+	for _, p := range patterns {
+		target := name
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkSource(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	files := map[string]string{
+		"a.txt":          "a",
+		"empty.txt":      "",
+		".DS_Store":      "x",
+		"sub/b.txt":      "b",
+		"sub/c.tmp":      "c",
+		"tmp/d.txt":      "d",
+		"loop/e.txt":     "e",
+		"sub/deep/g.txt": "g",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "f.txt"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"link.txt":  filepath.Join(root, "a.txt"),
+		"broken":    filepath.Join(root, "missing"),
+		"outside":   outside,
+		"loop/back": root,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	walk := func(opts WalkOptions) ([]string, []string) {
+		var paths, errPaths []string
+		errs, err := WalkSource(root, opts, func(p string, info os.FileInfo) error {
+			rel, _ := filepath.Rel(root, p)
+			paths = append(paths, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range errs {
+			rel, _ := filepath.Rel(root, e.Path)
+			errPaths = append(errPaths, filepath.ToSlash(rel))
+		}
+		return paths, errPaths
+	}
+
+	paths, errs := walk(WalkOptions{Exclude: []string{".DS_Store", "*.tmp", "tmp"}, SkipEmpty: true})
+	want := []string{"a.txt", "link.txt", "loop/e.txt", "sub/b.txt", "sub/deep/g.txt"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("files policy: got %v, want %v", paths, want)
+	}
+	if !reflect.DeepEqual(errs, []string{"broken"}) {
+		t.Fatalf("files policy: got errors %v, want the broken symlink", errs)
+	}
+
+	paths, errs = walk(WalkOptions{Symlinks: SymlinkFollow, Include: []string{"*.txt"}, Exclude: []string{"sub/deep"}})
+	want = []string{"a.txt", "empty.txt", "link.txt", "loop/e.txt", "outside/f.txt", "sub/b.txt", "tmp/d.txt"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("follow policy: got %v, want %v", paths, want)
+	}
+	if !reflect.DeepEqual(errs, []string{"broken", "loop/back"}) {
+		t.Fatalf("follow policy: got errors %v, want the broken symlink and the loop", errs)
+	}
+
+	paths, errs = walk(WalkOptions{Symlinks: SymlinkSkip, Include: []string{"*.txt"}})
+	want = []string{"a.txt", "empty.txt", "loop/e.txt", "sub/b.txt", "sub/deep/g.txt", "tmp/d.txt"}
+	if !reflect.DeepEqual(paths, want) || len(errs) != 0 {
+		t.Fatalf("skip policy: got %v with errors %v, want %v", paths, errs, want)
+	}
+
+	if err := (WalkOptions{Symlinks: "always"}).Validate(); err == nil {
+		t.Fatalf("expected unknown symlink policy to be rejected")
+	}
+	if err := (WalkOptions{Exclude: []string{"["}}).Validate(); err == nil {
+		t.Fatalf("expected bad pattern to be rejected")
+	}
+}